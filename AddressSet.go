@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/binary"
+	"bytes"
 	"net"
 	"sort"
 	"strings"
@@ -17,13 +17,13 @@ type AddressSet interface {
 
 type AddressSetImpl struct {
 
-	addresses []uint32
+	addresses []ipKey
 
 }
 
 func NewAddressSet(addressList string) AddressSet {
 	as := &AddressSetImpl{
-		make([]uint32, 0, 10),
+		make([]ipKey, 0, 10),
 	}
 	for _, address := range strings.Split(addressList, ",") {
 		trimmed := strings.TrimSpace(address)
@@ -34,39 +34,35 @@ func NewAddressSet(addressList string) AddressSet {
 	return as
 }
 
-func (as *AddressSetImpl) add(ip uint32) {
+func (as *AddressSetImpl) add(ip ipKey) {
 	as.addresses = append(as.addresses, ip)
 	sort.Slice(as.addresses, func(i, j int) bool {
-		return as.addresses[i] < as.addresses[j]
+		return bytes.Compare(as.addresses[i][:], as.addresses[j][:]) < 0
 	})
 }
 
 func (as *AddressSetImpl) Add(ip net.IP) {
-	as.add(as.ipToUint32(ip))
+	if ip == nil {
+		Error.Printf("Bad address in address set\n")
+		return
+	}
+	as.add(toIPKey(ip))
 }
 
-func (as *AddressSetImpl) find(i, j int, target uint32) bool {
+func (as *AddressSetImpl) find(i, j int, target ipKey) bool {
 	if i >= j {
 		return false
 	}
 	mid := i + (j - i) / 2
 	if as.addresses[mid] == target {
 		return true
-	} else if target < as.addresses[mid] {
+	} else if bytes.Compare(target[:], as.addresses[mid][:]) < 0 {
 		return as.find(i, mid, target)
 	}
 	return as.find(mid + 1, j, target)
 }
 
-func (as *AddressSetImpl) ipToUint32(ip net.IP) uint32 {
-	if len(ip) == 16 {
-		return binary.BigEndian.Uint32(ip[12:16])
-	} else {
-		return binary.BigEndian.Uint32(ip)
-	}
-}
-
 func (as *AddressSetImpl) Test(ip net.IP) bool {
-	return as.find(0, len(as.addresses), as.ipToUint32(ip))
+	return as.find(0, len(as.addresses), toIPKey(ip))
 
 }
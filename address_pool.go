@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Lease is the inner addressing the server pushes to a client in its welcome
+type Lease struct {
+	addr net.IP
+	phantom net.IP
+	gateway net.IP
+	prefix int
+	dns []net.IP
+	mtu int
+}
+
+const (
+	leaseAddr byte = 1
+	leasePhantom byte = 2
+	leaseGateway byte = 3
+	leaseDNS byte = 4
+	leaseMTU byte = 5
+)
+
+func (l *Lease) String() string {
+	return fmt.Sprintf("%v/%d", l.addr, l.prefix)
+}
+
+func appendOption(b []byte, t byte, value []byte) []byte {
+	b = append(b, t, byte(len(value)))
+	return append(b, value...)
+}
+
+func (l *Lease) Marshal() []byte {
+	var b []byte
+	b = appendOption(b, leaseAddr, append(copyBytes(l.addr.To4()), byte(l.prefix)))
+	b = appendOption(b, leasePhantom, l.phantom.To4())
+	b = appendOption(b, leaseGateway, l.gateway.To4())
+	for _, dns := range l.dns {
+		b = appendOption(b, leaseDNS, dns.To4())
+	}
+	if l.mtu > 0 {
+		mtu := make([]byte, 2)
+		binary.BigEndian.PutUint16(mtu, uint16(l.mtu))
+		b = appendOption(b, leaseMTU, mtu)
+	}
+	return b
+}
+
+func ParseLease(b []byte) (*Lease, error) {
+	l := &Lease{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2 + int(b[1]) {
+			return nil, errors.New("truncated lease option")
+		}
+		t, value := b[0], b[2:2+int(b[1])]
+		b = b[2+int(b[1]):]
+		switch t {
+		case leaseAddr:
+			if len(value) != 5 {
+				return nil, errors.New("bad lease address")
+			}
+			l.addr = copyIP(value[:4])
+			l.prefix = int(value[4])
+		case leasePhantom:
+			l.phantom = copyIP(value)
+		case leaseGateway:
+			l.gateway = copyIP(value)
+		case leaseDNS:
+			l.dns = append(l.dns, copyIP(value))
+		case leaseMTU:
+			if len(value) != 2 {
+				return nil, errors.New("bad lease mtu")
+			}
+			l.mtu = int(binary.BigEndian.Uint16(value))
+		}
+	}
+	if l.addr == nil {
+		return nil, errors.New("lease without address")
+	}
+	return l, nil
+}
+
+// AddressPool leases every client name a pair of addresses, the address of its
+// device and its phantom address. The pair is picked by hashing the name so a
+// client usually gets the same lease after the server restarts. A lease is
+// held by every session of the name and is freed once all of them are gone
+type AddressPool struct {
+	lock sync.Mutex
+	network uint32
+	prefix int
+	gateway net.IP
+	dns []net.IP
+	mtu int
+	leases map[string]*Lease
+	holders map[string]int
+	used map[uint32]string
+}
+
+func NewAddressPool(cidr string, dns string, mtu int) (*AddressPool, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, errors.New("only IPv4 pool is supported")
+	}
+	prefix, _ := ipNet.Mask.Size()
+	if prefix > 29 {
+		return nil, errors.New("pool is too small")
+	}
+	if prefix < 8 {
+		return nil, errors.New("pool is too large")
+	}
+	network := binary.BigEndian.Uint32(ipNet.IP.To4())
+	p := &AddressPool{
+		network: network,
+		prefix: prefix,
+		gateway: uint32ToIP(network + 1),
+		mtu: mtu,
+		leases: make(map[string]*Lease),
+		holders: make(map[string]int),
+		used: make(map[uint32]string),
+	}
+	for _, server := range strings.Split(dns, ",") {
+		if trimmed := strings.TrimSpace(server); trimmed != "" {
+			p.dns = append(p.dns, net.ParseIP(trimmed))
+		}
+	}
+	return p, nil
+}
+
+func uint32ToIP(ip uint32) net.IP {
+	return net.IPv4(byte(ip >> 24), byte(ip >> 16), byte(ip >> 8), byte(ip)).To4()
+}
+
+func (p *AddressPool) Gateway() net.IP {
+	return p.gateway
+}
+
+func (p *AddressPool) Prefix() int {
+	return p.prefix
+}
+
+func (p *AddressPool) Lease(name string) (*Lease, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if l, ok := p.leases[name]; ok {
+		p.holders[name]++
+		return l, nil
+	}
+
+	// pairs start after the network and gateway addresses and end before broadcast
+	pairs := uint32(1 << uint(32 - p.prefix)) / 2 - 2
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	start := h.Sum32() % pairs
+	for i := uint32(0); i < pairs; i++ {
+		addr := p.network + 2 + (start + i) % pairs * 2
+		if _, ok := p.used[addr]; ok {
+			continue
+		}
+		p.used[addr] = name
+		l := &Lease{
+			uint32ToIP(addr),
+			uint32ToIP(addr + 1),
+			p.gateway,
+			p.prefix,
+			p.dns,
+			p.mtu,
+		}
+		p.leases[name] = l
+		p.holders[name] = 1
+		Info.Printf("lease %v to %s\n", l, name)
+		return l, nil
+	}
+	return nil, errors.New("address pool exhausted")
+}
+
+// Release drops a holder of the lease of name, its addresses may be leased
+// to another name once nobody holds it
+func (p *AddressPool) Release(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	l, ok := p.leases[name]
+	if !ok {
+		return
+	}
+	if p.holders[name]--; p.holders[name] > 0 {
+		return
+	}
+	delete(p.leases, name)
+	delete(p.holders, name)
+	delete(p.used, binary.BigEndian.Uint32(l.addr.To4()))
+	Info.Printf("lease %v of %s released\n", l, name)
+}
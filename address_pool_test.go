@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressPoolLease(t *testing.T) {
+	pool, err := NewAddressPool("10.8.0.0/24", "8.8.8.8, 1.1.1.1", 1400)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	if !pool.Gateway().Equal(net.IPv4(10, 8, 0, 1)) {
+		t.Errorf("Expect gateway 10.8.0.1, but got %v", pool.Gateway())
+	}
+
+	seen := make(map[string]string)
+	for _, name := range []string { "alice", "bob", "carol", "dave" } {
+		lease, err := pool.Lease(name)
+		if err != nil {
+			t.Fatalf("Failed to lease to %s: %v", name, err)
+		}
+		for _, ip := range []net.IP { lease.addr, lease.phantom } {
+			if owner, ok := seen[ip.String()]; ok {
+				t.Errorf("%v leased to both %s and %s", ip, owner, name)
+			}
+			seen[ip.String()] = name
+			if ip[3] < 2 || ip[3] > 254 {
+				t.Errorf("%v leased to %s is reserved", ip, name)
+			}
+		}
+		again, _ := pool.Lease(name)
+		if !again.addr.Equal(lease.addr) {
+			t.Errorf("Expect same lease of %s, but got %v and %v", name, lease, again)
+		}
+	}
+}
+
+func TestAddressPoolExhausted(t *testing.T) {
+	pool, _ := NewAddressPool("10.8.0.0/29", "", 0)
+	for _, name := range []string { "alice", "bob" } {
+		if _, err := pool.Lease(name); err != nil {
+			t.Fatalf("Failed to lease to %s: %v", name, err)
+		}
+	}
+	if _, err := pool.Lease("carol"); err == nil {
+		t.Errorf("Expect pool exhausted")
+	}
+}
+
+func TestAddressPoolRelease(t *testing.T) {
+	pool, _ := NewAddressPool("10.8.0.0/29", "", 0)
+	for _, name := range []string { "alice", "alice", "bob" } {
+		if _, err := pool.Lease(name); err != nil {
+			t.Fatalf("Failed to lease to %s: %v", name, err)
+		}
+	}
+	pool.Release("alice")
+	if _, err := pool.Lease("carol"); err == nil {
+		t.Errorf("Expect lease of alice kept while held")
+	}
+	pool.Release("alice")
+	if _, err := pool.Lease("carol"); err != nil {
+		t.Errorf("Expect lease of alice free once released but got %v", err)
+	}
+	pool.Release("nobody")
+}
+
+func TestAddressPoolSize(t *testing.T) {
+	tests := []struct { cidr string; expect bool } {
+		{ "10.0.0.0/0", false },
+		{ "10.0.0.0/7", false },
+		{ "10.0.0.0/8", true },
+		{ "10.8.0.0/29", true },
+		{ "10.8.0.0/30", false },
+	}
+	for _, test := range tests {
+		if _, err := NewAddressPool(test.cidr, "", 0); (err == nil) != test.expect {
+			t.Errorf("Expect pool %s accepted %v, but got %v", test.cidr, test.expect, err)
+		}
+	}
+}
+
+func TestLeaseMarshal(t *testing.T) {
+	pool, _ := NewAddressPool("10.8.0.0/16", "8.8.8.8,1.1.1.1", 1400)
+	lease, _ := pool.Lease("alice")
+	parsed, err := ParseLease(lease.Marshal())
+	if err != nil {
+		t.Fatalf("Failed to parse lease: %v", err)
+	}
+	if !parsed.addr.Equal(lease.addr) || !parsed.phantom.Equal(lease.phantom) || !parsed.gateway.Equal(lease.gateway) ||
+		parsed.prefix != 16 || parsed.mtu != 1400 || len(parsed.dns) != 2 || !parsed.dns[1].Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Errorf("Expect %+v, but got %+v", lease, parsed)
+	}
+	if _, err := ParseLease(lease.Marshal()[:3]); err == nil {
+		t.Errorf("Expect truncated lease rejected")
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"container/heap"
-	"encoding/binary"
 	"net"
 	"sync"
 	"time"
@@ -16,20 +15,24 @@ type AddressQueue interface {
 
 	IPDomains(ip net.IP) []string
 
+	IPs() []net.IP
+
+	Len() int
+
 }
 
 type AddressQueueImpl struct {
 	pq             PriorityQueue
-	validBefore    map[uint32]int64
-	ip2DomainCount map[uint32]map[string]uint32
+	validBefore    map[ipKey]int64
+	ip2DomainCount map[ipKey]map[string]uint32
 	lock           sync.Mutex
 }
 
 func NewAddressQueue() AddressQueue {
 	ret := AddressQueueImpl{
 		make(PriorityQueue, 0, 16),
-		make(map[uint32]int64),
-		make(map[uint32]map[string]uint32),
+		make(map[ipKey]int64),
+		make(map[ipKey]map[string]uint32),
 		sync.Mutex{},
 	}
 	return &ret
@@ -41,7 +44,7 @@ func (aq *AddressQueueImpl) expire() {
 	for len(aq.pq) > 0 && aq.pq[0].ttl < now {
 		record := heap.Pop(&aq.pq).(*Record)
 
-		ip := binary.BigEndian.Uint32(record.ip.To4())
+		ip := toIPKey(record.ip)
 		if validBefore, ok := aq.validBefore[ip]; ok && validBefore < now {
 			delete(aq.validBefore, ip)
 			delete(aq.ip2DomainCount[ip], "*")
@@ -62,7 +65,7 @@ func (aq *AddressQueueImpl) expire() {
 func (aq *AddressQueueImpl) add(expiredAt int64, ip net.IP, domain string) {
 	heap.Push(&aq.pq, &Record {expiredAt, domain, copyIP(ip)})
 
-	ipVal := binary.BigEndian.Uint32(ip.To4())
+	ipVal := toIPKey(ip)
 	if domainCount, ok := aq.ip2DomainCount[ipVal]; ok {
 		domainCount[domain]++
 	} else {
@@ -84,7 +87,7 @@ func (aq *AddressQueueImpl) Add(ttlMs int64, ip net.IP, domain string) {
 }
 
 func (aq *AddressQueueImpl) visit(ip net.IP) {
-	ipVal := binary.BigEndian.Uint32(ip.To4())
+	ipVal := toIPKey(ip)
 
 	domain := "*"
 	if domainCount, ok := aq.ip2DomainCount[ipVal]; ok {
@@ -101,7 +104,7 @@ func (aq *AddressQueueImpl) TestIP(ip net.IP) bool {
 
 	aq.expire()
 
-	key := binary.BigEndian.Uint32(ip.To4())
+	key := toIPKey(ip)
 	_, ok := aq.ip2DomainCount[key]
 	return ok
 }
@@ -110,7 +113,9 @@ func (aq *AddressQueueImpl) IPDomains(ip net.IP) []string {
 	aq.lock.Lock()
 	defer aq.lock.Unlock()
 
-	key := binary.BigEndian.Uint32(ip.To4())
+	aq.expire()
+
+	key := toIPKey(ip)
 	domainCount, ok := aq.ip2DomainCount[key]
 	if ok {
 		domains := make([]string, len(domainCount))
@@ -124,6 +129,29 @@ func (aq *AddressQueueImpl) IPDomains(ip net.IP) []string {
 	return []string {}
 }
 
+func (aq *AddressQueueImpl) IPs() []net.IP {
+	aq.lock.Lock()
+	defer aq.lock.Unlock()
+
+	aq.expire()
+
+	ips := make([]net.IP, 0, len(aq.ip2DomainCount))
+	for key := range aq.ip2DomainCount {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, key[:])
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// Len is the number of addresses in the queue
+func (aq *AddressQueueImpl) Len() int {
+	aq.lock.Lock()
+	defer aq.lock.Unlock()
+
+	return len(aq.ip2DomainCount)
+}
+
 func (aq *AddressQueueImpl) copy() PriorityQueue {
 	aq.lock.Lock()
 	defer aq.lock.Unlock()
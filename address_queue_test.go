@@ -112,3 +112,35 @@ func TestAddExpire2(t *testing.T) {
 		return
 	}
 }
+
+func TestAddIPv6(t *testing.T) {
+	aq := NewAddressQueue()
+	ip := net.ParseIP("2001:4860:4860::8888")
+	aq.Add(1000, ip, "dns.google.com")
+
+	if !aq.TestIP(ip) {
+		t.Errorf("Expect IP: %v existed", ip)
+	}
+	// the low 32 bits must not alias an IPv4 address
+	if aq.TestIP(net.IPv4(0, 0, 0x88, 0x88)) {
+		t.Errorf("Expect IP: %v not existed", net.IPv4(0, 0, 0x88, 0x88))
+	}
+	found := false
+	for _, domain := range aq.IPDomains(ip) {
+		found = found || domain == "dns.google.com"
+	}
+	if !found {
+		t.Errorf("Expect dns.google.com in domains of %v but got %v", ip, aq.IPDomains(ip))
+	}
+}
+
+func TestLen(t *testing.T) {
+	aq := NewAddressQueue()
+	aq.Add(1000, net.IPv4(1, 1, 1, 1), "one.one.one.one")
+	aq.Add(1000, net.IPv4(1, 1, 1, 1), "cloudflare-dns.com")
+	aq.Add(1000, net.IPv4(1, 0, 0, 1), "one.one.one.one")
+
+	if aq.Len() != 2 || len(aq.IPs()) != 2 {
+		t.Errorf("Expect 2 addresses, but got %d %v", aq.Len(), aq.IPs())
+	}
+}
@@ -31,6 +31,14 @@ func (aq *AddressQueueWithPersistenceImpl) IPDomains(ip net.IP) []string {
 	return aq.addressQueue.IPDomains(ip)
 }
 
+func (aq *AddressQueueWithPersistenceImpl) IPs() []net.IP {
+	return aq.addressQueue.IPs()
+}
+
+func (aq *AddressQueueWithPersistenceImpl) Len() int {
+	return aq.addressQueue.Len()
+}
+
 func NewAddressQueueWithPersistence(filename string) AddressQueue {
 	ret := AddressQueueWithPersistenceImpl {
 		NewAddressQueue().(*AddressQueueImpl),
@@ -42,11 +50,13 @@ func NewAddressQueueWithPersistence(filename string) AddressQueue {
 
 	ret.restore()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		ret.flush()
+		if _, err := ret.Flush(); err != nil {
+			Error.Printf("Failed to flush records to %s, %v\n", ret.persistFile, err)
+		}
 		os.Exit(0)
 	}()
 
@@ -54,8 +64,15 @@ func NewAddressQueueWithPersistence(filename string) AddressQueue {
 }
 
 func (aq *AddressQueueWithPersistenceImpl) restore() {
+	n := readAddressRecords(aq.persistFile, aq.addressQueue)
+	Info.Printf("Read %d records from %s\n", n, aq.persistFile)
+}
+
+// readAddressRecords adds the records persisted in filename to queue before
+// it is shared, it tells how many are read
+func readAddressRecords(filename string, queue *AddressQueueImpl) int {
 	n := 0
-	ReadLine(aq.persistFile, func(line string) {
+	ReadLine(filename, func(line string) {
 		line = strings.TrimSuffix(line, "\n")
 		content := strings.Split(line, " ")
 		if len(content) != 3 {
@@ -72,51 +89,58 @@ func (aq *AddressQueueWithPersistenceImpl) restore() {
 			Error.Printf("Bad line of IP: %s\n", line)
 			return
 		}
-		aq.addressQueue.add(expiredAt, ip, content[2])
+		queue.add(expiredAt, ip, content[2])
 		n++
 	})
-	Info.Printf("Read %d records from %s\n", n, aq.persistFile)
+	return n
 }
 
 func (aq *AddressQueueWithPersistenceImpl) persist(copied PriorityQueue) {
 	go func() {
-		aq.flock.Lock()
-		defer aq.flock.Unlock()
-
-		fo, err := os.Create(aq.persistFile)
-		if err != nil {
+		if err := aq.write(copied); err != nil {
 			Error.Printf("Failed to persist address to %s, %v\n", aq.persistFile, err)
-			return
-		}
-		defer func() {
-			if err := fo.Close(); err != nil {
-				Error.Printf("Failed to close persist file %s, %v\n", aq.persistFile, err)
-			}
-		}()
-		w := bufio.NewWriter(fo)
-		for _, record := range copied {
-			bytes := fmt.Sprintf("%d %s %s\n",
-				record.ttl,
-				record.ip.String(),
-				record.domain)
-			_, err := w.WriteString(bytes)
-			if err != nil {
-				Error.Printf("Failed to write record. %v\n", err)
-				break
-			}
 		}
-		if err := w.Flush(); err != nil {
-			Error.Printf("Failed to flush. %v\n", err)
+	}()
+}
+
+func (aq *AddressQueueWithPersistenceImpl) write(copied PriorityQueue) error {
+	aq.flock.Lock()
+	defer aq.flock.Unlock()
+
+	fo, err := os.Create(aq.persistFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := fo.Close(); err != nil {
+			Error.Printf("Failed to close persist file %s, %v\n", aq.persistFile, err)
 		}
 	}()
+	w := bufio.NewWriter(fo)
+	for _, record := range copied {
+		bytes := fmt.Sprintf("%d %s %s\n",
+			record.ttl,
+			record.ip.String(),
+			record.domain)
+		if _, err := w.WriteString(bytes); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
 }
 
-func (aq *AddressQueueWithPersistenceImpl) flush() {
+// Flush writes the records to the persist file before returning, it returns
+// how many are written
+func (aq *AddressQueueWithPersistenceImpl) Flush() (int, error) {
 	copied := aq.addressQueue.copy()
-	if copied != nil && len(copied) > 0 {
-		Info.Printf("Flushed %d records\n", len(copied))
-		aq.persist(copied)
+	if len(copied) == 0 {
+		return 0, nil
+	}
+	if err := aq.write(copied); err != nil {
+		return 0, err
 	}
+	Info.Printf("Flushed %d records\n", len(copied))
+	return len(copied), nil
 }
 
 func (aq *AddressQueueWithPersistenceImpl) Add(ttlMs int64, ip net.IP, domain string) {
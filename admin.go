@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// flusher is implemented by address queues which persist their records
+type flusher interface {
+
+	Flush() (int, error)
+
+}
+
+// AdminAPI lets a running client be inspected and changed through HTTP with
+// JSON bodies. As it can reroute traffic it is served on localhost or a unix
+// socket only. On localhost a bearer token is required, any web page the user
+// opens may send requests there, while the socket is kept to the user by its
+// permissions
+type AdminAPI struct {
+	ctx *Context
+	token string
+	blockedFile string
+}
+
+func NewAdminAPI(ctx *Context, token, blockedFile string) *AdminAPI {
+	return &AdminAPI{ ctx, token, blockedFile }
+}
+
+type blockedAddress struct {
+	IP string `json:"ip"`
+	Domains []string `json:"domains"`
+}
+
+type domainChange struct {
+	Domain string `json:"domain"`
+	Changed bool `json:"changed"`
+}
+
+func (a *AdminAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocked/addresses", a.blockedAddresses)
+	mux.HandleFunc("/blocked/domains", a.blockedDomains)
+	mux.HandleFunc("/blocked/flush", a.flushRecords)
+	mux.HandleFunc("/global", a.global)
+	mux.HandleFunc("/tunnel", a.tunnel)
+	mux.HandleFunc("/explain", a.explain)
+	return a.authorized(mux)
+}
+
+// Start serves the API on address, either host:port of localhost or
+// unix:path of a socket
+func (a *AdminAPI) Start(address string) error {
+	if a.token == "" && !strings.HasPrefix(address, "unix:") {
+		return errors.New("admin_token is required unless the admin API listens on a unix socket")
+	}
+	listener, err := listenAdmin(address)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, a.Handler()); err != nil {
+			Error.Printf("Admin API stopped: %v\n", err)
+		}
+	}()
+	Info.Printf("Serving admin API at %v\n", listener.Addr())
+	return nil
+}
+
+func listenAdmin(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		path := strings.TrimPrefix(address, "unix:")
+		// a socket left behind by the previous run is in the way
+		if info, err := os.Lstat(path); err == nil && info.Mode() & os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(path, 0600); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("admin API must listen on localhost or a unix socket, not " + address)
+	}
+	return net.Listen("tcp", address)
+}
+
+func (a *AdminAPI) authorized(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("bad token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Debug.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{ "error": err.Error() })
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, errors.New(r.Method + " not allowed on " + r.URL.Path))
+}
+
+// blockedAddresses lists the addresses resolved from blocked domains with
+// the domains they are resolved from
+func (a *AdminAPI) blockedAddresses(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	addresses := make([]blockedAddress, 0)
+	for _, ip := range a.ctx.blockedIp.IPs() {
+		domains := a.ctx.blockedIp.IPDomains(ip)
+		sort.Strings(domains)
+		addresses = append(addresses, blockedAddress{ ip.String(), domains })
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].IP < addresses[j].IP
+	})
+	writeJSON(w, http.StatusOK, addresses)
+}
+
+// blockedDomains lists, adds to or removes from the blocked domains. The
+// list is edited in its file so that a change outlives the client
+func (a *AdminAPI) blockedDomains(w http.ResponseWriter, r *http.Request) {
+	var domain string
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		domains, err := readBlockedList(a.blockedFile)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if domains == nil {
+			domains = []string{}
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{ "domains": domains })
+		return
+	case http.MethodPost:
+		var body struct {
+			Domain string `json:"domain"`
+		}
+		if err = json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		domain = body.Domain
+	case http.MethodDelete:
+		domain = r.URL.Query().Get("domain")
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if domain, err = normalizeDomain(domain); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var changed bool
+	if r.Method == http.MethodPost {
+		changed, err = addToBlockedList(a.blockedFile, domain)
+	} else {
+		changed, err = removeFromBlockedList(a.blockedFile, domain)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if r.Method == http.MethodDelete && !changed {
+		writeError(w, http.StatusNotFound, errors.New(domain + " is not blocked"))
+		return
+	}
+	if changed {
+		if r.Method == http.MethodPost {
+			Info.Printf("Blocked %s through admin API\n", domain)
+		} else {
+			Info.Printf("Unblocked %s through admin API\n", domain)
+		}
+		// the watcher reloads as well, but the change applies before responding
+		a.ctx.blocked.Store(NewDomainTrie(a.blockedFile))
+	}
+	writeJSON(w, http.StatusOK, domainChange{ domain, changed })
+}
+
+// flushRecords writes the blocked addresses to their file at once
+func (a *AdminAPI) flushRecords(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, r)
+		return
+	}
+	f, ok := a.ctx.blockedIp.(flusher)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, errors.New("blocked addresses are not persisted"))
+		return
+	}
+	n, err := f.Flush()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{ "flushed": n })
+}
+
+// global tells or switches whether every packet goes through the tunnel
+func (a *AdminAPI) global(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var body struct {
+			Global *bool `json:"global"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Global == nil {
+			writeError(w, http.StatusBadRequest, errors.New("expect {\"global\": true|false}"))
+			return
+		}
+		a.ctx.setGlobal(*body.Global)
+		Info.Printf("Set global to %v through admin API\n", *body.Global)
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{ "global": a.ctx.isGlobal() })
+}
+
+// tunnel tells where the tunnel sends to, and whether it is alive if known
+func (a *AdminAPI) tunnel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	status := map[string]interface{}{ "destination": tunnelDestination(a.ctx.tunnel) }
+	if checker, ok := a.ctx.tunnel.(healthChecker); ok {
+		status["alive"] = checker.Alive()
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// explain tells how the address or domain of ?target= is routed and why
+func (a *AdminAPI) explain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	explanation, err := a.ctx.Explain(r.URL.Query().Get("target"), a.blockedFile)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, explanation)
+}
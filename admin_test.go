@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type destinedTunnel struct {
+	fakeTunnel
+}
+
+func (t *destinedTunnel) currentDestination() string {
+	return "192.0.2.1:8080"
+}
+
+// newTestAdmin serves a client whose blocked list is in dir
+func newTestAdmin(t *testing.T, dir, token string) (*AdminAPI, *Context, string) {
+	file := filepath.Join(dir, "blocked.txt")
+	err := ioutil.WriteFile(file, []byte("# comment\ngoogle.com"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write %s: %v\n", file, err)
+	}
+	ctx := &Context{ blockedIp: NewAddressQueue(), tunnel: &destinedTunnel{} }
+	ctx.blocked.Store(NewDomainTrie(file))
+	return NewAdminAPI(ctx, token, file), ctx, file
+}
+
+func call(api *AdminAPI, method, path, body string) (int, map[string]interface{}) {
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer secret")
+	api.Handler().ServeHTTP(recorder, request)
+	var decoded map[string]interface{}
+	_ = json.Unmarshal(recorder.Body.Bytes(), &decoded)
+	return recorder.Code, decoded
+}
+
+func TestAdminBlockedDomains(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	api, ctx, file := newTestAdmin(t, dir, "secret")
+
+	if code, body := call(api, "POST", "/blocked/domains", `{"domain": "Example.COM."}`); code != http.StatusOK || body["changed"] != true {
+		t.Errorf("Expect example.com added but got %d %v\n", code, body)
+	}
+	if !ctx.blocked.Load().(DomainTrie).Test("www.example.com") {
+		t.Errorf("Expect www.example.com blocked at once\n")
+	}
+	if code, body := call(api, "POST", "/blocked/domains", `{"domain": "example.com"}`); code != http.StatusOK || body["changed"] != false {
+		t.Errorf("Expect example.com listed once but got %d %v\n", code, body)
+	}
+	if code, body := call(api, "GET", "/blocked/domains", ""); code != http.StatusOK || len(body["domains"].([]interface{})) != 2 {
+		t.Errorf("Expect 2 domains but got %d %v\n", code, body)
+	}
+
+	if code, _ := call(api, "DELETE", "/blocked/domains?domain=google.com", ""); code != http.StatusOK {
+		t.Errorf("Expect google.com removed but got %d\n", code)
+	}
+	if ctx.blocked.Load().(DomainTrie).Test("google.com") {
+		t.Errorf("Expect google.com not blocked any more\n")
+	}
+	if code, _ := call(api, "DELETE", "/blocked/domains?domain=google.com", ""); code != http.StatusNotFound {
+		t.Errorf("Expect 404 for a domain not listed but got %d\n", code)
+	}
+	if code, _ := call(api, "POST", "/blocked/domains", `{"domain": "a b"}`); code != http.StatusBadRequest {
+		t.Errorf("Expect 400 for a bad domain but got %d\n", code)
+	}
+
+	content, _ := ioutil.ReadFile(file)
+	if string(content) != "# comment\nexample.com\n" {
+		t.Errorf("Expect comment kept in file but got %q\n", content)
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	api, ctx, _ := newTestAdmin(t, dir, "secret")
+	ctx.blockedIp.Add(1000, net.IPv4(1, 2, 3, 4), "example.com")
+
+	if code, body := call(api, "GET", "/explain?target=www.google.com", ""); code != http.StatusOK || body["rule"] != "blocked_domain" || body["via_tunnel"] != true {
+		t.Errorf("Expect www.google.com explained as blocked but got %d %v\n", code, body)
+	}
+	if code, _ := call(api, "GET", "/explain?target=", ""); code != http.StatusBadRequest {
+		t.Errorf("Expect 400 without target but got %d\n", code)
+	}
+
+	code, _ := call(NewAdminAPI(ctx, "other", ""), "GET", "/global", "")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Expect 401 for a bad token but got %d\n", code)
+	}
+
+	if code, body := call(api, "PUT", "/global", `{"global": true}`); code != http.StatusOK || body["global"] != true || !ctx.isGlobal() {
+		t.Errorf("Expect global set but got %d %v\n", code, body)
+	}
+	if code, _ := call(api, "PUT", "/global", `{}`); code != http.StatusBadRequest {
+		t.Errorf("Expect 400 without global but got %d\n", code)
+	}
+	if code, body := call(api, "GET", "/tunnel", ""); code != http.StatusOK || body["destination"] != "192.0.2.1:8080" {
+		t.Errorf("Expect destination of tunnel but got %d %v\n", code, body)
+	}
+	if code, _ := call(api, "POST", "/blocked/flush", ""); code != http.StatusNotImplemented {
+		t.Errorf("Expect 501 for records not persisted but got %d\n", code)
+	}
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/blocked/addresses", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	api.Handler().ServeHTTP(recorder, request)
+	var addresses []blockedAddress
+	if err := json.Unmarshal(recorder.Body.Bytes(), &addresses); err != nil || len(addresses) != 1 ||
+		addresses[0].IP != "1.2.3.4" || len(addresses[0].Domains) != 1 || addresses[0].Domains[0] != "example.com" {
+		t.Errorf("Expect 1.2.3.4 of example.com but got %s\n", recorder.Body.String())
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	if _, err := listenAdmin("0.0.0.0:0"); err == nil {
+		t.Errorf("Expect admin API refused on every address\n")
+	}
+	listener, err := listenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expect admin API on localhost but got %v\n", err)
+	}
+	_ = listener.Close()
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "admin")
+	defer os.RemoveAll(dir)
+	api, _, _ := newTestAdmin(t, dir, "")
+
+	if err := api.Start("127.0.0.1:0"); err == nil {
+		t.Errorf("Expect admin API on localhost refused without token\n")
+	}
+	if err := api.Start("unix:" + filepath.Join(dir, "admin.sock")); err != nil {
+		t.Errorf("Expect admin API on a unix socket without token but got %v\n", err)
+	}
+}
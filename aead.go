@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	mathrand "math/rand"
+	"sync/atomic"
+	"time"
+)
+
+type Obscurer interface {
+
+	Obscure(mss int, packet []byte) ([]byte, error)
+
+	// ObscureTo is Obscure into dst if it has room, packet is not copied if
+	// it lies in dst right behind the header already
+	ObscureTo(dst []byte, mss int, packet []byte) ([]byte, error)
+
+	// Overhead is how much larger than a packet it is obscured without padding
+	Overhead() int
+
+	// Restore returns the payload and its authenticated sequence number, zero if unsequenced
+	Restore(packet []byte) ([]byte, uint64, error)
+
+}
+
+// xorObscurer keeps the legacy unauthenticated format, used when no secret is configured
+type xorObscurer struct {}
+
+func (xorObscurer) Obscure(mss int, packet []byte) ([]byte, error) {
+	return obscure(mss, packet)
+}
+
+func (xorObscurer) ObscureTo(dst []byte, mss int, packet []byte) ([]byte, error) {
+	return obscureTo(dst, mss, packet)
+}
+
+func (xorObscurer) Overhead() int {
+	return 8
+}
+
+func (xorObscurer) Restore(packet []byte) ([]byte, uint64, error) {
+	ret, err := restore(packet)
+	return ret, 0, err
+}
+
+var errAuthentication = errors.New("message authentication failed")
+
+const aeadNonceSize = 12
+
+// AEADObscurer seals packets with AES-256-GCM, the nonce is a random per-process
+// salt followed by a monotonic counter seeded from the wall clock, so the counter
+// doubles as a sequence number which keeps growing across restarts
+type AEADObscurer struct {
+	aead cipher.AEAD
+	salt [4]byte
+	counter uint64
+}
+
+func NewAEADObscurer(secret string) (*AEADObscurer, error) {
+	if secret == "" {
+		return nil, errors.New("empty secret")
+	}
+	key := sha256.Sum256([]byte("gotun:" + secret))
+	return newAEADObscurer(key[:], false)
+}
+
+// newAEADObscurer seals with key, the top bit of the salt tells whether it is
+// the key of a session or the shared one
+func newAEADObscurer(key []byte, session bool) (*AEADObscurer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	o := &AEADObscurer{ aead: aead, counter: uint64(time.Now().UnixNano()) }
+	if _, err := rand.Read(o.salt[:]); err != nil {
+		return nil, err
+	}
+	if session {
+		o.salt[0] |= 0x80
+	} else {
+		o.salt[0] &^= 0x80
+	}
+	return o, nil
+}
+
+func NewObscurer(secret string) (Obscurer, error) {
+	if secret == "" {
+		Warning.Printf("No secret configured, tunnel payload is NOT authenticated\n")
+		return xorObscurer{}, nil
+	}
+	return NewAEADObscurer(secret)
+}
+
+func (o *AEADObscurer) Overhead() int {
+	return aeadNonceSize + o.aead.Overhead() + 1
+}
+
+func (o *AEADObscurer) Obscure(mss int, packet []byte) ([]byte, error) {
+	return o.ObscureTo(nil, mss, packet)
+}
+
+func (o *AEADObscurer) ObscureTo(dst []byte, mss int, packet []byte) ([]byte, error) {
+	packetLength := len(packet)
+	remainLength := mss - o.Overhead() - packetLength
+	if remainLength < 0 {
+		return nil, errors.New("max segment size is smaller than packet size")
+	}
+	padLength := 0
+	if remainLength >= 256 {
+		padLength = mathrand.Intn(256)
+	}
+
+	plainLength := packetLength + padLength + 1
+	if cap(dst) < aeadNonceSize + plainLength + o.aead.Overhead() {
+		dst = make([]byte, 0, aeadNonceSize + plainLength + o.aead.Overhead())
+	}
+	ret := dst[:aeadNonceSize + plainLength]
+	// the payload is moved first as the nonce may overlap where it was
+	plain := ret[aeadNonceSize:]
+	if !samePlace(plain, packet) {
+		copy(plain, packet)
+	}
+	nonce := ret[:aeadNonceSize]
+	copy(nonce, o.salt[:])
+	binary.BigEndian.PutUint64(nonce[4:], atomic.AddUint64(&o.counter, 1))
+
+	// buffers may be reused, padding bytes are not zero already
+	zeroBytes(plain[packetLength:plainLength-1])
+	plain[plainLength-1] = byte(padLength)
+
+	return o.aead.Seal(ret[:aeadNonceSize], nonce, plain, nil), nil
+}
+
+// sender is the salt of the process which sealed packet, it is part of the
+// nonce so that a packet claiming another sender fails to restore
+func (o *AEADObscurer) sender(packet []byte) (uint32, bool) {
+	if len(packet) < aeadNonceSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet), true
+}
+
+func (o *AEADObscurer) Restore(packet []byte) ([]byte, uint64, error) {
+	if len(packet) < aeadNonceSize + o.aead.Overhead() + 1 {
+		return nil, 0, errors.New("short packet")
+	}
+	nonce := packet[:aeadNonceSize]
+	plain, err := o.aead.Open(packet[aeadNonceSize:aeadNonceSize], nonce, packet[aeadNonceSize:], nil)
+	if err != nil {
+		return nil, 0, errAuthentication
+	}
+	padLength := int(plain[len(plain)-1])
+	if len(plain) < padLength + 1 {
+		return nil, 0, errors.New("no room for padding bytes")
+	}
+	return plain[:len(plain)-1-padLength], binary.BigEndian.Uint64(nonce[4:]), nil
+}
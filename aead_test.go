@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAEADObscureRestore(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	o, err := NewAEADObscurer("secret")
+	if err != nil {
+		t.Fatalf("Failed to create obscurer: %v", err)
+	}
+	for n := 0; n < 100; n++ {
+		length := rand.Intn(1400) + 1
+		p := make([]byte, length)
+		rand.Read(p)
+		obscured, err := o.Obscure(1492 - 20 - 8, p)
+		if err != nil {
+			t.Fatalf("Failed to obscure %d bytes: %v", length, err)
+		}
+		restored, _, err := o.Restore(obscured)
+		if err != nil || !bytes.Equal(p, restored) {
+			t.Errorf("failed to obscure then restore payload of %d bytes, err: %v", length, err)
+		}
+	}
+}
+
+func TestAEADRejectForged(t *testing.T) {
+	o0, _ := NewAEADObscurer("secret")
+	o1, _ := NewAEADObscurer("another secret")
+
+	obscured, _ := o0.Obscure(1400, []byte("hello"))
+	if _, _, err := o1.Restore(obscured); err != errAuthentication {
+		t.Errorf("Expect authentication error with wrong key, but got %v", err)
+	}
+
+	obscured[len(obscured)-1] ^= 1
+	if _, _, err := o0.Restore(obscured); err != errAuthentication {
+		t.Errorf("Expect authentication error on tampered packet, but got %v", err)
+	}
+
+	legacy, _ := obscure(1400, []byte("hello"))
+	if _, _, err := o0.Restore(legacy); err == nil {
+		t.Errorf("Expect legacy packet to be rejected")
+	}
+}
+
+func TestAEADTooLarge(t *testing.T) {
+	o, _ := NewAEADObscurer("secret")
+	if _, err := o.Obscure(100, make([]byte, 100)); err == nil {
+		t.Errorf("Expect error when packet does not fit in mss")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"syscall"
+)
+
+// batchConn is what ipv4.PacketConn and ipv6.PacketConn have in common, their
+// messages are the same type
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+
+	SetBPF(filter []bpf.RawInstruction) error
+
+	LocalAddr() net.Addr
+
+	Close() error
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil
+}
+
+// underlayNetwork picks the IPv4 or IPv6 flavor of network for ip, unspecified
+// addresses stay with IPv4 unless written as "::"
+func underlayNetwork(network string, ip net.IP) string {
+	if isIPv6(ip) {
+		return network + "6"
+	}
+	return network + "4"
+}
+
+func underlayHeaderLength(v6 bool) int {
+	if v6 {
+		return 40
+	}
+	return 20
+}
+
+func newBatchConn(conn net.PacketConn, v6 bool) batchConn {
+	if v6 {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// writeMessages writes ms through conn and returns how many are done with. A
+// message the kernel refuses as larger than the interface MTU is handed to
+// tooLarge and skipped, as sending it again fails the same way, any other
+// error stops writing
+func writeMessages(conn batchConn, ms []ipv4.Message, tooLarge func([]byte)) (int, error) {
+	sent := 0
+	for sent < len(ms) {
+		n, err := conn.WriteBatch(ms[sent:], 0)
+		if err != nil {
+			if !errors.Is(err, syscall.EMSGSIZE) {
+				return sent, err
+			}
+			tooLarge(ms[sent].Buffers[0])
+			n = 1
+		}
+		sent += n
+	}
+	return sent, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// blockedListLock serializes the edits of blocked lists made at runtime, the
+// file watcher reloads the list after each of them
+var blockedListLock sync.Mutex
+
+// normalizeDomain makes domain a line of a blocked list
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" || strings.ContainsAny(domain, " \t\r\n#/") {
+		return "", errors.New("bad domain: " + domain)
+	}
+	return domain, nil
+}
+
+func splitBlockedList(content []byte) []string {
+	var domains []string
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	return domains
+}
+
+// readBlockedList returns the domains listed in filename, comments left out
+func readBlockedList(filename string) ([]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return splitBlockedList(content), nil
+}
+
+// addToBlockedList appends domain to filename, it tells false if domain is
+// listed already
+func addToBlockedList(filename, domain string) (bool, error) {
+	blockedListLock.Lock()
+	defer blockedListLock.Unlock()
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	for _, listed := range splitBlockedList(content) {
+		if listed == domain {
+			return false, nil
+		}
+	}
+	line := domain + "\n"
+	if len(content) > 0 && content[len(content) - 1] != '\n' {
+		line = "\n" + line
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	if _, err = f.WriteString(line); err != nil {
+		_ = f.Close()
+		return false, err
+	}
+	return true, f.Close()
+}
+
+// removeFromBlockedList removes the lines of domain from filename, it tells
+// false if domain is not listed. Comments are kept
+func removeFromBlockedList(filename, domain string) (bool, error) {
+	blockedListLock.Lock()
+	defer blockedListLock.Unlock()
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if strings.TrimSpace(line) != domain {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == len(lines) {
+		return false, nil
+	}
+	// written in place rather than renamed, as the watcher reloads on writes
+	return true, ioutil.WriteFile(filename, []byte(strings.Join(kept, "")), 0644)
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packets of a bond are marked and carry the bond id, so that the server joins
+// the paths of a client whatever addresses they come from
+const (
+	// bondData is followed by the bond id, a sequence number and the packet
+	bondData byte = 0xb0
+	// bondProbe is followed by the bond id, the probe number and the time sent
+	bondProbe byte = 0xb1
+	// bondProbeAck echoes a probe back through the path it came from
+	bondProbeAck byte = 0xb2
+
+	bondHeaderLength = 9
+	bondProbeLength = 17
+)
+
+var (
+	bondProbeInterval = 500 * time.Millisecond
+	// bondPathTimeout is how long a path may stay unanswered before it is left unused
+	bondPathTimeout = 3 * time.Second
+	// bondLossGain is how much the latest probe counts in the loss average
+	bondLossGain = 0.1
+	// bondReorderWindow and bondReorderDelay are the defaults of reorder_window
+	// and reorder_delay
+	bondReorderWindow = 64
+	bondReorderDelay = 50 * time.Millisecond
+)
+
+var (
+	bondDuplicated = NewCounter("bond_duplicated_total", "Packets sent through two paths of a bond")
+	bondProbesLost = NewCounter("bond_probes_lost_total", "Bond probes left unanswered")
+)
+
+func putBondHeader(packet []byte, mark byte, id, seq uint32) {
+	packet[0] = mark
+	binary.BigEndian.PutUint32(packet[1:], id)
+	binary.BigEndian.PutUint32(packet[5:], seq)
+}
+
+// isBondPathType tells the tunnel types a bond path can be, each of them is
+// able to send from a given local address
+func isBondPathType(tunnelType string) bool {
+	switch tunnelType {
+	case "udp", "faketcp", "icmp", "raw":
+		return true
+	}
+	return false
+}
+
+// parseBondPath parses type@local, local is optional
+func parseBondPath(item string) (string, net.IP, error) {
+	tunnelType, local := item, ""
+	if at := strings.Index(item, "@"); at >= 0 {
+		tunnelType, local = strings.TrimSpace(item[:at]), strings.TrimSpace(item[at+1:])
+	}
+	if !isBondPathType(tunnelType) {
+		return "", nil, fmt.Errorf("bad bond path type of %s", item)
+	}
+	if local == "" {
+		return tunnelType, nil, nil
+	}
+	ip := net.ParseIP(local)
+	if ip == nil {
+		return "", nil, fmt.Errorf("bad local address of bond path %s", item)
+	}
+	return tunnelType, ip, nil
+}
+
+// latencySensitive tells whether packet is worth duplicating: it is not larger
+// than size, e.g. interactive traffic and acknowledgements, or it is ICMP or DNS
+func latencySensitive(packet []byte, size int) bool {
+	return len(packet) <= size || isICMPOrDNS(packet)
+}
+
+// isICMPOrDNS tells whether packet is an ICMP packet or a DNS query or answer
+func isICMPOrDNS(packet []byte) bool {
+	var protocol byte
+	var transport []byte
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		protocol = packet[9]
+		if headerLength := int(packet[0] & 0x0f) * 4; len(packet) >= headerLength {
+			transport = packet[headerLength:]
+		}
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		protocol = packet[6]
+		transport = packet[40:]
+	}
+	switch protocol {
+	case 1, 58:
+		return true
+	case 17:
+		return len(transport) >= 4 && (binary.BigEndian.Uint16(transport[0:]) == 53 || binary.BigEndian.Uint16(transport[2:]) == 53)
+	}
+	return false
+}
+
+// bondPath is one tunnel of a bond, it is weighted by probing it
+type bondPath struct {
+	name string
+	tunnel Tunnel
+	lock sync.Mutex
+	probe uint32
+	answered bool
+	srtt time.Duration
+	loss float64
+	lastAnswered time.Time
+	mtu int32
+}
+
+func (p *bondPath) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return fmt.Sprintf("%s(rtt %v, loss %.0f%%)", p.name, p.srtt.Truncate(time.Microsecond), p.loss * 100)
+}
+
+// weight prefers fast paths losing few packets, a path not answering weighs 0
+func (p *bondPath) weight(now time.Time) float64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.srtt <= 0 || now.Sub(p.lastAnswered) > bondPathTimeout {
+		return 0
+	}
+	return (1 - p.loss) / p.srtt.Seconds()
+}
+
+// sendProbe counts the previous probe as lost unless it was answered, then
+// sends the next one
+func (p *bondPath) sendProbe(id uint32, now time.Time) {
+	p.lock.Lock()
+	if p.probe > 0 {
+		lost := 0.0
+		if !p.answered {
+			lost = 1
+			bondProbesLost.Inc()
+		}
+		p.loss += bondLossGain * (lost - p.loss)
+	}
+	p.probe++
+	p.answered = false
+	probe := p.probe
+	p.lock.Unlock()
+
+	msg := make([]byte, bondProbeLength)
+	putBondHeader(msg, bondProbe, id, probe)
+	binary.BigEndian.PutUint64(msg[9:], uint64(now.UnixNano()))
+	p.tunnel.Send(msg)
+}
+
+// probeAnswered measures the round trip of the latest probe, answers later
+// than the next probe count as lost
+func (p *bondPath) probeAnswered(msg []byte, now time.Time) {
+	probe := binary.BigEndian.Uint32(msg[5:])
+	sent := int64(binary.BigEndian.Uint64(msg[9:]))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if probe != p.probe || p.answered {
+		return
+	}
+	p.answered = true
+	p.lastAnswered = now
+	rtt := time.Duration(now.UnixNano() - sent)
+	if rtt < time.Microsecond {
+		rtt = time.Microsecond
+	}
+	if p.srtt == 0 {
+		p.srtt = rtt
+	} else {
+		p.srtt += (rtt - p.srtt) / 8
+	}
+}
+
+// bondUndeliverable strips the bond header off the data packets a path drops
+// before passing them on to handler, probes are not reported
+func bondUndeliverable(handler undeliverableHandler) undeliverableHandler {
+	if handler == nil {
+		return nil
+	}
+	return func(packet []byte, reason unreachable, mtu int) {
+		if len(packet) < bondHeaderLength || packet[0] != bondData {
+			return
+		}
+		if mtu > bondHeaderLength {
+			mtu -= bondHeaderLength
+		}
+		handler(packet[bondHeaderLength:], reason, mtu)
+	}
+}
+
+// BondTunnel spreads packets over several paths to one server, e.g. through a
+// wired and a LTE uplink, weighted by the round trip and loss of each. Packets
+// not larger than duplicate, ICMP and DNS go through the two best paths at once
+type BondTunnel struct {
+	id uint32
+	seq uint32
+	// lock guards paths while they are appended, as the path MTU of those
+	// already started may change meanwhile
+	lock sync.Mutex
+	paths []*bondPath
+	duplicate int
+	handler func (Tunnel, []byte)
+}
+
+// NewBondTunnel connects to vpsAddr through every path of bond_paths, each
+// handshakes on its own under the credential of the client
+func NewBondTunnel(common, client *ini.Section, vpsAddr string, opts *TunnelOptions) (Tunnel, error) {
+	items := strings.Split(client.Key("bond_paths").String(), ",")
+	nonce, err := randomNonce()
+	if err != nil {
+		return nil, err
+	}
+	t := &BondTunnel{
+		id: binary.BigEndian.Uint32(nonce),
+		duplicate: client.Key("bond_duplicate").MustInt(0),
+	}
+	for i, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tunnelType, local, err := parseBondPath(item)
+		if err != nil {
+			return nil, err
+		}
+		path := &bondPath{ name: item }
+		pathOpts := *opts
+		pathOpts.local = local
+		if credential := opts.getCredential(); credential != nil {
+			pathOpts.credential = &Credential{ credential.name + pathSeparator + strconv.Itoa(i), credential.secret }
+		}
+		pathOpts.onMTU = func(mtu int) { t.pathMTUChanged(path, mtu, opts.onMTU) }
+		pathOpts.onUndeliverable = bondUndeliverable(opts.getOnUndeliverable())
+		tunnel, err := newClientEndpoint(tunnelType, common, client, vpsAddr, &pathOpts)
+		if err != nil {
+			return nil, fmt.Errorf("bond path %s: %v", item, err)
+		}
+		path.tunnel = tunnel
+		tunnel.SetHandler(func (_ Tunnel, content []byte) { t.received(path, content) })
+		t.lock.Lock()
+		t.paths = append(t.paths, path)
+		t.lock.Unlock()
+	}
+	if len(t.paths) == 0 {
+		return nil, errors.New("no bond_paths configured")
+	}
+	Info.Printf("Bond %08x to %s through %v\n", t.id, vpsAddr, items)
+	go t.probeLoop()
+	return t, nil
+}
+
+// pathMTUChanged passes the smallest MTU among the paths probed on to onMTU,
+// less the bond header
+func (t *BondTunnel) pathMTUChanged(path *bondPath, mtu int, onMTU func(int)) {
+	atomic.StoreInt32(&path.mtu, int32(mtu))
+	smallest := mtu
+	t.lock.Lock()
+	for _, p := range t.paths {
+		if m := int(atomic.LoadInt32(&p.mtu)); m > 0 && m < smallest {
+			smallest = m
+		}
+	}
+	t.lock.Unlock()
+	if onMTU != nil {
+		onMTU(smallest - bondHeaderLength)
+	}
+}
+
+func (t *BondTunnel) Send(content []byte) {
+	packet := packetBufferOf(bondHeaderLength + len(content))
+	putBondHeader(packet, bondData, t.id, atomic.AddUint32(&t.seq, 1) - 1)
+	copy(packet[bondHeaderLength:], content)
+
+	first, second := t.pick(time.Now())
+	first.tunnel.Send(packet)
+	if second != nil && t.duplicate > 0 && latencySensitive(content, t.duplicate) {
+		bondDuplicated.Inc()
+		second.tunnel.Send(packet)
+	}
+	// tunnels are done with what they are sent once Send returns
+	putPacketBuffer(packet)
+}
+
+// payloadMTU is the smallest among the paths less the bond header, as a
+// packet may go through any of them
+func (t *BondTunnel) payloadMTU() int {
+	smallest := 0
+	for _, path := range t.paths {
+		if mtu := tunnelPayloadMTU(path.tunnel); mtu > 0 && (smallest == 0 || mtu < smallest) {
+			smallest = mtu
+		}
+	}
+	if smallest == 0 {
+		return 0
+	}
+	return smallest - bondHeaderLength
+}
+
+// currentDestination lists every path, any of them may be sent through
+func (t *BondTunnel) currentDestination() string {
+	destinations := make([]string, len(t.paths))
+	for i, path := range t.paths {
+		destinations[i] = path.name + " " + tunnelDestination(path.tunnel)
+	}
+	return strings.Join(destinations, ", ")
+}
+
+func (t *BondTunnel) SetHandler(handler func (Tunnel, []byte)) {
+	t.handler = handler
+}
+
+// Alive tells whether any path answers, so that bonds can fail over as well
+func (t *BondTunnel) Alive() bool {
+	now := time.Now()
+	for _, path := range t.paths {
+		if path.weight(now) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pick chooses a path at random by weight and the best of the others, if no
+// path answers they are chosen evenly
+func (t *BondTunnel) pick(now time.Time) (*bondPath, *bondPath) {
+	weights := make([]float64, len(t.paths))
+	total := 0.0
+	for i, path := range t.paths {
+		weights[i] = path.weight(now)
+		total += weights[i]
+	}
+	if total == 0 {
+		first := rand.Intn(len(t.paths))
+		if len(t.paths) == 1 {
+			return t.paths[first], nil
+		}
+		return t.paths[first], t.paths[(first + 1) % len(t.paths)]
+	}
+	first := 0
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		if weight > 0 {
+			first = i
+			if r -= weight; r < 0 {
+				break
+			}
+		}
+	}
+	var second *bondPath
+	best := 0.0
+	for i, weight := range weights {
+		if i != first && weight > best {
+			second, best = t.paths[i], weight
+		}
+	}
+	return t.paths[first], second
+}
+
+func (t *BondTunnel) received(path *bondPath, content []byte) {
+	if len(content) < bondHeaderLength || binary.BigEndian.Uint32(content[1:]) != t.id {
+		return
+	}
+	switch content[0] {
+	case bondData:
+		if t.handler == nil {
+			Warning.Printf("no receive handler set, ignored %d bytes", len(content))
+			return
+		}
+		t.handler(t, content[bondHeaderLength:])
+	case bondProbeAck:
+		if len(content) == bondProbeLength {
+			path.probeAnswered(content, time.Now())
+		}
+	}
+}
+
+func (t *BondTunnel) probeLoop() {
+	probes := 0
+	for now := range time.Tick(bondProbeInterval) {
+		for _, path := range t.paths {
+			path.sendProbe(t.id, now)
+		}
+		if probes++; probes % 120 == 0 {
+			Debug.Printf("Bond %08x paths: %v\n", t.id, t.paths)
+		}
+	}
+}
+
+// bondMember is a session of a listening tunnel which is one path of a bond
+type bondMember struct {
+	session Tunnel
+	lastSeen int64
+}
+
+// BondSession is a bonding client on the server, its packets are put back in
+// order before handed to the handler. Replies go through the path the client
+// sent through last, thus following the weights the client measured
+type BondSession struct {
+	key string
+	id uint32
+	owner *BondListener
+	lock sync.Mutex
+	members []*bondMember
+	latest *bondMember
+	seq uint32
+	reorder *ReorderBuffer
+}
+
+func (b *BondSession) Send(content []byte) {
+	b.lock.Lock()
+	latest := b.latest
+	b.lock.Unlock()
+	if latest == nil {
+		Debug.Printf("No data from bond %v yet, skip %d bytes\n", b, len(content))
+		b.owner.undeliverable.report(content, unreachableHost, 0)
+		return
+	}
+	packet := packetBufferOf(bondHeaderLength + len(content))
+	putBondHeader(packet, bondData, b.id, atomic.AddUint32(&b.seq, 1) - 1)
+	copy(packet[bondHeaderLength:], content)
+	latest.session.Send(packet)
+	putPacketBuffer(packet)
+}
+
+// payloadMTU is that of the path replies go through, less the bond header
+func (b *BondSession) payloadMTU() int {
+	b.lock.Lock()
+	latest := b.latest
+	b.lock.Unlock()
+	if latest == nil {
+		return 0
+	}
+	if mtu := tunnelPayloadMTU(latest.session); mtu > 0 {
+		return mtu - bondHeaderLength
+	}
+	return 0
+}
+
+func (b *BondSession) SetHandler(handler func (Tunnel, []byte)) {
+	b.owner.SetHandler(handler)
+}
+
+// Lease returns the lease shared by the paths of the client, nil if no pool is configured
+func (b *BondSession) Lease() *Lease {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, member := range b.members {
+		if s, ok := member.session.(*Session); ok && s.Lease() != nil {
+			return s.Lease()
+		}
+	}
+	return nil
+}
+
+func (b *BondSession) String() string {
+	return "bond " + b.key
+}
+
+// join records session as a path of the bond, data tells that the client
+// chose to send a packet through it
+func (b *BondSession) join(session Tunnel, data bool, now int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var member *bondMember
+	for _, m := range b.members {
+		if m.session == session {
+			member = m
+			break
+		}
+	}
+	if member == nil {
+		member = &bondMember{ session, now }
+		b.members = append(b.members, member)
+		Info.Printf("%v joined by %v\n", b, session)
+	}
+	member.lastSeen = now
+	if data {
+		b.latest = member
+	}
+}
+
+// expire forgets the paths idle for the session timeout, it tells whether
+// any path is left
+func (b *BondSession) expire(deadline int64) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	members := b.members[:0]
+	for _, m := range b.members {
+		if m.lastSeen >= deadline {
+			members = append(members, m)
+		} else if m == b.latest {
+			b.latest = nil
+		}
+	}
+	b.members = members
+	return len(members) > 0
+}
+
+// BondListener accepts the paths of bonding clients on every tunnel type of
+// bond_types and joins them into a BondSession per client
+type BondListener struct {
+	tunnels []Tunnel
+	lock sync.Mutex
+	bonds map[string]*BondSession
+	handler func (Tunnel, []byte)
+	undeliverable undeliverableHandler
+	timeout time.Duration
+	reorderWindow int
+	reorderDelay time.Duration
+}
+
+func NewBondListener(common, server *ini.Section, opts *TunnelOptions) (Tunnel, error) {
+	l := &BondListener{
+		bonds: make(map[string]*BondSession),
+		undeliverable: opts.getOnUndeliverable(),
+		timeout: opts.getSessionTimeout(),
+		reorderWindow: server.Key("reorder_window").MustInt(bondReorderWindow),
+		reorderDelay: time.Duration(server.Key("reorder_delay").MustInt(int(bondReorderDelay / time.Millisecond))) * time.Millisecond,
+	}
+	memberOpts := opts
+	if handler := opts.getOnUndeliverable(); handler != nil {
+		wrapped := *opts
+		wrapped.onUndeliverable = bondUndeliverable(handler)
+		memberOpts = &wrapped
+	}
+	for _, tunnelType := range strings.Split(server.Key("bond_types").MustString("udp"), ",") {
+		tunnelType = strings.TrimSpace(tunnelType)
+		if !isBondPathType(tunnelType) {
+			return nil, errors.New("bad bond type: " + tunnelType)
+		}
+		tunnel, err := newServerListener(tunnelType, common, server, memberOpts)
+		if err != nil {
+			return nil, fmt.Errorf("bond type %s: %v", tunnelType, err)
+		}
+		tunnel.SetHandler(l.received)
+		l.tunnels = append(l.tunnels, tunnel)
+	}
+	go l.expireLoop()
+	return l, nil
+}
+
+func (l *BondListener) Send(content []byte) {
+	Warning.Printf("No destination, skip %v bytes\n", len(content))
+	l.undeliverable.report(content, unreachableNet, 0)
+}
+
+func (l *BondListener) SetHandler(handler func (Tunnel, []byte)) {
+	l.handler = handler
+}
+
+// bond returns the bond of id the client of session runs, bonds of different
+// clients are told apart by their names as ids are only random
+func (l *BondListener) bond(session Tunnel, id uint32) *BondSession {
+	name := ""
+	if s, ok := session.(*Session); ok {
+		name = credentialName(s.Name())
+	}
+	key := fmt.Sprintf("%s/%08x", name, id)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.bonds[key]
+	if !ok {
+		b = &BondSession{ key: key, id: id, owner: l }
+		b.reorder = NewReorderBuffer(l.reorderWindow, l.reorderDelay, func(packet []byte) { l.deliver(b, packet) })
+		l.bonds[key] = b
+		Info.Printf("new %v\n", b)
+	}
+	return b
+}
+
+func (l *BondListener) received(session Tunnel, content []byte) {
+	if len(content) < bondHeaderLength {
+		return
+	}
+	id := binary.BigEndian.Uint32(content[1:])
+	switch content[0] {
+	case bondData:
+		b := l.bond(session, id)
+		b.join(session, true, time.Now().UnixNano())
+		// the receive buffer is reused while the packet may be held
+		b.reorder.Push(binary.BigEndian.Uint32(content[5:]), copyBytes(content[bondHeaderLength:]))
+	case bondProbe:
+		if len(content) != bondProbeLength {
+			return
+		}
+		l.bond(session, id).join(session, false, time.Now().UnixNano())
+		ack := copyBytes(content)
+		ack[0] = bondProbeAck
+		session.Send(ack)
+	}
+}
+
+func (l *BondListener) deliver(b *BondSession, packet []byte) {
+	if l.handler == nil {
+		Warning.Printf("no receive handler set, ignored %d bytes", len(packet))
+		return
+	}
+	l.handler(b, packet)
+}
+
+func (l *BondListener) expire(now time.Time) {
+	deadline := now.UnixNano() - l.timeout.Nanoseconds()
+	l.lock.Lock()
+	bonds := make([]*BondSession, 0, len(l.bonds))
+	for key, b := range l.bonds {
+		if !b.expire(deadline) {
+			delete(l.bonds, key)
+			Info.Printf("%v expired\n", b)
+			continue
+		}
+		bonds = append(bonds, b)
+	}
+	l.lock.Unlock()
+	for _, b := range bonds {
+		b.reorder.Expire(now)
+	}
+}
+
+func (l *BondListener) expireLoop() {
+	interval := l.reorderDelay / 2
+	if interval < 10 * time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	for now := range time.Tick(interval) {
+		l.expire(now)
+	}
+}
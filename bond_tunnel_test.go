@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/ini.v1"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseBondPath(t *testing.T) {
+	tests := []struct { item string; tunnelType string; local net.IP; err bool } {
+		{ "udp", "udp", nil, false },
+		{ "raw @ 10.64.0.2", "raw", net.ParseIP("10.64.0.2"), false },
+		{ "faketcp@2001:db8::2", "faketcp", net.ParseIP("2001:db8::2"), false },
+		{ "tcp@10.64.0.2", "", nil, true },
+		{ "udp@wlan0", "", nil, true },
+	}
+	for _, test := range tests {
+		tunnelType, local, err := parseBondPath(test.item)
+		if (err != nil) != test.err || tunnelType != test.tunnelType || !local.Equal(test.local) {
+			t.Errorf("Expect %s %v %v from %q but got %s %v %v", test.tunnelType, test.local, test.err, test.item, tunnelType, local, err)
+		}
+	}
+}
+
+func TestLatencySensitive(t *testing.T) {
+	udp := func(dport byte, length int) []byte {
+		packet := make([]byte, length)
+		packet[0], packet[9], packet[23] = 0x45, 17, dport
+		return packet
+	}
+	tests := []struct { packet []byte; expect bool } {
+		{ udp(53, 512), true },
+		{ udp(80, 512), false },
+		{ udp(80, 100), true },
+		{ append([]byte{ 0x45, 0, 0, 0, 0, 0, 0, 0, 0, 1 }, make([]byte, 500)...), true },
+	}
+	for idx, test := range tests {
+		if latencySensitive(test.packet, 128) != test.expect {
+			t.Errorf("Expect %dth packet latency sensitive %v", idx+1, test.expect)
+		}
+	}
+}
+
+func TestBondPick(t *testing.T) {
+	now := time.Now()
+	fast := &bondPath{ name: "fast", tunnel: &fakeTunnel{}, srtt: 10 * time.Millisecond, lastAnswered: now }
+	slow := &bondPath{ name: "slow", tunnel: &fakeTunnel{}, srtt: 40 * time.Millisecond, lastAnswered: now }
+	dead := &bondPath{ name: "dead", tunnel: &fakeTunnel{}, srtt: time.Millisecond, lastAnswered: now.Add(-time.Minute) }
+	tunnel := &BondTunnel{ paths: []*bondPath{ slow, dead, fast } }
+
+	picked := make(map[*bondPath]int)
+	for i := 0; i < 1000; i++ {
+		first, second := tunnel.pick(now)
+		picked[first]++
+		if first == fast && second != slow || first == slow && second != fast {
+			t.Fatalf("Expect the other live path as second but got %v", second)
+		}
+	}
+	if picked[dead] != 0 || picked[fast] < 700 || picked[slow] < 100 {
+		t.Errorf("Expect paths picked by weight but got fast %d slow %d dead %d", picked[fast], picked[slow], picked[dead])
+	}
+}
+
+func TestBond(t *testing.T) {
+	bondProbeInterval = 20 * time.Millisecond
+	defer func() { bondProbeInterval = 500 * time.Millisecond }()
+	cfg, err := ini.Load([]byte("[common]\ntype = bond\nport = 11116\n[server]\nlisten = 127.0.0.1\n[client]\nbond_paths = udp@127.0.0.1, udp@127.0.0.2\nbond_duplicate = 64\n"))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	server, err := NewBondListener(cfg.Section("common"), cfg.Section("server"), nil)
+	if err != nil {
+		t.Fatalf("Failed to listen bond: %v", err)
+	}
+	var lock sync.Mutex
+	var received [][]byte
+	server.SetHandler(func(session Tunnel, content []byte) {
+		lock.Lock()
+		received = append(received, copyBytes(content))
+		lock.Unlock()
+		session.Send(content)
+	})
+	client, err := NewBondTunnel(cfg.Section("common"), cfg.Section("client"), "127.0.0.1", &TunnelOptions{})
+	if err != nil {
+		t.Fatalf("Failed to connect bond: %v", err)
+	}
+	replies := make(chan []byte, 16)
+	client.SetHandler(func(_ Tunnel, content []byte) { replies <- copyBytes(content) })
+
+	time.Sleep(200 * time.Millisecond)
+	if !client.(*BondTunnel).Alive() {
+		t.Fatalf("Expect probes answered through the paths %v", client.(*BondTunnel).paths)
+	}
+	listener := server.(*BondListener)
+	listener.lock.Lock()
+	bonds := make([]*BondSession, 0, len(listener.bonds))
+	for _, b := range listener.bonds {
+		bonds = append(bonds, b)
+	}
+	listener.lock.Unlock()
+	if len(bonds) != 1 {
+		t.Fatalf("Expect paths joined into 1 bond but got %d", len(bonds))
+	}
+	for _, b := range bonds {
+		b.lock.Lock()
+		members := len(b.members)
+		b.lock.Unlock()
+		if members != 2 {
+			t.Errorf("Expect 2 paths of %v but got %d", b, members)
+		}
+	}
+
+	// small packets are duplicated but handed over once
+	for i := 0; i < 8; i++ {
+		client.Send([]byte{ 0x45, byte(i) })
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case reply := <-replies:
+			if !bytes.Equal(reply, []byte{ 0x45, byte(i) }) {
+				t.Errorf("Expect reply %d but got %x", i, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expect reply %d", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != 8 {
+		t.Errorf("Expect 8 packets received but got %d", len(received))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// bridgeFrameMark leads every Ethernet frame in the tunnel, a frame could
+// otherwise be taken for a control message as MACs may start with a 0 nibble
+const bridgeFrameMark byte = 0xe0
+
+var bridgeFlooded = NewCounter("bridge_flooded_total", "Frames flooded to every bridge port for having no MAC route")
+
+func markFrame(frame []byte) []byte {
+	marked := make([]byte, 1 + len(frame))
+	marked[0] = bridgeFrameMark
+	copy(marked[1:], frame)
+	return marked
+}
+
+func unmarkFrame(content []byte) []byte {
+	if len(content) < 1 + etherHeaderLength || content[0] != bridgeFrameMark {
+		return nil
+	}
+	return content[1:]
+}
+
+// startBridgeClient extends the LAN segment of the tap device to the server,
+// frames are carried as they are without looking into them
+func startBridgeClient(device TunTap, tunnel Tunnel) {
+	device.SetHandler(func (_ TunTap, frame []byte) {
+		deviceToTunnel.Count(frame)
+		tunnel.Send(markFrame(frame))
+	})
+	tunnel.SetHandler(func (_ Tunnel, content []byte) {
+		if frame := unmarkFrame(content); frame != nil {
+			tunnelToDevice.Count(frame)
+			device.Send(frame)
+		}
+	})
+}
+
+// startBridgeServer switches frames among the tap device and the clients by
+// MACs learned from them, broadcasts and unknown MACs go to every port
+func startBridgeServer(device TunTap, tunnel Tunnel, timeout time.Duration) {
+	macs := NewRouteTable(timeout)
+	// from is nil for frames of the device
+	forward := func(frame []byte, from Tunnel) {
+		dst := net.HardwareAddr(frame[0:6])
+		if dst[0] & 0x01 == 0 {
+			if session := macs.LookupMAC(dst); session != nil {
+				if session != from {
+					session.Send(markFrame(frame))
+				}
+				return
+			}
+		}
+		if from != nil {
+			tunnelToDevice.Count(frame)
+			device.Send(frame)
+		}
+		bridgeFlooded.Inc()
+		marked := markFrame(frame)
+		for _, session := range macs.Tunnels() {
+			if session != from {
+				session.Send(marked)
+			}
+		}
+	}
+	device.SetHandler(func (_ TunTap, frame []byte) {
+		if len(frame) >= etherHeaderLength {
+			deviceToTunnel.Count(frame)
+			forward(frame, nil)
+		}
+	})
+	tunnel.SetHandler(func (session Tunnel, content []byte) {
+		frame := unmarkFrame(content)
+		if frame == nil {
+			return
+		}
+		if src := net.HardwareAddr(frame[6:12]); src[0] & 0x01 == 0 {
+			macs.LearnMAC(copyHardwareAddr(src), session)
+		}
+		forward(frame, session)
+	})
+}
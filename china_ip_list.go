@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net"
 	"sort"
@@ -25,14 +26,24 @@ type IPMask struct {
 
 }
 
+type IPMask6 struct {
+
+	net ipKey
+
+	mask uint8
+
+}
+
 type ChinaIPListImpl struct {
 
 	items []IPMask
 
+	items6 []IPMask6
+
 }
 
 func NewChinaIPList(loadFromFile string) ChinaIPList {
-	ret := &ChinaIPListImpl{ nil }
+	ret := &ChinaIPListImpl{ nil, nil }
 	if loadFromFile != "" {
 		ret.readIPMasks(loadFromFile)
 	}
@@ -49,6 +60,7 @@ func (cil *ChinaIPListImpl) readIPMasks(filename string) {
 		}
 	})
 	cil.sort()
+	cil.sort6()
 	Info.Printf("Load %v records from %v\n", count, filename)
 }
 
@@ -80,7 +92,36 @@ func (cil *ChinaIPListImpl) add(ipMask string) {
 	if len(ipMask) == 0 {
 		return
 	}
-	cil.items = append(cil.items, *cil.parse(ipMask))
+	if strings.Contains(ipMask, ":") {
+		if item := cil.parse6(ipMask); item != nil {
+			cil.items6 = append(cil.items6, *item)
+		}
+		return
+	}
+	if item := cil.parse(ipMask); item != nil {
+		cil.items = append(cil.items, *item)
+	}
+}
+
+func (cil *ChinaIPListImpl) parse6(raw string) *IPMask6 {
+	_, ipNet, err := net.ParseCIDR(raw)
+	if err != nil {
+		Error.Printf("Bad IP/Net: %v\n", raw)
+		return nil
+	}
+	ones, _ := ipNet.Mask.Size()
+	return &IPMask6{ toIPKey(ipNet.IP), uint8(ones) }
+}
+
+func (cil *ChinaIPListImpl) mask6(ip ipKey, mask uint8) ipKey {
+	for i := range ip {
+		if bits := int(mask) - i * 8; bits <= 0 {
+			ip[i] = 0
+		} else if bits < 8 {
+			ip[i] &= ^byte(0xff >> uint(bits))
+		}
+	}
+	return ip
 }
 
 var masks = []uint32 {
@@ -151,11 +192,29 @@ func (cil *ChinaIPListImpl) sort() {
 	}
 }
 
+// sort6 sorts IPv6 networks the same way, a network covered by the previous one
+// is replaced by it so that the nearest network found is the covering one
+func (cil *ChinaIPListImpl) sort6() {
+	sort.Slice(cil.items6, func(i, j int) bool {
+		if c := bytes.Compare(cil.items6[i].net[:], cil.items6[j].net[:]); c != 0 {
+			return c < 0
+		}
+		return cil.items6[i].mask < cil.items6[j].mask
+	})
+	for i := 1; i < len(cil.items6); i++ {
+		last := cil.items6[i-1]
+		if cil.mask6(cil.items6[i].net, last.mask) == last.net {
+			cil.items6[i] = last
+		}
+	}
+}
+
 func (cil *ChinaIPListImpl) Add(ipMasks []string) {
 	for _, ipMask := range ipMasks {
 		cil.add(ipMask)
 	}
 	cil.sort()
+	cil.sort6()
 }
 
 func (cil *ChinaIPListImpl) find(i, j int, target uint32) int {
@@ -180,6 +239,31 @@ func (cil *ChinaIPListImpl) TestUint32(ip uint32) bool {
 	return cil.mask(ip, nearest.mask) == nearest.net
 }
 
+func (cil *ChinaIPListImpl) find6(i, j int, target ipKey) int {
+	if i >= j {
+		return i - 1
+	}
+	mid := i + (j - i) / 2
+	if c := bytes.Compare(target[:], cil.items6[mid].net[:]); c == 0 {
+		return mid
+	} else if c < 0 {
+		return cil.find6(i, mid, target)
+	}
+	return cil.find6(mid + 1, j, target)
+}
+
+func (cil *ChinaIPListImpl) test6(ip ipKey) bool {
+	nearestIdx := cil.find6(0, len(cil.items6), ip)
+	if nearestIdx == -1 || nearestIdx >= len(cil.items6) {
+		return false
+	}
+	nearest := cil.items6[nearestIdx]
+	return cil.mask6(ip, nearest.mask) == nearest.net
+}
+
 func (cil *ChinaIPListImpl) TestIP(ip net.IP) bool {
-	return cil.TestUint32(cil.ipToUint32(ip))
+	if ip.To4() == nil {
+		return cil.test6(toIPKey(ip))
+	}
+	return cil.TestUint32(cil.ipToUint32(ip.To4()))
 }
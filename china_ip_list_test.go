@@ -12,6 +12,11 @@ func TestChinaIPListTest(t *testing.T) {
 		{ []string {"192.168.1.0/24", "192.168.2.0/24"}, "192.168.1.1", true },
 		{ []string {"192.168.1.0/24", "192.168.1.48/26"}, "192.168.2.1", false },
 		{ []string {"203.90.8.0/21", "203.90.0.0/22"}, "203.90.8.1", true },
+		{ []string {"240e::/20", "2408:8000::/20"}, "240e:1::1", true },
+		{ []string {"240e::/20", "2408:8000::/20"}, "2001:db8::1", false },
+		{ []string {"2400:da00::/32", "2400:da00:1::/48"}, "2400:da00:2::1", true },
+		{ []string {"240e::/20", "192.168.1.0/24"}, "192.168.1.1", true },
+		{ []string {"240e::/20", "192.168.1.0/24"}, "::ffff:192.168.1.1", true },
 	}
 
 	for _, test := range tests {
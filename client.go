@@ -2,8 +2,6 @@ package main
 
 import (
 	"github.com/fsnotify/fsnotify"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"gopkg.in/ini.v1"
 	"net"
 	"strings"
@@ -11,8 +9,20 @@ import (
 	"time"
 )
 
+var (
+	dnsBlocked = NewCounter("dns_blocked_total", "DNS questions for blocked domains sent to the clean DNS through the tunnel")
+	dnsOk = NewCounter("dns_ok_total", "DNS questions for domains not blocked sent to the fast DNS")
+	dnsLocal = NewCounter("dns_local_total", "DNS questions for .lan domains sent to the local DNS")
+)
+
+const (
+	blockedFile = "blocked.txt"
+	blockedRecordsFile = "blocked_records.txt"
+)
+
 type Context struct {
-	global bool
+	// global is set to route every packet through the tunnel
+	global int32
 	blocked atomic.Value
 	blockedIp AddressQueue
 	skippedIp AddressSet
@@ -20,6 +30,8 @@ type Context struct {
 	remoteAddr net.IP
 	localAddr net.IP
 	phantomAddr net.IP
+	localAddr6 net.IP
+	phantomAddr6 net.IP
 	fastDNS net.IP
 	cleanDNS net.IP
 	localDNS net.IP
@@ -29,35 +41,63 @@ type Context struct {
 }
 
 func startClient(tunTap TunTap, common, client *ini.Section, watcher *fsnotify.Watcher) {
-	tunnel, err := NewClientTunnel(common, client)
+	leased := make(chan *Lease, 1)
+	var current atomic.Value
+	var onUndeliverable undeliverableHandler
+	if common.Key("mode").String() != "bridge" {
+		// bridged frames are not answered, they are not IP packets
+		onUndeliverable = icmpErrorsTo(tunTap)
+	}
+	tunnel, err := NewClientTunnel(common, client, func(lease *Lease) {
+		if old, ok := current.Load().(*Lease); ok {
+			if !old.addr.Equal(lease.addr) {
+				Warning.Printf("Server leased %v but %v is in use, restart to apply\n", lease, old)
+			}
+			return
+		}
+		current.Store(lease)
+		leased <- lease
+	}, func(mtu int) {
+		if common.Key("mode").String() == "bridge" {
+			return
+		}
+		Info.Printf("Set MTU of %s to %d\n", tunTap.Name(), mtu)
+		if err := SetDeviceMTU(tunTap.Name(), mtu); err != nil {
+			Error.Printf("Failed to set MTU of %s: %v\n", tunTap.Name(), err)
+		}
+	}, onUndeliverable)
 	if err != nil {
 		Error.Printf("Failed to create client tunnel: %v\n", err)
 		return
 	}
-	global, err := client.Key("global").Bool()
-	if err != nil {
-		Warning.Printf("Bad global config, %v\n", err)
-		global = false
+	if common.Key("mode").String() == "bridge" {
+		startBridgeClient(tunTap, tunnel)
+		return
 	}
+	ctx := newContext(client, NewAddressQueueWithPersistence(blockedRecordsFile), tunTap, tunnel)
 
-	ctx := Context{
-		global,
-		atomic.Value {},
-		NewAddressQueueWithPersistence("blocked_records.txt"),
-		NewAddressSet(client.Key("skipped_addresses").String()),
-		NewQueryList(),
-		net.ParseIP(client.Key("remote_addr").String()),
-		net.ParseIP(client.Key("local_addr").String()),
-		net.ParseIP(client.Key("phantom_addr").String()),
-		net.ParseIP(client.Key("fast_dns").String()),
-		net.ParseIP(client.Key("clean_dns").String()),
-		net.ParseIP(client.Key("local_dns").String()),
-		tunTap,
-		tunnel,
-		NewChinaIPList("china_ip_list.txt"),
+	if ctx.localAddr == nil {
+		if client.Key("credential").String() == "" {
+			Error.Printf("local_addr is required unless leased from server with credential\n")
+			return
+		}
+		if _, ok := tunnel.(*FailoverTunnel); ok {
+			// every server leases from a pool of its own, switching to another
+			// one would leave the device with an address it does not route
+			Error.Printf("local_addr is required with more than one server in vps_addr\n")
+			return
+		}
+		Info.Printf("No local_addr configured, waiting for lease from server\n")
+		ctx.applyLease(<-leased)
 	}
 
-	ctx.blocked.Store(NewDomainTrie("blocked.txt"))
+	if ethernet, ok := tunTap.(*EthernetDevice); ok {
+		ethernet.SetOwned(ctx.ownsAddress)
+	}
+
+	NewGaugeFunc("blocked_addresses", "Addresses resolved from blocked domains, which are routed through the tunnel", func() int64 {
+		return int64(ctx.blockedIp.Len())
+	})
 
 	if err := watcher.Add("."); err != nil {
 		Error.Println("Failed to create watcher for blocked.txt", err)
@@ -69,6 +109,49 @@ func startClient(tunTap TunTap, common, client *ini.Section, watcher *fsnotify.W
 
 	tunTap.SetHandler(func (_ TunTap, content []byte) { ctx.cliDeviceReceived(tunTap, tunnel, content) })
 	tunnel.SetHandler(func (_ Tunnel, content []byte) { ctx.cliTunnelReceived(tunTap, tunnel, content) })
+
+	if address := client.Key("admin_listen").String(); address != "" {
+		api := NewAdminAPI(ctx, client.Key("admin_token").String(), blockedFile)
+		if err := api.Start(address); err != nil {
+			Error.Printf("Failed to start admin API: %v\n", err)
+		}
+	}
+}
+
+func (ctx *Context) isGlobal() bool {
+	return atomic.LoadInt32(&ctx.global) != 0
+}
+
+// setGlobal switches between routing every packet through the tunnel and
+// routing by the rules, packets are routed concurrently with switching
+func (ctx *Context) setGlobal(global bool) {
+	var value int32
+	if global {
+		value = 1
+	}
+	atomic.StoreInt32(&ctx.global, value)
+}
+
+// ownsAddress tells whether the device stands for ip in tap mode, the host
+// reaches the phantom and local addresses through it
+func (ctx *Context) ownsAddress(ip net.IP) bool {
+	return ip.Equal(ctx.phantomAddr) || ip.Equal(ctx.localAddr)
+}
+
+// applyLease fills the addressing left out of the config with the lease and
+// configures the device accordingly
+func (ctx *Context) applyLease(lease *Lease) {
+	Info.Printf("Leased %v, gateway: %v, dns: %v, mtu: %d\n", lease, lease.gateway, lease.dns, lease.mtu)
+	ctx.localAddr = lease.addr
+	if ctx.phantomAddr == nil {
+		ctx.phantomAddr = lease.phantom
+	}
+	if ctx.cleanDNS == nil && len(lease.dns) > 0 {
+		ctx.cleanDNS = lease.dns[0]
+	}
+	if err := ConfigureDevice(ctx.tunTap.Name(), lease.addr, lease.gateway, lease.prefix, lease.mtu); err != nil {
+		Error.Printf("Failed to configure %s: %v\n", ctx.tunTap.Name(), err)
+	}
 }
 
 func (ctx *Context) blockedFileWatcher(watcher *fsnotify.Watcher) {
@@ -79,8 +162,8 @@ func (ctx *Context) blockedFileWatcher(watcher *fsnotify.Watcher) {
 				Error.Println("Get watcher.Events chan not ok")
 			}
 			if event.Op & fsnotify.Write == fsnotify.Write {
-				if "blocked.txt" == event.Name || strings.HasSuffix(event.Name, "/blocked.txt") {
-					ctx.blocked.Store(NewDomainTrie("blocked.txt"))
+				if blockedFile == event.Name || strings.HasSuffix(event.Name, "/" + blockedFile) {
+					ctx.blocked.Store(NewDomainTrie(blockedFile))
 				}
 			}
 		case err, ok := <-watcher.Errors:
@@ -92,195 +175,200 @@ func (ctx *Context) blockedFileWatcher(watcher *fsnotify.Watcher) {
 	}
 }
 
-func (ctx *Context) isViaTunnel(packet gopacket.Packet) (bool, bool) {
-	layer := packet.Layer(layers.LayerTypeIPv4)
-	if layer == nil {
-		Error.Printf("unexptect layer %v\n", packet)
-		return false, false
-	}
-	ipv4 := layer.(*layers.IPv4)
-	if ctx.skippedIp.Test(ipv4.DstIP) {
-		return false, false
-	}
-	if ipv4.Version == 6 {
-		return true, false
+// newContext loads the routing config of client and the lists it refers to,
+// blockedIp keeps the addresses resolved from blocked domains
+func newContext(client *ini.Section, blockedIp AddressQueue, tunTap TunTap, tunnel Tunnel) *Context {
+	global, err := client.Key("global").Bool()
+	if err != nil {
+		Warning.Printf("Bad global config, %v\n", err)
+		global = false
 	}
-	if ipv4.DstIP.Equal(ctx.remoteAddr) {
-		return true, false
+
+	ctx := &Context{
+		0,
+		atomic.Value {},
+		blockedIp,
+		NewAddressSet(client.Key("skipped_addresses").String()),
+		NewQueryList(),
+		net.ParseIP(client.Key("remote_addr").String()),
+		net.ParseIP(client.Key("local_addr").String()),
+		net.ParseIP(client.Key("phantom_addr").String()),
+		net.ParseIP(client.Key("local_addr6").String()),
+		net.ParseIP(client.Key("phantom_addr6").String()),
+		net.ParseIP(client.Key("fast_dns").String()),
+		net.ParseIP(client.Key("clean_dns").String()),
+		net.ParseIP(client.Key("local_dns").String()),
+		tunTap,
+		tunnel,
+		NewChinaIPList("china_ip_list.txt"),
 	}
-	if !ipv4.DstIP.IsGlobalUnicast() {
-		return false, false
+	ctx.setGlobal(global)
+	ctx.blocked.Store(NewDomainTrie(blockedFile))
+	return ctx
+}
+
+// changeToServer redirects a DNS query to server, only IPv4 queries are
+// redirected as the servers configured are IPv4 ones
+func (ctx *Context) changeToServer(header *packetHeader, msg dnsMessage, server net.IP) bool {
+	if header.v6 || server.To4() == nil {
+		return false
 	}
-	if ctx.global {
-		return true, false
+	return ctx.queryList.ChangeToServer(header, msg.id(), server)
+}
+
+// isViaTunnel tells whether the packet of header goes through the tunnel, DNS
+// queries are redirected in place to the server of their names. The rules are
+// checked in the order explain reports them
+func (ctx *Context) isViaTunnel(header *packetHeader) bool {
+	dstIP := header.dst
+	if dstIP == nil {
+		Error.Printf("unexpected packet of %d bytes\n", len(header.packet))
+		return false
 	}
-	if ctx.blockedIp.TestIP(ipv4.DstIP) {
-		Debug.Printf("ip: %v blocked\n", ipv4.DstIP)
-		if ctx.chinaIPList.TestIP(ipv4.DstIP) {
-			domains := ctx.blockedIp.IPDomains(ipv4.DstIP)
-			Info.Printf("ip: %v in china ip list but blocked by domains: %v\n", ipv4.DstIP, domains)
+	if rule, ok := ctx.addressRule(dstIP, true); ok {
+		if rule == ruleBlockedIP {
+			Debug.Printf("ip: %v blocked\n", dstIP)
+			if ctx.chinaIPList.TestIP(dstIP) {
+				domains := ctx.blockedIp.IPDomains(dstIP)
+				Info.Printf("ip: %v in china ip list but blocked by domains: %v\n", dstIP, domains)
+			}
 		}
-		return true, false
+		return rule.viaTunnel()
 	}
 
-	layer = packet.Layer(layers.LayerTypeDNS)
-	if layer != nil {
-		dnsLayer := layer.(*layers.DNS)
-		for _, q := range dnsLayer.Questions {
-			if q.Type != layers.DNSTypeA {
-				continue
-			}
-			qName := string(q.Name)
-			if strings.HasSuffix(qName, ".lan.") || strings.HasSuffix(qName, ".lan") {
-				Info.Printf("%v is local\n", qName)
-				modified := ctx.queryList.ChangeToServer(dnsLayer.ID, packet.TransportLayer(), ipv4, ctx.localDNS)
-				return false, modified
-			} else if ctx.blocked.Load().(DomainTrie).Test(qName) {
-				Info.Printf("%v is blocked\n", qName)
-				modified := ctx.queryList.ChangeToServer(dnsLayer.ID, packet.TransportLayer(), ipv4, ctx.cleanDNS)
-				return true, modified
-			} else {
-				Info.Printf("%v is ok\n", qName)
+	if msg := header.dns(); msg != nil {
+		if questions, _, ok := msg.records(); ok {
+			for _, q := range questions {
+				if q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA {
+					continue
+				}
+				switch ctx.domainRule(q.name) {
+				case ruleLocalDomain:
+					dnsLocal.Inc()
+					Info.Printf("%v is local\n", q.name)
+					ctx.changeToServer(header, msg, ctx.localDNS)
+					return false
+				case ruleBlockedDomain:
+					dnsBlocked.Inc()
+					Info.Printf("%v is blocked\n", q.name)
+					ctx.changeToServer(header, msg, ctx.cleanDNS)
+					return true
+				default:
+					dnsOk.Inc()
+					Info.Printf("%v is ok\n", q.name)
+				}
 			}
+			ctx.changeToServer(header, msg, ctx.fastDNS)
+			return false
 		}
-		modified := ctx.queryList.ChangeToServer(dnsLayer.ID, packet.TransportLayer(), ipv4, ctx.fastDNS)
-		return false, modified
 	}
-	if ipv4.DstIP.IsGlobalUnicast() && !ctx.chinaIPList.TestIP(ipv4.DstIP) {
-		Debug.Printf("ip: %v not in china ip list\n", ipv4.DstIP)
-		return true, false
+	rule := ctx.chinaRule(dstIP)
+	if rule == ruleNotChinaIP {
+		Debug.Printf("ip: %v not in china ip list\n", dstIP)
 	}
-	return false, false
+	return rule.viaTunnel()
 }
 
-func updateChecksum(packet gopacket.Packet) []byte {
-	networkLayer := packet.NetworkLayer()
-	var err error
-	if networkLayer != nil {
-		switch networkLayer.LayerType() {
-		case layers.LayerTypeIPv4:
-			transportLayer := packet.TransportLayer()
-			if transportLayer != nil {
-				switch transportLayer.LayerType() {
-				case layers.LayerTypeTCP:
-					err = transportLayer.(*layers.TCP).SetNetworkLayerForChecksum(networkLayer.(*layers.IPv4))
-				case layers.LayerTypeUDP:
-					err = transportLayer.(*layers.UDP).SetNetworkLayerForChecksum(networkLayer.(*layers.IPv4))
-				}
-			}
-		case layers.LayerTypeIPv6:
-			icmp := packet.Layer(layers.LayerTypeICMPv6)
-			if icmp != nil {
-				err = icmp.(*layers.ICMPv6).SetNetworkLayerForChecksum(networkLayer)
-			}
-		}
+// addressRule finds the rule deciding the route to ip ahead of the DNS rules,
+// if any. visit tells a packet is sent to ip, which keeps a blocked address
+// in the queue for a while longer
+func (ctx *Context) addressRule(ip net.IP, visit bool) (routeRule, bool) {
+	if ctx.skippedIp.Test(ip) {
+		return ruleSkipped, true
 	}
-	if err != nil {
-		Error.Printf("something error happen %v\n", err)
-		return packet.Data()
+	if ip.Equal(ctx.remoteAddr) {
+		return ruleRemote, true
 	}
-	options := gopacket.SerializeOptions{
-		ComputeChecksums: true,
-		FixLengths: true,
+	if !ip.IsGlobalUnicast() {
+		return ruleNotGlobalUnicast, true
 	}
-	newBuffer := gopacket.NewSerializeBuffer()
-	err = gopacket.SerializePacket(newBuffer, options, packet)
-	if err != nil {
-		Error.Printf("failed to serialize packet: %v\n", err)
-		return packet.Data()
+	if ctx.isGlobal() {
+		return ruleGlobal, true
 	}
-	return newBuffer.Bytes()
+	if visit && ctx.blockedIp.TestIP(ip) || !visit && len(ctx.blockedIp.IPDomains(ip)) > 0 {
+		return ruleBlockedIP, true
+	}
+	return 0, false
 }
 
-func (ctx *Context) tryChangeSrc(packet gopacket.Packet) bool {
-	layer := packet.Layer(layers.LayerTypeIPv4)
-	if layer != nil && layer.(*layers.IPv4).Version == 4 {
-		if layer.(*layers.IPv4).SrcIP.Equal(ctx.localAddr) {
-			layer.(*layers.IPv4).SrcIP = copyIP(ctx.phantomAddr)
-			return true
-		}
+// domainRule decides the DNS server queried for name
+func (ctx *Context) domainRule(name string) routeRule {
+	if strings.HasSuffix(name, ".lan.") || strings.HasSuffix(name, ".lan") {
+		return ruleLocalDomain
+	}
+	if ctx.blocked.Load().(DomainTrie).Test(name) {
+		return ruleBlockedDomain
 	}
-	return false
+	return ruleOkDomain
 }
 
-func (ctx *Context) tryRestoreDst(packet gopacket.Packet) bool {
-	layer := packet.Layer(layers.LayerTypeIPv4)
-	if layer != nil && layer.(*layers.IPv4).Version == 4 {
-		if layer.(*layers.IPv4).DstIP.Equal(ctx.phantomAddr) {
-			layer.(*layers.IPv4).DstIP = copyIP(ctx.localAddr)
-			return true
-		}
+// chinaRule decides the route to ip when no other rule does
+func (ctx *Context) chinaRule(ip net.IP) routeRule {
+	if ctx.chinaIPList.TestIP(ip) {
+		return ruleChinaIP
 	}
-	return false
+	return ruleNotChinaIP
 }
 
-var decodeOptions = gopacket.DecodeOptions{
-	Lazy: true,
-	NoCopy: true,
-	SkipDecodeRecovery: true,
+func (ctx *Context) tryChangeSrc(header *packetHeader) bool {
+	if !header.v6 {
+		return header.src.Equal(ctx.localAddr) && header.setSrc(ctx.phantomAddr)
+	}
+	return ctx.phantomAddr6 != nil && header.src.Equal(ctx.localAddr6) && header.setSrc(ctx.phantomAddr6)
 }
 
-func hasIPv4DNSLayer(packet gopacket.Packet, fn func(ipv4 *layers.IPv4, dns *layers.DNS) bool) (bool, bool) {
-	ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-	if ipv4Layer != nil && ipv4Layer.(*layers.IPv4).Version == 4 {
-		dnsLayer := packet.Layer(layers.LayerTypeDNS)
-		if dnsLayer != nil {
-			return true, fn(ipv4Layer.(*layers.IPv4), dnsLayer.(*layers.DNS))
-		}
+func (ctx *Context) tryRestoreDst(header *packetHeader) bool {
+	if !header.v6 {
+		return header.dst.Equal(ctx.phantomAddr) && header.setDst(ctx.localAddr)
 	}
-	return false, false
+	return ctx.phantomAddr6 != nil && header.dst.Equal(ctx.phantomAddr6) && header.setDst(ctx.localAddr6)
 }
 
+// cliDeviceReceived routes a packet read from the device, content is
+// rewritten in place as the device is done with it once this returns
 func (ctx *Context) cliDeviceReceived(device TunTap, tunnel Tunnel, content []byte) {
-	packet := gopacket.NewPacket(content, layers.LayerTypeIPv4, decodeOptions)
-	restored := ctx.tryRestoreDst(packet)
-	if restored {
+	var header packetHeader
+	parseHeader(content, &header)
+	if ctx.tryRestoreDst(&header) {
 		// packet modified to fast dns must come from phantom address
-		has, skip := hasIPv4DNSLayer(packet, func(ipv4 *layers.IPv4, dns *layers.DNS) bool {
-			ctx.queryList.RestoreDnsSource(dns.ID, packet.TransportLayer(), ipv4)
-			return false
-		})
-		if !has || !skip {
-			device.Send(updateChecksum(packet))
+		if msg := header.dns(); msg != nil {
+			ctx.queryList.RestoreDnsSource(&header, msg.id())
 		}
+		deviceToDevice.Count(content)
+		device.Send(content)
 		return
 	}
 
-	viaTunnel, modified := ctx.isViaTunnel(packet)
-
-	if viaTunnel {
-		if modified {
-			tunnel.Send(updateChecksum(packet))
-		} else {
-			tunnel.Send(content)
-		}
+	if ctx.isViaTunnel(&header) {
+		clampMSS(&header, tunnelPayloadMTU(tunnel))
+		deviceToTunnel.Count(content)
+		tunnel.Send(content)
 	} else {
-		changed := ctx.tryChangeSrc(packet)
-		if modified || changed {
-			device.Send(updateChecksum(packet))
-		} else {
-			device.Send(content)
-		}
+		ctx.tryChangeSrc(&header)
+		deviceToDevice.Count(content)
+		device.Send(content)
 	}
 }
 
-func (ctx *Context) cliTunnelReceived(device TunTap, _ Tunnel, content []byte) {
-	if ctx.global {
-		device.Send(content)
+func (ctx *Context) cliTunnelReceived(device TunTap, tunnel Tunnel, content []byte) {
+	tunnelToDevice.Count(content)
+	if ctx.isGlobal() {
+		device.Send(clampPacketMSS(content, tunnel))
 		return
 	}
-	packet := gopacket.NewPacket(content, layers.LayerTypeIPv4, decodeOptions)
-	has, modified := hasIPv4DNSLayer(packet, func(ipv4 *layers.IPv4, dns *layers.DNS) bool {
-		for _, ans := range dns.Answers {
-			if ans.Type == layers.DNSTypeA {
-				ctx.blockedIp.Add(int64(ans.TTL) * time.Second.Milliseconds(), ans.IP, string(ans.Name))
+	var header packetHeader
+	if parseHeader(content, &header) {
+		clampMSS(&header, tunnelPayloadMTU(tunnel))
+	}
+	if msg := header.dns(); msg != nil {
+		if _, answers, ok := msg.records(); ok {
+			for _, ans := range answers {
+				if (ans.rtype == dnsTypeA && len(ans.data) == net.IPv4len) || (ans.rtype == dnsTypeAAAA && len(ans.data) == net.IPv6len) {
+					ctx.blockedIp.Add(int64(ans.ttl) * time.Second.Milliseconds(), ans.data, ans.name)
+				}
 			}
 		}
-		return ctx.queryList.RestoreDnsSource(dns.ID, packet.TransportLayer(), ipv4)
-	})
-	if has && modified {
-		device.Send(updateChecksum(packet))
-	} else {
-		device.Send(content)
+		ctx.queryList.RestoreDnsSource(&header, msg.id())
 	}
+	device.Send(content)
 }
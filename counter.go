@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Counter struct {
+	name string
+	help string
+	value uint64
+}
+
+var (
+	countersLock sync.Mutex
+	counters []*Counter
+)
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{ name, help, 0 }
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	counters = append(counters, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int) {
+	atomic.AddUint64(&c.value, uint64(n))
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) Name() string {
+	return c.name
+}
+
+func AllCounters() []*Counter {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	copied := make([]*Counter, len(counters))
+	copy(copied, counters)
+	return copied
+}
+
+// Gauge is a value going up and down, e.g. the packets queued
+type Gauge struct {
+	name string
+	help string
+	value int64
+	fn func() int64
+}
+
+var gauges []*Gauge
+
+func NewGauge(name, help string) *Gauge {
+	return newGauge(&Gauge{ name, help, 0, nil })
+}
+
+// NewGaugeFunc makes a gauge of what fn tells when read, e.g. the size of a
+// structure not worth tracking on every change
+func NewGaugeFunc(name, help string, fn func() int64) *Gauge {
+	return newGauge(&Gauge{ name, help, 0, fn })
+}
+
+func newGauge(g *Gauge) *Gauge {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	gauges = append(gauges, g)
+	return g
+}
+
+func (g *Gauge) Add(n int) {
+	atomic.AddInt64(&g.value, int64(n))
+}
+
+func (g *Gauge) Value() int64 {
+	if g.fn != nil {
+		return g.fn()
+	}
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+func AllGauges() []*Gauge {
+	countersLock.Lock()
+	defer countersLock.Unlock()
+	copied := make([]*Gauge, len(gauges))
+	copy(copied, gauges)
+	return copied
+}
+
+// Traffic counts the packets and bytes going one direction
+type Traffic struct {
+	packets *Counter
+	bytes *Counter
+}
+
+func NewTraffic(direction, help string) *Traffic {
+	return &Traffic{
+		NewCounter(direction + "_packets_total", help + ", in packets"),
+		NewCounter(direction + "_bytes_total", help + ", in bytes"),
+	}
+}
+
+func (t *Traffic) Count(content []byte) {
+	t.packets.Inc()
+	t.bytes.Add(len(content))
+}
+
+var (
+	deviceToTunnel = NewTraffic("device_to_tunnel", "Traffic read from the device and sent through the tunnel")
+	tunnelToDevice = NewTraffic("tunnel_to_device", "Traffic received through the tunnel and written to the device")
+	// deviceToDevice is what a client routes directly rather than through the tunnel
+	deviceToDevice = NewTraffic("device_to_device", "Traffic read from the device and written back to it")
+)
+
+var (
+	tunnelAuthFailures = NewCounter("tunnel_auth_failures_total", "Received tunnel packets dropped for failing authentication")
+	tunnelRestoreErrors = NewCounter("tunnel_restore_errors_total", "Received tunnel packets dropped for malformed framing")
+	tunnelObscureErrors = NewCounter("tunnel_obscure_errors_total", "Packets dropped for failing to be obscured")
+	tunnelDestinationChanges = NewCounter("tunnel_destination_changed_total", "Times a client tunnel dialed its server anew")
+)
+
+func LogCounters(interval time.Duration) {
+	for range time.Tick(interval) {
+		var sb strings.Builder
+		for _, c := range AllCounters() {
+			if v := c.Value(); v > 0 {
+				fmt.Fprintf(&sb, " %s=%d", c.name, v)
+			}
+		}
+		for _, g := range AllGauges() {
+			if v := g.Value(); v != 0 {
+				fmt.Fprintf(&sb, " %s=%d", g.name, v)
+			}
+		}
+		if sb.Len() > 0 {
+			Info.Printf("counters:%s\n", sb.String())
+		}
+	}
+}
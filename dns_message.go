@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+const (
+	dnsHeaderLength = 12
+	dnsTypeA uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	// dnsMaxNameLength and dnsMaxPointers bound decoding a name of a message
+	// crafted to loop
+	dnsMaxNameLength = 255
+	dnsMaxPointers = 16
+)
+
+type dnsQuestion struct {
+	name string
+	qtype uint16
+}
+
+type dnsAnswer struct {
+	name string
+	rtype uint16
+	ttl uint32
+	data []byte
+}
+
+// dnsMessage is a DNS message carried by UDP, decoded just for the questions
+// and answers routing looks at. Names are dotted without the trailing dot,
+// as gopacket decodes them
+type dnsMessage []byte
+
+func (m dnsMessage) id() uint16 {
+	return binary.BigEndian.Uint16(m)
+}
+
+// records decodes the questions and answers, it tells whether m is well
+// formed as far as them
+func (m dnsMessage) records() ([]dnsQuestion, []dnsAnswer, bool) {
+	if len(m) < dnsHeaderLength {
+		return nil, nil, false
+	}
+	var questions []dnsQuestion
+	var answers []dnsAnswer
+	offset := dnsHeaderLength
+	for count := binary.BigEndian.Uint16(m[4:]); count > 0; count-- {
+		name, next, ok := m.name(offset)
+		if !ok || next + 4 > len(m) {
+			return nil, nil, false
+		}
+		questions = append(questions, dnsQuestion{ name, binary.BigEndian.Uint16(m[next:]) })
+		offset = next + 4
+	}
+	for count := binary.BigEndian.Uint16(m[6:]); count > 0; count-- {
+		name, next, ok := m.name(offset)
+		if !ok || next + 10 > len(m) {
+			return nil, nil, false
+		}
+		end := next + 10 + int(binary.BigEndian.Uint16(m[next + 8:]))
+		if end > len(m) {
+			return nil, nil, false
+		}
+		answers = append(answers, dnsAnswer{
+			name,
+			binary.BigEndian.Uint16(m[next:]),
+			binary.BigEndian.Uint32(m[next + 4:]),
+			m[next + 10:end],
+		})
+		offset = end
+	}
+	return questions, answers, true
+}
+
+// name decodes the name at offset following compression pointers, it
+// returns the offset past the name where it is
+func (m dnsMessage) name(offset int) (string, int, bool) {
+	var buf [dnsMaxNameLength]byte
+	name := buf[:0]
+	next, pointers := -1, 0
+	for offset < len(m) {
+		length := int(m[offset])
+		switch length & 0xc0 {
+		case 0x00:
+			if length == 0 {
+				if next < 0 {
+					next = offset + 1
+				}
+				return string(name), next, true
+			}
+			if offset + 1 + length > len(m) || len(name) + 1 + length > len(buf) {
+				return "", 0, false
+			}
+			if len(name) > 0 {
+				name = append(name, '.')
+			}
+			name = append(name, m[offset + 1:offset + 1 + length]...)
+			offset += 1 + length
+		case 0xc0:
+			if offset + 2 > len(m) || pointers == dnsMaxPointers {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(m[offset:]) & 0x3fff)
+			pointers++
+		default:
+			return "", 0, false
+		}
+	}
+	return "", 0, false
+}
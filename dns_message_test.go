@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+func dnsPayload(dns *layers.DNS) []byte {
+	buffer := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buffer, gopacket.SerializeOptions{ FixLengths: true }); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDNSRecords(t *testing.T) {
+	msg := dnsMessage(dnsPayload(&layers.DNS{
+		ID: 201,
+		QR: true,
+		Questions: []layers.DNSQuestion{
+			{ Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN },
+		},
+		Answers: []layers.DNSResourceRecord{
+			{ Name: []byte("www.example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.IPv4(1, 2, 3, 4) },
+			{ Name: []byte("www.example.com"), Type: layers.DNSTypeAAAA, Class: layers.DNSClassIN, TTL: 60, IP: net.ParseIP("2001:db8::1") },
+		},
+	}))
+	if msg.id() != 201 {
+		t.Errorf("Expect id 201 but got %d\n", msg.id())
+	}
+	questions, answers, ok := msg.records()
+	if !ok || len(questions) != 1 || len(answers) != 2 {
+		t.Fatalf("Expect 1 question and 2 answers but got %v %v %v\n", ok, questions, answers)
+	}
+	if questions[0] != (dnsQuestion{ "www.example.com", dnsTypeA }) {
+		t.Errorf("Expect question of www.example.com but got %v\n", questions[0])
+	}
+	if a := answers[0]; a.name != "www.example.com" || a.rtype != dnsTypeA || a.ttl != 300 || !net.IP(a.data).Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("Expect A answer but got %v\n", a)
+	}
+	if a := answers[1]; a.rtype != dnsTypeAAAA || a.ttl != 60 || !net.IP(a.data).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Expect AAAA answer but got %v\n", a)
+	}
+}
+
+func TestDNSCompressedName(t *testing.T) {
+	header := []byte{ 0, 1, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0 }
+	question := []byte{ 3, 'w', 'w', 'w', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1 }
+	// an alias pointing into the question name
+	answer := []byte{ 3, 'c', 'd', 'n', 0xc0, 16, 0, 1, 0, 1, 0, 0, 0, 10, 0, 4, 5, 6, 7, 8 }
+	msg := dnsMessage(append(append(header, question...), answer...))
+	_, answers, ok := msg.records()
+	if !ok || len(answers) != 1 || answers[0].name != "cdn.example.com" {
+		t.Errorf("Expect answer of cdn.example.com but got %v %v\n", ok, answers)
+	}
+
+	malformed := []dnsMessage{
+		// pointing to itself
+		append(append([]byte{}, header[:6]...), 0, 0, 0, 0, 0, 0, 0xc0, 12, 0, 1, 0, 1),
+		// truncated label
+		append(append([]byte{}, header...), question[:10]...),
+		// missing type and class
+		append(append([]byte{}, header...), question[:17]...),
+		dnsMessage(header[:8]),
+	}
+	for i, msg := range malformed {
+		if _, _, ok := msg.records(); ok {
+			t.Errorf("Expect malformed message %d rejected\n", i)
+		}
+	}
+}
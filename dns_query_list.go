@@ -2,9 +2,8 @@ package main
 
 import (
 	"encoding/binary"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -17,13 +16,16 @@ type Query struct {
 	replaced net.IP
 }
 
+// QueryList is shared by the workers of every device queue and the tunnel
 type QueryList struct {
+	lock sync.Mutex
 	queries []Query
 	queryMap map[uint64]Query
 }
 
 func NewQueryList() *QueryList {
 	return &QueryList{
+		sync.Mutex{},
 		make([]Query, 0, 16),
 		make(map[uint64]Query),
 	}
@@ -50,55 +52,51 @@ func (ql *QueryList) expire() {
 	ql.queries = ql.queries[skipped:]
 }
 
-func (ql *QueryList) ChangeToServer(id uint16, transportLayer gopacket.TransportLayer, ipv4Layer *layers.IPv4, server net.IP) bool {
+// ChangeToServer redirects the query of id in an IPv4 packet to server
+func (ql *QueryList) ChangeToServer(header *packetHeader, id uint16, server net.IP) bool {
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
 	ql.expire()
-	if ipv4Layer.DstIP.Equal(server) {
-		return false
-	}
-
-	var srcPort uint16
-	switch transportLayer.LayerType() {
-	case layers.LayerTypeTCP:
-		srcPort = uint16(transportLayer.(*layers.TCP).SrcPort)
-	case layers.LayerTypeUDP:
-		srcPort = uint16(transportLayer.(*layers.UDP).SrcPort)
-	default:
+	if header.v6 || !header.hasPorts() || header.dst.Equal(server) {
 		return false
 	}
 
+	// the addresses of the packet are in a buffer to be reused, server is not
+	addrs := make(net.IP, 8)
+	copy(addrs, header.src)
+	copy(addrs[4:], header.dst)
 	query := Query{
 		time.Now().UnixNano(),
 		id,
-		srcPort,
-		copyIP(ipv4Layer.SrcIP),
-		copyIP(ipv4Layer.DstIP),
-		copyIP(server),
+		header.srcPort,
+		addrs[:4:4],
+		addrs[4:],
+		server,
+	}
+	if !header.setDst(server) {
+		return false
 	}
 	ql.queries = append(ql.queries, query)
 
 	key := toKey(query.srcIP, query.srcPort, query.id)
 	ql.queryMap[key] = query
-
-	ipv4Layer.DstIP = copyIP(server)
 	return true
 }
 
-func (ql *QueryList) RestoreDnsSource(id uint16, transportLayer gopacket.TransportLayer, ipv4Layer *layers.IPv4) bool {
-	var dstPort uint16
-	switch transportLayer.LayerType() {
-	case layers.LayerTypeTCP:
-		dstPort = uint16(transportLayer.(*layers.TCP).DstPort)
-	case layers.LayerTypeUDP:
-		dstPort = uint16(transportLayer.(*layers.UDP).DstPort)
-	default:
+// RestoreDnsSource restores the source of the answer of id to an IPv4 packet
+// redirected by ChangeToServer
+func (ql *QueryList) RestoreDnsSource(header *packetHeader, id uint16) bool {
+	if header.v6 || !header.hasPorts() {
 		return false
 	}
 
-	key := toKey(ipv4Layer.DstIP, dstPort, id)
-	if query, ok := ql.queryMap[key]; ok {
-		if query.replaced.Equal(ipv4Layer.SrcIP) {
-			ipv4Layer.SrcIP = copyIP(query.original)
-			return true
+	key := toKey(header.dst, header.dstPort, id)
+	ql.lock.Lock()
+	query, ok := ql.queryMap[key]
+	ql.lock.Unlock()
+	if ok {
+		if query.replaced.Equal(header.src) {
+			return header.setSrc(query.original)
 		}
 	}
 	return false
@@ -1,65 +1,45 @@
 package main
 
 import (
-	"github.com/google/gopacket/layers"
 	"net"
 	"testing"
 )
 
 func TestChange(t *testing.T) {
-	ipLayer := layers.IPv4{
-		SrcIP:    net.IPv4(127, 0, 0, 1),
-		DstIP:    net.IPv4(114, 114, 114, 114),
-		Protocol: layers.IPProtocolUDP,
-	}
-	udpLayer := layers.UDP{
-		SrcPort:   0,
-		DstPort:   50000,
-		Length:    0,
-		Checksum:  0,
-	}
+	packet := udpPacket(net.IPv4(127, 0, 0, 1), net.IPv4(114, 114, 114, 114), 0, 50000, nil)
 	server := net.IPv4(8, 8, 8, 8)
 
+	var header packetHeader
+	parseHeader(packet, &header)
 	ql := NewQueryList()
-	ql.ChangeToServer(201, &udpLayer, &ipLayer, server)
+	ql.ChangeToServer(&header, 201, server)
 
-	if !ipLayer.DstIP.Equal(server) {
-		t.Errorf("Expect dst ip: %v, but got: %v\n", server, ipLayer.DstIP)
+	if !packetDstIP(packet).Equal(server) {
+		t.Errorf("Expect dst ip: %v, but got: %v\n", server, packetDstIP(packet))
+	}
+	if !checksumValid(packet) {
+		t.Errorf("Expect valid checksum\n")
 	}
 }
 
 func TestRestore(t *testing.T) {
-	ipLayer := layers.IPv4{
-		SrcIP:    net.IPv4(127, 0, 0, 1),
-		DstIP:    net.IPv4(114, 114, 114, 114),
-		Protocol: layers.IPProtocolUDP,
-	}
-	udpRequest := layers.UDP{
-		SrcPort:   0,
-		DstPort:   50000,
-		Length:    0,
-		Checksum:  0,
-	}
+	packet := udpPacket(net.IPv4(127, 0, 0, 1), net.IPv4(114, 114, 114, 114), 0, 50000, nil)
 	server := net.IPv4(8, 8, 8, 8)
 
+	var header packetHeader
+	parseHeader(packet, &header)
 	ql := NewQueryList()
-	ql.ChangeToServer(201, &udpRequest, &ipLayer, server)
+	ql.ChangeToServer(&header, 201, server)
 
 	// RESPONSE
-	ipLayer = layers.IPv4{
-		SrcIP:    net.IPv4(8, 8, 8, 8),
-		DstIP:    net.IPv4(127, 0, 0, 1),
-		Protocol: layers.IPProtocolUDP,
-	}
-	udpResponse := layers.UDP{
-		SrcPort:   50000,
-		DstPort:   0,
-		Length:    0,
-		Checksum:  0,
-	}
-	ql.RestoreDnsSource(201, &udpResponse, &ipLayer)
+	packet = udpPacket(net.IPv4(8, 8, 8, 8), net.IPv4(127, 0, 0, 1), 50000, 0, nil)
+	parseHeader(packet, &header)
+	ql.RestoreDnsSource(&header, 201)
 
-	if !ipLayer.SrcIP.Equal(net.IPv4(114, 114, 114, 114)) {
-		t.Errorf("Expect src ip: %v, but got: %v\n", net.IPv4(114, 114, 114, 114), ipLayer.SrcIP)
+	if !packetSrcIP(packet).Equal(net.IPv4(114, 114, 114, 114)) {
+		t.Errorf("Expect src ip: %v, but got: %v\n", net.IPv4(114, 114, 114, 114), packetSrcIP(packet))
+	}
+	if !checksumValid(packet) {
+		t.Errorf("Expect valid checksum\n")
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	etherHeaderLength = 14
+	etherTypeIPv4 = 0x0800
+	etherTypeARP = 0x0806
+	etherTypeIPv6 = 0x86dd
+	arpLength = 28
+)
+
+var broadcastMAC = net.HardwareAddr{ 0xff, 0xff, 0xff, 0xff, 0xff, 0xff }
+
+func randomMAC() (net.HardwareAddr, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return nil, err
+	}
+	// unicast and locally administered
+	mac[0] = mac[0] & 0xfe | 0x02
+	return mac, nil
+}
+
+// EthernetDevice runs the IP handling of tun mode on a tap device, frames read
+// are stripped to IP packets and packets sent are framed again. It stands for
+// the addresses behind the device, e.g. the phantom and local ones of a client,
+// ARP is answered for those only with a MAC of its own
+type EthernetDevice struct {
+	device TunTap
+	mac net.HardwareAddr
+	peer atomic.Value
+	owned atomic.Value
+	handler func (TunTap, []byte)
+}
+
+func NewEthernetDevice(device TunTap) (TunTap, error) {
+	mac, err := randomMAC()
+	if err != nil {
+		return nil, err
+	}
+	e := &EthernetDevice{ device: device, mac: mac }
+	e.peer.Store(broadcastMAC)
+	Info.Printf("%s answers ARP as %v\n", device.Name(), e.mac)
+	return e, nil
+}
+
+// SetOwned makes ARP answered for the addresses owned tells to be behind the
+// device, nothing is answered before
+func (e *EthernetDevice) SetOwned(owned func (net.IP) bool) {
+	e.owned.Store(owned)
+}
+
+func (e *EthernetDevice) Send(packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	etherType := uint16(etherTypeIPv4)
+	if packet[0] >> 4 == 6 {
+		etherType = etherTypeIPv6
+	}
+	frame := make([]byte, etherHeaderLength + len(packet))
+	copy(frame[0:6], e.peer.Load().(net.HardwareAddr))
+	copy(frame[6:12], e.mac)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	copy(frame[etherHeaderLength:], packet)
+	e.device.Send(frame)
+}
+
+func (e *EthernetDevice) SetHandler(handler func (TunTap, []byte)) {
+	e.handler = handler
+	e.device.SetHandler(func (_ TunTap, frame []byte) { e.received(frame) })
+}
+
+func (e *EthernetDevice) Name() string {
+	return e.device.Name()
+}
+
+func (e *EthernetDevice) received(frame []byte) {
+	if len(frame) < etherHeaderLength {
+		return
+	}
+	// frames to us come from the host owning the device, answer to it
+	if src := net.HardwareAddr(frame[6:12]); src[0] & 0x01 == 0 && !bytes.Equal(src, e.peer.Load().(net.HardwareAddr)) {
+		Info.Printf("%s peer is %v\n", e.Name(), src)
+		e.peer.Store(copyHardwareAddr(src))
+	}
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeIPv4, etherTypeIPv6:
+		if e.handler == nil {
+			Warning.Printf("no handler set, skip %d bytes", len(frame))
+			return
+		}
+		e.handler(e, frame[etherHeaderLength:])
+	case etherTypeARP:
+		if reply := e.answerARP(frame[etherHeaderLength:]); reply != nil {
+			e.device.Send(reply)
+		}
+	default:
+		Debug.Printf("%s skip frame of type %x\n", e.Name(), frame[12:14])
+	}
+}
+
+// answerARP returns the frame replying an ARP request for an owned address,
+// nil for anything else including announcements of the host itself
+func (e *EthernetDevice) answerARP(arp []byte) []byte {
+	if len(arp) < arpLength ||
+		binary.BigEndian.Uint16(arp[0:]) != 1 || binary.BigEndian.Uint16(arp[2:]) != etherTypeIPv4 ||
+		arp[4] != 6 || arp[5] != 4 || binary.BigEndian.Uint16(arp[6:]) != 1 {
+		return nil
+	}
+	senderMAC, senderIP, targetIP := arp[8:14], arp[14:18], arp[24:28]
+	if bytes.Equal(senderIP, targetIP) {
+		return nil
+	}
+	// other hosts may share the segment, their addresses are not ours to claim
+	if owned, _ := e.owned.Load().(func (net.IP) bool); owned == nil || !owned(copyIP(targetIP)) {
+		return nil
+	}
+	Debug.Printf("answer ARP of %v to %v\n", net.IP(targetIP), net.IP(senderIP))
+
+	frame := make([]byte, etherHeaderLength + arpLength)
+	copy(frame[0:6], senderMAC)
+	copy(frame[6:12], e.mac)
+	binary.BigEndian.PutUint16(frame[12:], etherTypeARP)
+	reply := frame[etherHeaderLength:]
+	copy(reply[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(reply[6:], 2)
+	copy(reply[8:14], e.mac)
+	copy(reply[14:18], targetIP)
+	copy(reply[18:24], senderMAC)
+	copy(reply[24:28], senderIP)
+	return frame
+}
+
+func copyHardwareAddr(mac net.HardwareAddr) net.HardwareAddr {
+	return net.HardwareAddr(copyBytes(mac))
+}
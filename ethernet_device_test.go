@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+type fakeTunTap struct {
+	sent [][]byte
+	handler func (TunTap, []byte)
+}
+
+func (f *fakeTunTap) Send(content []byte) {
+	f.sent = append(f.sent, copyBytes(content))
+}
+
+func (f *fakeTunTap) SetHandler(handler func (TunTap, []byte)) {
+	f.handler = handler
+}
+
+func (f *fakeTunTap) Name() string {
+	return "fake0"
+}
+
+type fakeTunnel struct {
+	sent [][]byte
+	handler func (Tunnel, []byte)
+}
+
+func (f *fakeTunnel) Send(content []byte) {
+	f.sent = append(f.sent, copyBytes(content))
+}
+
+func (f *fakeTunnel) SetHandler(handler func (Tunnel, []byte)) {
+	f.handler = handler
+}
+
+func ethernetFrame(dst, src net.HardwareAddr, etherType uint16, payload []byte) []byte {
+	frame := make([]byte, etherHeaderLength, etherHeaderLength + len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(frame, payload...)
+}
+
+func arpRequest(senderMAC net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	arp := make([]byte, arpLength)
+	binary.BigEndian.PutUint16(arp[0:], 1)
+	binary.BigEndian.PutUint16(arp[2:], etherTypeIPv4)
+	arp[4], arp[5] = 6, 4
+	binary.BigEndian.PutUint16(arp[6:], 1)
+	copy(arp[8:14], senderMAC)
+	copy(arp[14:18], senderIP.To4())
+	copy(arp[24:28], targetIP.To4())
+	return ethernetFrame(broadcastMAC, senderMAC, etherTypeARP, arp)
+}
+
+func TestEthernetDeviceARP(t *testing.T) {
+	tap := &fakeTunTap{}
+	ethernet, err := NewEthernetDevice(tap)
+	if err != nil {
+		t.Fatalf("Failed to create device: %v", err)
+	}
+	device := ethernet.(*EthernetDevice)
+	device.SetHandler(func (TunTap, []byte) {})
+	host := net.HardwareAddr{ 0x00, 0x11, 0x22, 0x33, 0x44, 0x55 }
+
+	tap.handler(tap, arpRequest(host, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)))
+	if len(tap.sent) != 0 {
+		t.Fatalf("Expect no ARP reply before addresses are owned but got %d", len(tap.sent))
+	}
+	device.SetOwned(func (ip net.IP) bool { return ip.Equal(net.IPv4(10, 0, 0, 2)) })
+	tap.handler(tap, arpRequest(host, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)))
+	if len(tap.sent) != 1 {
+		t.Fatalf("Expect 1 ARP reply but got %d", len(tap.sent))
+	}
+	reply := tap.sent[0]
+	arp := reply[etherHeaderLength:]
+	if !bytes.Equal(reply[0:6], host) || binary.BigEndian.Uint16(arp[6:]) != 2 {
+		t.Errorf("Expect ARP reply to %v but got %x", host, reply)
+	}
+	if !bytes.Equal(arp[8:14], device.mac) || !net.IP(arp[14:18]).Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Expect 10.0.0.2 at %v but got %v at %v", device.mac, net.IP(arp[14:18]), net.HardwareAddr(arp[8:14]))
+	}
+
+	// announcements are not answered
+	tap.handler(tap, arpRequest(host, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 1)))
+	if len(tap.sent) != 1 {
+		t.Errorf("Expect gratuitous ARP ignored but got %d frames", len(tap.sent))
+	}
+	// nor hosts sharing the segment
+	tap.handler(tap, arpRequest(host, net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 3)))
+	if len(tap.sent) != 1 {
+		t.Errorf("Expect ARP for 10.0.0.3 ignored but got %d frames", len(tap.sent))
+	}
+}
+
+func TestEthernetDeviceFraming(t *testing.T) {
+	tap := &fakeTunTap{}
+	ethernet, _ := NewEthernetDevice(tap)
+	device := ethernet.(*EthernetDevice)
+	var received []byte
+	device.SetHandler(func (_ TunTap, packet []byte) { received = copyBytes(packet) })
+	host := net.HardwareAddr{ 0x00, 0x11, 0x22, 0x33, 0x44, 0x55 }
+	packet := []byte{ 0x45, 0, 0, 20 }
+
+	device.Send(packet)
+	if !bytes.Equal(tap.sent[0][0:6], broadcastMAC) {
+		t.Errorf("Expect broadcast before the host is known but got %v", net.HardwareAddr(tap.sent[0][0:6]))
+	}
+
+	tap.handler(tap, ethernetFrame(device.mac, host, etherTypeIPv4, packet))
+	if !bytes.Equal(received, packet) {
+		t.Errorf("Expect %x but got %x", packet, received)
+	}
+
+	device.Send([]byte{ 0x60, 0, 0, 0 })
+	frame := tap.sent[1]
+	if !bytes.Equal(frame[0:6], host) || !bytes.Equal(frame[6:12], device.mac) || binary.BigEndian.Uint16(frame[12:]) != etherTypeIPv6 {
+		t.Errorf("Expect IPv6 frame from %v to %v but got %x", device.mac, host, frame[:etherHeaderLength])
+	}
+}
+
+func TestBridgeServer(t *testing.T) {
+	tap := &fakeTunTap{}
+	tunnel := &fakeTunnel{}
+	startBridgeServer(tap, tunnel, defaultSessionTimeout)
+	alice, bob := &fakeTunnel{}, &fakeTunnel{}
+	aliceMAC := net.HardwareAddr{ 0x02, 0, 0, 0, 0, 0xa }
+	bobMAC := net.HardwareAddr{ 0x02, 0, 0, 0, 0, 0xb }
+
+	tunnel.handler(alice, markFrame(ethernetFrame(broadcastMAC, aliceMAC, etherTypeARP, make([]byte, arpLength))))
+	tunnel.handler(bob, markFrame(ethernetFrame(broadcastMAC, bobMAC, etherTypeARP, make([]byte, arpLength))))
+	if len(tap.sent) != 2 || len(alice.sent) != 1 || len(bob.sent) != 0 {
+		t.Errorf("Expect broadcasts flooded but got %d %d %d", len(tap.sent), len(alice.sent), len(bob.sent))
+	}
+
+	// between clients frames do not go to the device
+	tunnel.handler(alice, markFrame(ethernetFrame(bobMAC, aliceMAC, etherTypeIPv4, []byte{ 0x45 })))
+	if len(tap.sent) != 2 || len(bob.sent) != 1 {
+		t.Errorf("Expect frame switched to bob but got %d %d", len(tap.sent), len(bob.sent))
+	}
+
+	tap.handler(tap, ethernetFrame(aliceMAC, net.HardwareAddr{ 0x02, 0, 0, 0, 0, 1 }, etherTypeIPv4, []byte{ 0x45 }))
+	if len(alice.sent) != 2 || len(bob.sent) != 1 {
+		t.Errorf("Expect frame switched to alice but got %d %d", len(alice.sent), len(bob.sent))
+	}
+	if frame := unmarkFrame(alice.sent[1]); frame == nil || !bytes.Equal(frame[0:6], aliceMAC) {
+		t.Errorf("Expect marked frame to alice but got %x", alice.sent[1])
+	}
+}
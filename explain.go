@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/ini.v1"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// routeRule is one of the rules isViaTunnel checks, the first which applies
+// decides whether a packet goes through the tunnel
+type routeRule int
+
+const (
+	ruleSkipped routeRule = iota
+	ruleRemote
+	ruleNotGlobalUnicast
+	ruleGlobal
+	ruleBlockedIP
+	ruleLocalDomain
+	ruleBlockedDomain
+	ruleOkDomain
+	ruleChinaIP
+	ruleNotChinaIP
+)
+
+var routeRuleNames = []string{
+	"skipped_addresses",
+	"remote_addr",
+	"not_global_unicast",
+	"global",
+	"blocked_ip",
+	"lan_domain",
+	"blocked_domain",
+	"ok_domain",
+	"china_ip",
+	"not_china_ip",
+}
+
+func (r routeRule) String() string {
+	return routeRuleNames[r]
+}
+
+func (r routeRule) viaTunnel() bool {
+	switch r {
+	case ruleRemote, ruleGlobal, ruleBlockedIP, ruleBlockedDomain, ruleNotChinaIP:
+		return true
+	}
+	return false
+}
+
+// Explanation tells which rule routes a target and why
+type Explanation struct {
+	Target string `json:"target"`
+	ViaTunnel bool `json:"via_tunnel"`
+	Rule string `json:"rule"`
+	Reason string `json:"reason"`
+	// Addresses explains the blocked addresses a domain resolved to
+	Addresses []*Explanation `json:"addresses,omitempty"`
+}
+
+// Explain tells how target, an address or a domain, is routed. A domain is
+// routed as its DNS queries are, blockedFile is searched for the line which
+// blocks it. Explaining changes nothing, blocked addresses are not kept for
+// longer as when packets are sent to them
+func (ctx *Context) Explain(target, blockedFile string) (*Explanation, error) {
+	if ip := net.ParseIP(strings.TrimSpace(target)); ip != nil {
+		return ctx.explainAddress(ip), nil
+	}
+	domain, err := normalizeDomain(target)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.explainDomain(domain, blockedFile), nil
+}
+
+func (ctx *Context) explainAddress(ip net.IP) *Explanation {
+	rule, ok := ctx.addressRule(ip, false)
+	if !ok {
+		rule = ctx.chinaRule(ip)
+	}
+	var reason string
+	switch rule {
+	case ruleSkipped:
+		reason = fmt.Sprintf("%v is in skipped_addresses", ip)
+	case ruleRemote:
+		reason = fmt.Sprintf("%v is remote_addr, the server of the tunnel", ip)
+	case ruleNotGlobalUnicast:
+		reason = fmt.Sprintf("%v is not a global unicast address", ip)
+	case ruleGlobal:
+		reason = "global is on, every global unicast address goes through the tunnel"
+	case ruleBlockedIP:
+		reason = fmt.Sprintf("%v was resolved from blocked domains %s", ip, strings.Join(ctx.blockedDomainsOf(ip), ", "))
+		if ctx.chinaIPList.TestIP(ip) {
+			reason += ", though it is in the china ip list"
+		}
+	case ruleChinaIP:
+		reason = fmt.Sprintf("%v is in the china ip list", ip)
+	case ruleNotChinaIP:
+		reason = fmt.Sprintf("%v is neither resolved from a blocked domain nor in the china ip list", ip)
+	}
+	return &Explanation{ ip.String(), rule.viaTunnel(), rule.String(), reason, nil }
+}
+
+// blockedDomainsOf lists the domains ip was resolved from, sorted, leaving
+// out the mark of the address being visited
+func (ctx *Context) blockedDomainsOf(ip net.IP) []string {
+	var domains []string
+	for _, domain := range ctx.blockedIp.IPDomains(ip) {
+		if domain != "*" {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+// dnsServerOf returns the DNS server queries routed by rule go to
+func (ctx *Context) dnsServerOf(rule routeRule) net.IP {
+	switch rule {
+	case ruleLocalDomain:
+		return ctx.localDNS
+	case ruleBlockedDomain:
+		return ctx.cleanDNS
+	}
+	return ctx.fastDNS
+}
+
+// explainDomain explains the route of the queries of domain as they are sent
+// to the DNS server the DNS rules choose, whose address rules come first
+func (ctx *Context) explainDomain(domain, blockedFile string) *Explanation {
+	rule := ctx.domainRule(domain)
+	server := ctx.dnsServerOf(rule)
+	if server != nil {
+		if byAddress, ok := ctx.addressRule(server, false); ok {
+			rule = byAddress
+		}
+	} else if ctx.isGlobal() {
+		rule = ruleGlobal
+	}
+	var reason string
+	switch rule {
+	case ruleGlobal:
+		reason = fmt.Sprintf("global is on, queries of %s go through the tunnel to the server they are sent to", domain)
+	case ruleLocalDomain:
+		reason = fmt.Sprintf("%s is a .lan domain, its queries go to local_dns %v", domain, ctx.localDNS)
+	case ruleBlockedDomain:
+		by := ""
+		if line := blockingLine(domain, blockedFile); line != "" {
+			by = " by " + line + " in " + blockedFile
+		}
+		reason = fmt.Sprintf("%s is blocked%s, its queries go to clean_dns %v through the tunnel", domain, by, ctx.cleanDNS)
+	case ruleOkDomain:
+		reason = fmt.Sprintf("%s is not blocked, its queries go to fast_dns %v and its addresses are routed by the china ip list", domain, ctx.fastDNS)
+	default:
+		reason = fmt.Sprintf("queries of %s are sent as they are since %s", domain, ctx.explainAddress(server).Reason)
+	}
+	explanation := &Explanation{ domain, rule.viaTunnel(), rule.String(), reason, nil }
+
+	for _, ip := range ctx.blockedIp.IPs() {
+		for _, resolvedFrom := range ctx.blockedIp.IPDomains(ip) {
+			if strings.EqualFold(strings.TrimSuffix(resolvedFrom, "."), domain) {
+				explanation.Addresses = append(explanation.Addresses, ctx.explainAddress(ip))
+				break
+			}
+		}
+	}
+	sort.Slice(explanation.Addresses, func(i, j int) bool {
+		return explanation.Addresses[i].Target < explanation.Addresses[j].Target
+	})
+	return explanation
+}
+
+// blockingLine finds the line of blockedFile which blocks domain, the most
+// specific one if several do
+func blockingLine(domain, blockedFile string) string {
+	domains, err := readBlockedList(blockedFile)
+	if err != nil {
+		return ""
+	}
+	found := ""
+	for _, listed := range domains {
+		listed = strings.ToLower(strings.TrimSuffix(listed, "."))
+		if (domain == listed || strings.HasSuffix(domain, "." + listed)) && len(listed) > len(found) {
+			found = listed
+		}
+	}
+	return found
+}
+
+func writeExplanation(w io.Writer, e *Explanation, indent string) error {
+	route := "direct"
+	if e.ViaTunnel {
+		route = "tunnel"
+	}
+	if _, err := fmt.Fprintf(w, "%s%s: %s by %s\n%s  %s\n", indent, e.Target, route, e.Rule, indent, e.Reason); err != nil {
+		return err
+	}
+	for _, address := range e.Addresses {
+		if err := writeExplanation(w, address, indent + "  "); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runExplain explains the route of each address or domain of args offline,
+// loading the lists a client started with the same config would
+func runExplain(args []string, w io.Writer) error {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	file := flags.String("f", "", "config file")
+	asJSON := flags.Bool("json", false, "print explanations as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: gotun explain -f <config> [-json] <ip|domain>...")
+	}
+	cfg, err := ini.Load(*file)
+	if err != nil {
+		return fmt.Errorf("bad config: %v", err)
+	}
+
+	// records are read without persisting them back, the running client
+	// if any owns the file
+	blockedIp := NewAddressQueue()
+	if _, err := os.Stat(blockedRecordsFile); err == nil {
+		readAddressRecords(blockedRecordsFile, blockedIp.(*AddressQueueImpl))
+	}
+	ctx := newContext(cfg.Section("client"), blockedIp, nil, nil)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	for _, target := range flags.Args() {
+		explanation, err := ctx.Explain(target, blockedFile)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			err = encoder.Encode(explanation)
+		} else {
+			err = writeExplanation(w, explanation, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"github.com/google/gopacket/layers"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newExplainContext routes as a client whose blocked list is in dir
+func newExplainContext(t *testing.T, dir string) (*Context, string) {
+	file := filepath.Join(dir, "blocked.txt")
+	if err := ioutil.WriteFile(file, []byte("google.com\ntwitter.com\n"), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v\n", file, err)
+	}
+	chinaIPList := NewChinaIPList("")
+	chinaIPList.Add([]string{ "114.114.0.0/16" })
+	ctx := &Context{
+		blockedIp: NewAddressQueue(),
+		skippedIp: NewAddressSet("10.1.1.1"),
+		remoteAddr: net.IPv4(192, 0, 2, 1),
+		fastDNS: net.IPv4(114, 114, 114, 114),
+		cleanDNS: net.IPv4(8, 8, 8, 8),
+		localDNS: net.IPv4(192, 168, 1, 1),
+		chinaIPList: chinaIPList,
+	}
+	ctx.blocked.Store(NewDomainTrie(file))
+	ctx.blockedIp.Add(60000, net.IPv4(114, 114, 1, 1), "www.google.com")
+	ctx.blockedIp.Add(60000, net.IPv4(142, 250, 1, 1), "mail.google.com")
+	return ctx, file
+}
+
+func TestExplain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "explain")
+	defer os.RemoveAll(dir)
+	ctx, file := newExplainContext(t, dir)
+
+	tests := []struct {
+		target string
+		viaTunnel bool
+		rule string
+		reason string
+	}{
+		{ "10.1.1.1", false, "skipped_addresses", "skipped_addresses" },
+		{ "192.0.2.1", true, "remote_addr", "remote_addr" },
+		{ "192.168.1.10", true, "not_china_ip", "nor in the china ip list" },
+		{ "127.0.0.1", false, "not_global_unicast", "not a global unicast" },
+		{ "114.114.1.1", true, "blocked_ip", "www.google.com, though it is in the china ip list" },
+		{ "114.114.2.2", false, "china_ip", "in the china ip list" },
+		{ "1.1.1.1", true, "not_china_ip", "nor in the china ip list" },
+		{ "router.lan", false, "lan_domain", "local_dns 192.168.1.1" },
+		{ "Mail.Google.com.", true, "blocked_domain", "by google.com in " + file },
+		{ "twitter.com", true, "blocked_domain", "by twitter.com in " + file },
+		{ "baidu.com", false, "ok_domain", "fast_dns 114.114.114.114" },
+	}
+	for _, test := range tests {
+		e, err := ctx.Explain(test.target, file)
+		if err != nil {
+			t.Errorf("Expect %s explained but got %v\n", test.target, err)
+			continue
+		}
+		if e.ViaTunnel != test.viaTunnel || e.Rule != test.rule || !strings.Contains(e.Reason, test.reason) {
+			t.Errorf("Expect %s %v by %s for %q but got %v by %s for %q\n",
+				test.target, test.viaTunnel, test.rule, test.reason, e.ViaTunnel, e.Rule, e.Reason)
+		}
+	}
+
+	e, _ := ctx.Explain("mail.google.com", file)
+	if len(e.Addresses) != 1 || e.Addresses[0].Target != "142.250.1.1" || e.Addresses[0].Rule != "blocked_ip" {
+		t.Errorf("Expect 142.250.1.1 resolved from mail.google.com but got %v\n", e.Addresses)
+	}
+	if _, err := ctx.Explain("a b", file); err == nil {
+		t.Errorf("Expect a bad target refused\n")
+	}
+
+	ctx.setGlobal(true)
+	for _, target := range []string{ "114.114.2.2", "baidu.com" } {
+		if e, _ := ctx.Explain(target, file); !e.ViaTunnel || e.Rule != "global" {
+			t.Errorf("Expect global route of %s but got %v by %s\n", target, e.ViaTunnel, e.Rule)
+		}
+	}
+}
+
+// TestExplainAgreesWithRoute checks explain reports the route packets take
+func TestExplainAgreesWithRoute(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "explain")
+	defer os.RemoveAll(dir)
+	ctx, file := newExplainContext(t, dir)
+
+	src := net.IPv4(10, 0, 0, 1)
+	for _, dst := range []string{ "10.1.1.1", "192.0.2.1", "127.0.0.1", "114.114.1.1", "114.114.2.2", "1.1.1.1" } {
+		var h packetHeader
+		parseHeader(udpPacket(src, net.ParseIP(dst), 1000, 5000, nil), &h)
+		e, _ := ctx.Explain(dst, file)
+		if viaTunnel := ctx.isViaTunnel(&h); viaTunnel != e.ViaTunnel {
+			t.Errorf("Expect %s routed %v as explained but got %v\n", dst, e.ViaTunnel, viaTunnel)
+		}
+	}
+
+	// queries sent to the DNS server the rules choose, one of them skipped
+	ctx.skippedIp = NewAddressSet("10.1.1.1,8.8.8.8")
+	ctx.queryList = NewQueryList()
+	for _, domain := range []string{ "router.lan", "twitter.com", "baidu.com" } {
+		e, _ := ctx.Explain(domain, file)
+		query := dnsPayload(&layers.DNS{
+			ID: 1,
+			Questions: []layers.DNSQuestion{ { Name: []byte(domain), Type: layers.DNSTypeA, Class: layers.DNSClassIN } },
+		})
+		var h packetHeader
+		parseHeader(udpPacket(src, ctx.dnsServerOf(ctx.domainRule(domain)), 1000, 53, query), &h)
+		if viaTunnel := ctx.isViaTunnel(&h); viaTunnel != e.ViaTunnel {
+			t.Errorf("Expect queries of %s routed %v as explained but got %v\n", domain, e.ViaTunnel, viaTunnel)
+		}
+	}
+	if e, _ := ctx.Explain("twitter.com", file); e.Rule != "skipped_addresses" || !strings.Contains(e.Reason, "8.8.8.8 is in skipped_addresses") {
+		t.Errorf("Expect queries of twitter.com skipped with clean_dns but got %s for %q\n", e.Rule, e.Reason)
+	}
+}
+
+func TestWriteExplanation(t *testing.T) {
+	e := &Explanation{ "google.com", true, "blocked_domain", "google.com is blocked", []*Explanation{
+		{ "1.2.3.4", true, "blocked_ip", "1.2.3.4 was resolved from blocked domains google.com", nil },
+	} }
+	var buffer bytes.Buffer
+	if err := writeExplanation(&buffer, e, ""); err != nil {
+		t.Fatalf("Failed to write explanation: %v\n", err)
+	}
+	expected := "google.com: tunnel by blocked_domain\n" +
+		"  google.com is blocked\n" +
+		"  1.2.3.4: tunnel by blocked_ip\n" +
+		"    1.2.3.4 was resolved from blocked domains google.com\n"
+	if buffer.String() != expected {
+		t.Errorf("Expect %q but got %q\n", expected, buffer.String())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var failovers = NewCounter("failover_switched_total", "Times the client switched to another server")
+
+// healthChecker is implemented by connecting tunnels which know whether their
+// server answers
+type healthChecker interface {
+
+	Alive() bool
+
+}
+
+// Endpoint is one server of the client, lower priority values are preferred
+type Endpoint struct {
+	addr string
+	priority int
+	tunnel Tunnel
+}
+
+func (e *Endpoint) alive() bool {
+	if checker, ok := e.tunnel.(healthChecker); ok {
+		return checker.Alive()
+	}
+	return true
+}
+
+func (e *Endpoint) String() string {
+	return fmt.Sprintf("%s/%d", e.addr, e.priority)
+}
+
+// parseEndpoints parses a comma separated list of servers, each optionally
+// followed by /priority. Without priority servers are preferred in order
+func parseEndpoints(list string) ([]*Endpoint, error) {
+	var endpoints []*Endpoint
+	for i, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		endpoint := &Endpoint{ addr: item, priority: i }
+		if slash := strings.LastIndex(item, "/"); slash >= 0 {
+			priority, err := strconv.Atoi(strings.TrimSpace(item[slash+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("bad priority of server %s", item)
+			}
+			endpoint.addr = strings.TrimSpace(item[:slash])
+			endpoint.priority = priority
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no server configured")
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].priority < endpoints[j].priority
+	})
+	return endpoints, nil
+}
+
+// FailoverTunnel keeps a tunnel to every server and sends through the most
+// preferred one alive, the health check of each is its keepalive. Packets
+// are received from all of them so nothing in flight is lost on switching.
+// The device keeps its address across servers, so it is configured rather
+// than leased from any of them
+type FailoverTunnel struct {
+	endpoints []*Endpoint
+	active int32
+}
+
+func NewFailoverTunnel(endpoints []*Endpoint) *FailoverTunnel {
+	t := &FailoverTunnel{ endpoints, 0 }
+	Info.Printf("Using %v, standby: %v\n", endpoints[0], endpoints[1:])
+	go t.checkLoop()
+	return t
+}
+
+func (t *FailoverTunnel) Active() *Endpoint {
+	return t.endpoints[atomic.LoadInt32(&t.active)]
+}
+
+func (t *FailoverTunnel) Send(content []byte) {
+	t.Active().tunnel.Send(content)
+}
+
+// payloadMTU is that of the active endpoint, 0 if it is unknown
+func (t *FailoverTunnel) payloadMTU() int {
+	return tunnelPayloadMTU(t.Active().tunnel)
+}
+
+func (t *FailoverTunnel) currentDestination() string {
+	active := t.Active()
+	if destination := tunnelDestination(active.tunnel); destination != "" {
+		return fmt.Sprintf("%v %s", active, destination)
+	}
+	return active.String()
+}
+
+func (t *FailoverTunnel) SetHandler(handler func (Tunnel, []byte)) {
+	for _, endpoint := range t.endpoints {
+		endpoint.tunnel.SetHandler(handler)
+	}
+}
+
+// check switches to the most preferred server alive, if none of them is the
+// active one is kept
+func (t *FailoverTunnel) check() {
+	current := atomic.LoadInt32(&t.active)
+	for i, endpoint := range t.endpoints {
+		if !endpoint.alive() {
+			continue
+		}
+		if int32(i) != current {
+			failovers.Inc()
+			Warning.Printf("Switch from %v to %v\n", t.endpoints[current], endpoint)
+			atomic.StoreInt32(&t.active, int32(i))
+		}
+		return
+	}
+}
+
+func (t *FailoverTunnel) checkLoop() {
+	for range time.Tick(time.Second) {
+		t.check()
+	}
+}
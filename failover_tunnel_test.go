@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+type aliveTunnel struct {
+	fakeTunnel
+	alive bool
+}
+
+func (t *aliveTunnel) Alive() bool {
+	return t.alive
+}
+
+func TestParseEndpoints(t *testing.T) {
+	tests := []struct { list string; expect []string; err bool } {
+		{ "1.2.3.4", []string{ "1.2.3.4/0" }, false },
+		{ "a.example.com, b.example.com", []string{ "a.example.com/0", "b.example.com/1" }, false },
+		{ "a.example.com/20, b.example.com/10, 2001:db8::1/10", []string{ "b.example.com/10", "2001:db8::1/10", "a.example.com/20" }, false },
+		{ "a.example.com/x", nil, true },
+		{ " , ", nil, true },
+	}
+	for _, test := range tests {
+		endpoints, err := parseEndpoints(test.list)
+		if (err != nil) != test.err {
+			t.Errorf("Expect error of %q %v but got %v", test.list, test.err, err)
+			continue
+		}
+		if len(endpoints) != len(test.expect) {
+			t.Errorf("Expect %v from %q but got %v", test.expect, test.list, endpoints)
+			continue
+		}
+		for i, endpoint := range endpoints {
+			if endpoint.String() != test.expect[i] {
+				t.Errorf("Expect %v from %q but got %v", test.expect, test.list, endpoints)
+				break
+			}
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	primary := &aliveTunnel{ alive: true }
+	backup := &aliveTunnel{ alive: true }
+	tunnel := &FailoverTunnel{ []*Endpoint{ { "primary", 0, primary }, { "backup", 1, backup } }, 0 }
+
+	steps := []struct { primary, backup bool; expect *aliveTunnel } {
+		{ true, true, primary },
+		{ false, true, backup },
+		{ false, false, backup },
+		{ true, false, primary },
+	}
+	for i, step := range steps {
+		primary.alive, backup.alive = step.primary, step.backup
+		tunnel.check()
+		tunnel.Send([]byte{ byte(i) })
+		if len(step.expect.sent) == 0 || step.expect.sent[len(step.expect.sent)-1][0] != byte(i) {
+			t.Errorf("Expect step %d sent through %v", i, tunnel.Active())
+		}
+	}
+}
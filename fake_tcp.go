@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/bpf"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tcpFlagFin byte = 0x01
+	tcpFlagSyn byte = 0x02
+	tcpFlagRst byte = 0x04
+	tcpFlagPsh byte = 0x08
+	tcpFlagAck byte = 0x10
+)
+
+const fakeTCPHeaderLength = 20
+
+// fakeTCPMaxFlows bounds the flows of a server, they are created before the
+// segments carried are authenticated
+const fakeTCPMaxFlows = 4096
+
+const (
+	fakeTCPSynSent = iota
+	fakeTCPSynReceived
+	fakeTCPEstablished
+)
+
+var (
+	fakeTCPNotEstablished = NewCounter("faketcp_not_established_total", "Packets dropped by faketcp tunnels before the fake connection is established")
+	fakeTCPFlowsRefused = NewCounter("faketcp_flows_refused_total", "Fake connections refused by faketcp servers for having too many")
+)
+
+type fakeTCPFlow struct {
+	lock sync.Mutex
+	remote *net.TCPAddr
+	localIP net.IP
+	localPort uint16
+	isn uint32
+	seq uint32
+	ack uint32
+	state int
+	lastSeen int64
+}
+
+func (flow *fakeTCPFlow) segment(flags byte, payload []byte) []byte {
+	var options []byte
+	if flags & tcpFlagSyn != 0 {
+		// MSS option, real stacks never send a bare SYN
+		options = []byte{ 2, 4, 0x05, 0xb4 }
+	}
+	headerLength := fakeTCPHeaderLength + len(options)
+	b := make([]byte, headerLength + len(payload))
+	binary.BigEndian.PutUint16(b[0:], flow.localPort)
+	binary.BigEndian.PutUint16(b[2:], uint16(flow.remote.Port))
+	binary.BigEndian.PutUint32(b[4:], flow.seq)
+	if flags & tcpFlagAck != 0 {
+		binary.BigEndian.PutUint32(b[8:], flow.ack)
+	}
+	b[12] = byte(headerLength / 4) << 4
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:], 0xffff)
+	copy(b[fakeTCPHeaderLength:], options)
+	copy(b[headerLength:], payload)
+	binary.BigEndian.PutUint16(b[16:], pseudoHeaderChecksum(flow.localIP, flow.remote.IP, 6, b))
+
+	flow.seq += uint32(len(payload))
+	if flags & tcpFlagSyn != 0 {
+		flow.seq++
+	}
+	return b
+}
+
+func (flow *fakeTCPFlow) reset() {
+	flow.isn = rand.Uint32()
+	flow.seq = flow.isn
+	flow.state = fakeTCPSynSent
+}
+
+// FakeTCP dresses packets of a raw tunnel up as a TCP flow so that stateful
+// firewalls and NATs let them through. There is no retransmission nor
+// ordering, sequence and acknowledgement numbers only follow the bytes sent
+type FakeTCP struct {
+	localPort uint16
+	client *fakeTCPFlow
+	lock sync.RWMutex
+	flows map[string]*fakeTCPFlow
+	sendSegment func(addr net.Addr, segment []byte)
+	// timeout is how long the server remembers an idle flow
+	timeout time.Duration
+}
+
+func newFakeTCP(localPort uint16, sendSegment func(net.Addr, []byte)) *FakeTCP {
+	return &FakeTCP{
+		localPort: localPort,
+		flows: make(map[string]*fakeTCPFlow),
+		sendSegment: sendSegment,
+	}
+}
+
+// NewFakeTCPClient starts the fake connection from local to remote, SYN is
+// repeated every second until it is established
+func NewFakeTCPClient(local net.IP, localPort uint16, remote *net.TCPAddr, sendSegment func(net.Addr, []byte)) *FakeTCP {
+	f := newFakeTCP(localPort, sendSegment)
+	f.client = &fakeTCPFlow{ remote: remote, localIP: local, localPort: localPort }
+	f.client.reset()
+	go f.synLoop()
+	return f
+}
+
+func NewFakeTCPServer(port uint16, timeout time.Duration, sendSegment func(net.Addr, []byte)) *FakeTCP {
+	f := newFakeTCP(port, sendSegment)
+	f.timeout = timeout
+	go f.expireLoop()
+	return f
+}
+
+func (f *FakeTCP) expireLoop() {
+	for range time.Tick(time.Minute) {
+		deadline := time.Now().UnixNano() - f.timeout.Nanoseconds()
+		f.lock.Lock()
+		for key, flow := range f.flows {
+			if atomic.LoadInt64(&flow.lastSeen) < deadline {
+				delete(f.flows, key)
+			}
+		}
+		f.lock.Unlock()
+	}
+}
+
+func (f *FakeTCP) synLoop() {
+	flow := f.client
+	for {
+		flow.lock.Lock()
+		if flow.state != fakeTCPEstablished {
+			flow.reset()
+			f.sendSegment(nil, flow.segment(tcpFlagSyn, nil))
+		}
+		flow.lock.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// Restart connects again from local to remote, only clients restart
+func (f *FakeTCP) Restart(local, remote net.IP) {
+	flow := f.client
+	if flow == nil {
+		return
+	}
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	flow.remote = &net.TCPAddr{ IP: remote, Port: flow.remote.Port }
+	flow.localIP = local
+	flow.reset()
+	Info.Printf("fake connection to %v restarted\n", flow.remote)
+}
+
+func (f *FakeTCP) Overhead() int {
+	return fakeTCPHeaderLength
+}
+
+// Filter only lets segments to the local port into the raw socket
+func (f *FakeTCP) Filter() []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadIndirect{ Off: 2, Size: 2 },
+		bpf.JumpIf{ Cond: bpf.JumpEqual, Val: uint32(f.localPort), SkipFalse: 1 },
+		bpf.RetConstant{ Val: 0xffff },
+		bpf.RetConstant{ Val: 0 },
+	}
+}
+
+// Wrap prepends the TCP header of the flow to addr, it returns nil if the
+// flow is not established yet
+func (f *FakeTCP) Wrap(addr net.Addr, payload []byte) ([]byte, net.Addr) {
+	flow := f.client
+	if flow == nil {
+		f.lock.RLock()
+		flow = f.flows[addr.String()]
+		f.lock.RUnlock()
+		if flow == nil {
+			fakeTCPNotEstablished.Inc()
+			return nil, nil
+		}
+		addr = &net.IPAddr{ IP: flow.remote.IP }
+	}
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if flow.state != fakeTCPEstablished {
+		fakeTCPNotEstablished.Inc()
+		Debug.Printf("fake connection to %v not established, skip %d bytes\n", flow.remote, len(payload))
+		return nil, nil
+	}
+	return flow.segment(tcpFlagPsh | tcpFlagAck, payload), addr
+}
+
+// Unwrap handles a segment sent from remote to local, it returns the peer and
+// the payload carried, nil if the segment is not for us or carries nothing
+func (f *FakeTCP) Unwrap(local, remote net.IP, segment []byte) (net.Addr, []byte) {
+	if len(segment) < fakeTCPHeaderLength || binary.BigEndian.Uint16(segment[2:]) != f.localPort {
+		return nil, nil
+	}
+	headerLength := int(segment[12] >> 4) * 4
+	if headerLength < fakeTCPHeaderLength || len(segment) < headerLength {
+		return nil, nil
+	}
+	remotePort := int(binary.BigEndian.Uint16(segment[0:]))
+	seq := binary.BigEndian.Uint32(segment[4:])
+	ack := binary.BigEndian.Uint32(segment[8:])
+	flags := segment[13]
+	payload := segment[headerLength:]
+
+	if flags & tcpFlagRst != 0 {
+		Debug.Printf("ignore RST from %v:%d\n", remote, remotePort)
+		return nil, nil
+	}
+
+	flow := f.client
+	if flow == nil {
+		if flow = f.serverFlow(local, remote, remotePort, flags, len(payload)); flow == nil {
+			return nil, nil
+		}
+	}
+	atomic.StoreInt64(&flow.lastSeen, time.Now().UnixNano())
+
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if f.client != nil && remotePort != flow.remote.Port {
+		return nil, nil
+	}
+	switch {
+	case flags & tcpFlagSyn != 0 && flags & tcpFlagAck == 0:
+		if f.client != nil {
+			return nil, nil
+		}
+		// SYN, possibly again after the peer restarted
+		flow.isn = rand.Uint32()
+		flow.seq = flow.isn
+		flow.ack = seq + 1
+		flow.state = fakeTCPSynReceived
+		f.sendSegment(&net.IPAddr{ IP: flow.remote.IP }, flow.segment(tcpFlagSyn | tcpFlagAck, nil))
+		return nil, nil
+	case flags & tcpFlagSyn != 0:
+		// SYN-ACK
+		if flow.state != fakeTCPSynSent || ack != flow.isn + 1 {
+			return nil, nil
+		}
+		flow.ack = seq + 1
+		flow.state = fakeTCPEstablished
+		Info.Printf("fake connection to %v established\n", flow.remote)
+		f.sendSegment(nil, flow.segment(tcpFlagAck, nil))
+		return nil, nil
+	}
+
+	if flow.state == fakeTCPSynReceived {
+		flow.state = fakeTCPEstablished
+		Info.Printf("fake connection from %v established\n", flow.remote)
+	} else if flow.state == fakeTCPSynSent && len(payload) > 0 {
+		// the server still knows us, e.g. our SYN-ACK got lost
+		flow.ack = seq
+		flow.state = fakeTCPEstablished
+	}
+	if end := seq + uint32(len(payload)); int32(end - flow.ack) > 0 {
+		flow.ack = end
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	return flow.remote, payload
+}
+
+func (f *FakeTCP) serverFlow(local, remote net.IP, remotePort int, flags byte, payloadLength int) *fakeTCPFlow {
+	key := net.JoinHostPort(remote.String(), fmt.Sprint(remotePort))
+	f.lock.RLock()
+	flow, ok := f.flows[key]
+	f.lock.RUnlock()
+	if ok {
+		return flow
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if flow, ok = f.flows[key]; ok {
+		return flow
+	}
+	if flags & tcpFlagSyn == 0 && payloadLength == 0 {
+		// a bare ACK does not deserve a flow
+		return nil
+	}
+	if len(f.flows) >= fakeTCPMaxFlows {
+		fakeTCPFlowsRefused.Inc()
+		Debug.Printf("Too many fake connections, ignore %s\n", key)
+		return nil
+	}
+	flow = &fakeTCPFlow{
+		remote: &net.TCPAddr{ IP: copyIP(remote), Port: remotePort },
+		localIP: copyIP(local),
+		localPort: f.localPort,
+	}
+	flow.reset()
+	if flags & tcpFlagSyn == 0 {
+		// data of a flow we forgot, e.g. after restart, pick it up as it is
+		flow.state = fakeTCPEstablished
+	}
+	f.flows[key] = flow
+	return flow
+}
+
+func FakeTCPConnect(addr string, port uint16, localPort uint16, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newRawTunnel(6, nil, ipAddr, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	if localPort == 0 {
+		localPort = uint16(20000 + rand.Intn(40000))
+	}
+	local := tunnel.getConn().LocalAddr().(*net.IPAddr).IP
+	Warning.Printf("Drop RST sent by kernel, e.g. iptables -I OUTPUT -p tcp --sport %d --tcp-flags RST RST -j DROP\n", localPort)
+	tunnel.startDisguised(NewFakeTCPClient(local, localPort, &net.TCPAddr{ IP: ipAddr.IP, Port: int(port) }, tunnel.sendSegment), opts)
+	return tunnel, nil
+}
+
+func FakeTCPListen(addr string, port uint16, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newRawTunnel(6, ipAddr, nil, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	Warning.Printf("Drop RST sent by kernel, e.g. iptables -I OUTPUT -p tcp --sport %d --tcp-flags RST RST -j DROP\n", port)
+	tunnel.startDisguised(NewFakeTCPServer(port, opts.getSessionTimeout(), tunnel.sendSegment), opts)
+	return tunnel, nil
+}
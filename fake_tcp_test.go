@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+type fakeTCPSegment struct {
+	addr net.Addr
+	segment []byte
+}
+
+func TestFakeTCPHandshake(t *testing.T) {
+	clientIP := net.IPv4(10, 0, 0, 1).To4()
+	serverIP := net.IPv4(10, 0, 0, 2).To4()
+	toServer := make(chan fakeTCPSegment, 16)
+	toClient := make(chan fakeTCPSegment, 16)
+	server := NewFakeTCPServer(8888, defaultSessionTimeout, func(addr net.Addr, segment []byte) { toClient <- fakeTCPSegment{ addr, segment } })
+	client := NewFakeTCPClient(clientIP, 23456, &net.TCPAddr{ IP: serverIP, Port: 8888 }, func(addr net.Addr, segment []byte) { toServer <- fakeTCPSegment{ addr, segment } })
+
+	syn := <-toServer
+	if syn.segment[13] != tcpFlagSyn {
+		t.Errorf("Expect SYN but got flags %x", syn.segment[13])
+	}
+	if pseudoHeaderChecksum(clientIP, serverIP, 6, syn.segment) != 0 {
+		t.Errorf("Expect valid checksum of SYN")
+	}
+	if from, payload := server.Unwrap(serverIP, clientIP, syn.segment); from != nil || payload != nil {
+		t.Errorf("Expect nothing from SYN but got %v", payload)
+	}
+	synAck := <-toClient
+	if synAck.segment[13] != tcpFlagSyn | tcpFlagAck {
+		t.Errorf("Expect SYN-ACK but got flags %x", synAck.segment[13])
+	}
+	if binary.BigEndian.Uint16(synAck.segment[2:]) != 23456 {
+		t.Errorf("Expect SYN-ACK to port 23456 but got %d", binary.BigEndian.Uint16(synAck.segment[2:]))
+	}
+	client.Unwrap(clientIP, serverIP, synAck.segment)
+	ack := <-toServer
+	if ack.segment[13] != tcpFlagAck {
+		t.Errorf("Expect ACK but got flags %x", ack.segment[13])
+	}
+	server.Unwrap(serverIP, clientIP, ack.segment)
+
+	wrapped, _ := client.Wrap(nil, []byte("hello"))
+	if wrapped == nil {
+		t.Fatalf("Expect established client")
+	}
+	from, payload := server.Unwrap(serverIP, clientIP, wrapped)
+	if string(payload) != "hello" || from.(*net.TCPAddr).Port != 23456 {
+		t.Errorf("Expect hello from port 23456 but got %q from %v", payload, from)
+	}
+
+	wrapped, addr := server.Wrap(from, []byte("world"))
+	if wrapped == nil || !addr.(*net.IPAddr).IP.Equal(clientIP) {
+		t.Fatalf("Expect segment to %v but got %v", clientIP, addr)
+	}
+	if _, payload = client.Unwrap(clientIP, serverIP, wrapped); string(payload) != "world" {
+		t.Errorf("Expect world but got %q", payload)
+	}
+}
+
+func TestFakeTCPIgnoreStray(t *testing.T) {
+	server := NewFakeTCPServer(8888, defaultSessionTimeout, func(net.Addr, []byte) {})
+	stray := make([]byte, fakeTCPHeaderLength)
+	binary.BigEndian.PutUint16(stray[0:], 40000)
+	binary.BigEndian.PutUint16(stray[2:], 8888)
+	stray[12] = 5 << 4
+	stray[13] = tcpFlagAck
+	server.Unwrap(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3), stray)
+	if len(server.flows) != 0 {
+		t.Errorf("Expect bare ACK ignored but got %d flows", len(server.flows))
+	}
+}
+
+func TestFakeTCPMaxFlows(t *testing.T) {
+	server := NewFakeTCPServer(8888, defaultSessionTimeout, func(net.Addr, []byte) {})
+	segment := make([]byte, fakeTCPHeaderLength + 4)
+	binary.BigEndian.PutUint16(segment[2:], 8888)
+	segment[12] = 5 << 4
+	segment[13] = tcpFlagPsh | tcpFlagAck
+	for port := 1; port <= fakeTCPMaxFlows + 1; port++ {
+		binary.BigEndian.PutUint16(segment[0:], uint16(port))
+		server.Unwrap(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3), segment)
+	}
+	if len(server.flows) != fakeTCPMaxFlows {
+		t.Errorf("Expect %d flows at most but got %d", fakeTCPMaxFlows, len(server.flows))
+	}
+	// flows already known keep working
+	binary.BigEndian.PutUint16(segment[0:], 1)
+	if _, payload := server.Unwrap(net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3), segment); len(payload) != 4 {
+		t.Errorf("Expect payload of a known flow but got %d bytes", len(payload))
+	}
+}
+
+func TestFakeTCPFilter(t *testing.T) {
+	filter, err := assembleFilter(false, newFakeTCP(8888, nil).Filter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	instructions := make([]bpf.Instruction, len(filter))
+	for i, raw := range filter {
+		instructions[i] = raw.Disassemble()
+	}
+	vm, err := bpf.NewVM(instructions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ port uint16; accept bool }{ { 8888, true }, { 8889, false } } {
+		packet := make([]byte, 20 + fakeTCPHeaderLength)
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[22:], c.port)
+		n, err := vm.Run(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (n > 0) != c.accept {
+			t.Errorf("Expect port %d accepted %v but got %d", c.port, c.accept, n)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A FEC datagram starts with fecMark, the id of its group, its index in the
+// group and, for parity shards, how many data shards the group has. It is
+// sealed as a whole like any packet, so that the header is authenticated
+// before the shard is kept
+const (
+	fecMark byte = 0xfe
+	fecHeaderLength = 7
+	fecParityFlag = 0x80
+	fecMaxData = 128
+	fecMaxParity = 64
+	// fecGroupsKept is how many groups of a peer are waited for their shards
+	fecGroupsKept = 64
+	// fecMaxPeers bounds the decoding state of a listening tunnel
+	fecMaxPeers = 4096
+)
+
+// fecFlushDelay is how long a group short of data shards waits before its
+// parity shards are sent anyway
+var fecFlushDelay = 20 * time.Millisecond
+
+var (
+	fecParitySent = NewCounter("fec_parity_sent_total", "FEC parity shards sent")
+	fecRecovered = NewCounter("fec_recovered_total", "Lost datagrams recovered by FEC")
+	fecUnrecoverable = NewCounter("fec_unrecoverable_total", "FEC groups given up with data shards missing")
+)
+
+// parseFEC parses data,parity group sizes
+func parseFEC(value string) (int, int, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("bad fec %q, expect data,parity", value)
+	}
+	data, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || data < 1 || data > fecMaxData {
+		return 0, 0, fmt.Errorf("bad fec data shards %q, expect 1 to %d", fields[0], fecMaxData)
+	}
+	parity, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil || parity < 1 || parity > fecMaxParity {
+		return 0, 0, fmt.Errorf("bad fec parity shards %q, expect 1 to %d", fields[1], fecMaxParity)
+	}
+	return data, parity, nil
+}
+
+func fecDatagram(group uint32, index, count byte, payload []byte) []byte {
+	datagram := make([]byte, fecHeaderLength + len(payload))
+	datagram[0] = fecMark
+	binary.BigEndian.PutUint32(datagram[1:], group)
+	datagram[5], datagram[6] = index, count
+	copy(datagram[fecHeaderLength:], payload)
+	return datagram
+}
+
+// fecShard prefixes payload with its length so that the padding added for
+// coding is stripped after recovery
+func fecShard(payload []byte, size int) []byte {
+	shard := make([]byte, size)
+	binary.BigEndian.PutUint16(shard, uint16(len(payload)))
+	copy(shard[2:], payload)
+	return shard
+}
+
+func addrKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// fecEncodeGroup is the group being sent to a destination, ids count up per
+// destination so that the receiver can tell how far behind a group is
+type fecEncodeGroup struct {
+	id uint32
+	addr net.Addr
+	seal Obscurer
+	payloads [][]byte
+	started time.Time
+}
+
+// FECEncoder sends data shards as they come and the parity shards of every
+// group of them right after its last one, groups are kept per destination.
+// It is only used by the sending goroutine of a tunnel
+type FECEncoder struct {
+	data int
+	parity int
+	groups map[string]*fecEncodeGroup
+}
+
+func NewFECEncoder(data, parity int) *FECEncoder {
+	return &FECEncoder{ data, parity, make(map[string]*fecEncodeGroup) }
+}
+
+// Overhead is what FEC adds to every datagram of the largest size
+func (e *FECEncoder) Overhead() int {
+	if e == nil {
+		return 0
+	}
+	return fecHeaderLength + 2
+}
+
+// Encode appends the datagrams to send for packet to batch, they are left to
+// be sealed with the sealer of packet. A packet sealed already, e.g. a control
+// message, is appended as it is
+func (e *FECEncoder) Encode(batch []outPacket, packet outPacket) []outPacket {
+	if e == nil || packet.seal == nil {
+		return append(batch, packet)
+	}
+	key := addrKey(packet.addr)
+	g, ok := e.groups[key]
+	if !ok {
+		g = &fecEncodeGroup{ addr: packet.addr }
+		e.groups[key] = g
+	}
+	if len(g.payloads) == 0 {
+		g.started = time.Now()
+	}
+	batch = append(batch, outPacket{ fecDatagram(g.id, byte(len(g.payloads)), 0, packet.data), packet.addr, packet.seal })
+	g.payloads = append(g.payloads, packet.data)
+	g.seal = packet.seal
+	if len(g.payloads) == e.data {
+		batch = e.close(batch, g)
+	}
+	return batch
+}
+
+// Flush appends the parity shards of the groups waiting longer than
+// fecFlushDelay, destinations idle for the session timeout are forgotten
+func (e *FECEncoder) Flush(batch []outPacket, now time.Time) []outPacket {
+	if e == nil {
+		return batch
+	}
+	for key, g := range e.groups {
+		if len(g.payloads) > 0 && now.Sub(g.started) >= fecFlushDelay {
+			batch = e.close(batch, g)
+		} else if len(g.payloads) == 0 && now.Sub(g.started) > defaultSessionTimeout {
+			delete(e.groups, key)
+		}
+	}
+	return batch
+}
+
+func (e *FECEncoder) close(batch []outPacket, g *fecEncodeGroup) []outPacket {
+	size := 0
+	for _, payload := range g.payloads {
+		if len(payload) > size {
+			size = len(payload)
+		}
+	}
+	shards := make([][]byte, len(g.payloads))
+	for j, payload := range g.payloads {
+		shards[j] = fecShard(payload, 2 + size)
+	}
+	for i, parity := range rsEncode(shards, e.parity) {
+		batch = append(batch, outPacket{ fecDatagram(g.id, byte(fecParityFlag | i), byte(len(shards)), parity), g.addr, g.seal })
+	}
+	fecParitySent.Add(e.parity)
+	g.id++
+	g.payloads = nil
+	return batch
+}
+
+// fecDecodeGroup holds the shards of a group by index until it is recovered
+type fecDecodeGroup struct {
+	data map[int][]byte
+	parity map[int][]byte
+	count int
+	done bool
+}
+
+// missing tells how many data shards are yet to come, the count is unknown
+// until a parity shard arrives
+func (g *fecDecodeGroup) missing() int {
+	missing := g.count
+	for index := range g.data {
+		if index < g.count {
+			missing--
+		}
+	}
+	return missing
+}
+
+// recover reconstructs the missing data shards and returns their payloads
+func (g *fecDecodeGroup) recover() [][]byte {
+	if len(g.parity) < g.missing() {
+		return nil
+	}
+	size := 0
+	parity := make([][]byte, fecMaxParity)
+	for i, shard := range g.parity {
+		if size != 0 && len(shard) != size {
+			return nil
+		}
+		parity[i] = shard
+		size = len(shard)
+	}
+	data := make([][]byte, g.count)
+	for j := range data {
+		if shard, ok := g.data[j]; ok {
+			if len(shard) > size {
+				return nil
+			}
+			data[j] = make([]byte, size)
+			copy(data[j], shard)
+		}
+	}
+	if err := rsReconstruct(data, parity); err != nil {
+		Error.Printf("Failed to recover FEC group: %v\n", err)
+		return nil
+	}
+	// a group which failed to recover is tried again as more shards come
+	g.done = true
+	var payloads [][]byte
+	for j, shard := range data {
+		if _, ok := g.data[j]; ok {
+			continue
+		}
+		// late arrivals of the shard are dropped as duplicates
+		g.data[j] = shard
+		if length := int(binary.BigEndian.Uint16(shard)); length <= len(shard) - 2 {
+			payloads = append(payloads, shard[2:2+length])
+			fecRecovered.Inc()
+		}
+	}
+	return payloads
+}
+
+type fecPeer struct {
+	latest uint32
+	groups map[uint32]*fecDecodeGroup
+	lastSeen int64
+}
+
+// group returns the group of id, groups left behind the window are given
+// up. A group far behind means the peer started over, e.g. it was restarted
+func (p *fecPeer) group(id uint32) *fecDecodeGroup {
+	if len(p.groups) == 0 || p.latest - id >= fecGroupsKept && int32(p.latest - id) > 0 {
+		p.groups = make(map[uint32]*fecDecodeGroup)
+		p.latest = id
+	} else if int32(id - p.latest) > 0 {
+		p.latest = id
+		for old, g := range p.groups {
+			if p.latest - old >= fecGroupsKept {
+				if !g.done && g.missing() > 0 {
+					fecUnrecoverable.Inc()
+				}
+				delete(p.groups, old)
+			}
+		}
+	}
+	g, ok := p.groups[id]
+	if !ok {
+		g = &fecDecodeGroup{ make(map[int][]byte), make(map[int][]byte), 0, false }
+		p.groups[id] = g
+	}
+	return g
+}
+
+// FECDecoder hands data shards over as they come and recovers the lost ones
+// once enough shards of their group arrived, groups are kept per peer
+type FECDecoder struct {
+	lock sync.Mutex
+	peers map[string]*fecPeer
+}
+
+func NewFECDecoder() *FECDecoder {
+	return &FECDecoder{ sync.Mutex{}, make(map[string]*fecPeer) }
+}
+
+func (d *FECDecoder) peer(key string, now int64) *fecPeer {
+	p, ok := d.peers[key]
+	if !ok {
+		if len(d.peers) >= fecMaxPeers {
+			for k, old := range d.peers {
+				if now - old.lastSeen > defaultSessionTimeout.Nanoseconds() {
+					delete(d.peers, k)
+				}
+			}
+			if len(d.peers) >= fecMaxPeers {
+				return nil
+			}
+		}
+		p = &fecPeer{ groups: make(map[uint32]*fecDecodeGroup) }
+		d.peers[key] = p
+	}
+	p.lastSeen = now
+	return p
+}
+
+// Decode returns the packets carried or recovered by datagram from the peer
+// of key, which is restored already. Packets not sent as FEC datagrams, e.g.
+// control messages, are returned as they are and without state of the peer
+// only the payload of datagram is returned
+func (d *FECDecoder) Decode(key string, datagram []byte) [][]byte {
+	if d == nil || len(datagram) == 0 || datagram[0] != fecMark {
+		return [][]byte{ datagram }
+	}
+	if len(datagram) < fecHeaderLength {
+		return nil
+	}
+	id := binary.BigEndian.Uint32(datagram[1:])
+	index, count := int(datagram[5]), int(datagram[6])
+	payload := datagram[fecHeaderLength:]
+	parity := index & fecParityFlag != 0
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var g *fecDecodeGroup
+	if p := d.peer(key, time.Now().UnixNano()); p != nil {
+		g = p.group(id)
+	}
+	if g == nil {
+		if parity {
+			return nil
+		}
+		return [][]byte{ payload }
+	}
+
+	var ret [][]byte
+	if !parity {
+		if _, ok := g.data[index]; ok {
+			// recovered already or duplicated
+			return nil
+		}
+		g.data[index] = fecShard(payload, 2 + len(payload))
+		ret = append(ret, payload)
+	} else {
+		index &^= fecParityFlag
+		if _, ok := g.parity[index]; ok || index >= fecMaxParity || count == 0 || (g.count != 0 && g.count != count) {
+			return nil
+		}
+		g.count = count
+		g.parity[index] = copyBytes(payload)
+	}
+	if !g.done && g.count > 0 {
+		if missing := g.missing(); missing == 0 {
+			g.done = true
+		} else if missing > 0 {
+			ret = append(ret, g.recover()...)
+		}
+	}
+	return ret
+}
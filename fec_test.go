@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseFEC(t *testing.T) {
+	tests := []struct { value string; data, parity int; err bool } {
+		{ "10,3", 10, 3, false },
+		{ " 4 , 2 ", 4, 2, false },
+		{ "10", 0, 0, true },
+		{ "0,3", 0, 0, true },
+		{ "129,3", 0, 0, true },
+		{ "10,x", 0, 0, true },
+	}
+	for _, test := range tests {
+		data, parity, err := parseFEC(test.value)
+		if (err != nil) != test.err || data != test.data || parity != test.parity {
+			t.Errorf("Expect %d,%d %v from %q but got %d,%d %v", test.data, test.parity, test.err, test.value, data, parity, err)
+		}
+	}
+}
+
+func TestFEC(t *testing.T) {
+	encoder := NewFECEncoder(4, 2)
+	decoder := NewFECDecoder()
+	var packets [][]byte
+	for i := 0; i < 7; i++ {
+		packets = append(packets, bytes.Repeat([]byte{ byte(i) }, 10 + i * 30))
+	}
+
+	var batch []outPacket
+	for _, packet := range packets {
+		batch = encoder.Encode(batch, outPacket{ packet, nil, xorObscurer{} })
+	}
+	if len(batch) != 4 + 2 + 3 {
+		t.Fatalf("Expect parity after 4 data shards but got %d datagrams", len(batch))
+	}
+	batch = encoder.Flush(batch, time.Now().Add(time.Second))
+	if len(batch) != 4 + 2 + 3 + 2 {
+		t.Fatalf("Expect parity of the short group flushed but got %d datagrams", len(batch))
+	}
+
+	// lose 2 of the first group and 1 of the second, with the last parity of
+	// the first group arriving after the other group started
+	lost := map[int]bool{ 0: true, 2: true, 7: true }
+	order := []int{ 0, 1, 2, 3, 4, 6, 7, 8, 9, 10, 5, 1 }
+	received := make(map[string]bool)
+	for _, i := range order {
+		if lost[i] {
+			continue
+		}
+		for _, datagram := range decoder.Decode("peer", batch[i].data) {
+			if received[string(datagram)] {
+				t.Errorf("Expect %x handed over once", datagram[:1])
+			}
+			received[string(datagram)] = true
+		}
+	}
+	for i, packet := range packets {
+		if !received[string(packet)] {
+			t.Errorf("Expect packet %d recovered", i)
+		}
+	}
+}
+
+func TestFECRecoverFailed(t *testing.T) {
+	// a data shard longer than the parity cannot be recovered with
+	g := &fecDecodeGroup{ map[int][]byte{ 0: make([]byte, 20) }, map[int][]byte{ 0: make([]byte, 10) }, 2, false }
+	if payloads := g.recover(); payloads != nil || g.done {
+		t.Errorf("Expect group left to recover later but got %d payloads, done %v", len(payloads), g.done)
+	}
+}
+
+func TestUDPFEC(t *testing.T) {
+	opts := &TunnelOptions{ fecData: 4, fecParity: 1 }
+	server, err := UDPListen("127.0.0.1", 11117, opts)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, content []byte) { session.Send(content) })
+	client, err := UDPConnect("127.0.0.1", 11117, opts)
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	replies := make(chan []byte, 16)
+	client.SetHandler(func(_ Tunnel, content []byte) { replies <- copyBytes(content) })
+
+	for i := 0; i < 6; i++ {
+		client.Send([]byte{ 0x45, byte(i) })
+	}
+	for i := 0; i < 6; i++ {
+		select {
+		case reply := <-replies:
+			if !bytes.Equal(reply, []byte{ 0x45, byte(i) }) {
+				t.Errorf("Expect reply %d but got %x", i, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expect reply %d", i)
+		}
+	}
+}
+
+func TestUDPFECSpoofedShards(t *testing.T) {
+	obscurer, _ := NewAEADObscurer("secret")
+	opts := &TunnelOptions{ fecData: 4, fecParity: 1, obscurer: obscurer }
+	server, err := UDPListen("127.0.0.1", 11124, opts)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, content []byte) { session.Send(content) })
+	client, err := UDPConnect("127.0.0.1", 11124, opts)
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	replies := make(chan []byte, 16)
+	client.SetHandler(func(_ Tunnel, content []byte) { replies <- copyBytes(content) })
+	expectReply := func(i int) {
+		select {
+		case reply := <-replies:
+			if !bytes.Equal(reply, []byte{ 0x45, byte(i) }) {
+				t.Errorf("Expect reply %d but got %x", i, reply)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expect reply %d", i)
+		}
+	}
+
+	client.Send([]byte{ 0x45, 0 })
+	expectReply(0)
+	// the first group is flushed, the next one is taken by forged shards
+	time.Sleep(4 * fecFlushDelay)
+	clientAddr := client.(*UDPTunnelImpl).getConn().LocalAddr().(*net.UDPAddr)
+	for index := 0; index < 4; index++ {
+		server.(*UDPTunnelImpl).received(clientAddr, fecDatagram(1, byte(index), 0, []byte{ 0x45, 0xff }))
+	}
+	server.(*UDPTunnelImpl).received(clientAddr, fecDatagram(1, fecParityFlag, 9, make([]byte, 4)))
+
+	for i := 1; i <= 4; i++ {
+		client.Send([]byte{ 0x45, byte(i) })
+	}
+	for i := 1; i <= 4; i++ {
+		expectReply(i)
+	}
+}
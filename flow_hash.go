@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// FNV-1a, cheap enough to run on every packet written to the device
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32 = 16777619
+)
+
+func fnvAdd(hash uint32, data []byte) uint32 {
+	for _, b := range data {
+		hash ^= uint32(b)
+		hash *= fnvPrime32
+	}
+	return hash
+}
+
+// flowHash hashes the addresses, protocol and ports of an IPv4 or IPv6
+// packet so that every packet of a flow gets the same hash. Fragments other
+// than the first carry no ports, so ports are left out for all fragments
+func flowHash(packet []byte) uint32 {
+	hash := uint32(fnvOffset32)
+	var protocol byte
+	var transport []byte
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		hash = fnvAdd(hash, packet[12:20])
+		protocol = packet[9]
+		// a bad header length leaves the packet hashed by its addresses
+		headerLength := int(packet[0] & 0x0f) * 4
+		if binary.BigEndian.Uint16(packet[6:]) & 0x3fff == 0 && headerLength >= 20 && headerLength <= len(packet) {
+			transport = packet[headerLength:]
+		}
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		hash = fnvAdd(hash, packet[8:40])
+		protocol = packet[6]
+		transport = packet[40:]
+	} else {
+		return fnvAdd(hash, packet)
+	}
+	hash = fnvAdd(hash, []byte{ protocol })
+	switch protocol {
+	case 6, 17, 132:
+		if len(transport) >= 4 {
+			hash = fnvAdd(hash, transport[:4])
+		}
+	}
+	return hash
+}
+
+// frameFlowHash hashes the packet an Ethernet frame carries, frames of other
+// types are hashed by their addresses
+func frameFlowHash(frame []byte) uint32 {
+	if len(frame) < etherHeaderLength {
+		return flowHash(frame)
+	}
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeIPv4, etherTypeIPv6:
+		return flowHash(frame[etherHeaderLength:])
+	}
+	return fnvAdd(fnvOffset32, frame[:12])
+}
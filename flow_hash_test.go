@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFlowHash(t *testing.T) {
+	syn := tcpSegment(false, true, false, 1460)
+	ack := tcpSegment(false, false, true, 0)
+	if flowHash(syn) != flowHash(ack) {
+		t.Errorf("Expect packets of a flow hashed the same\n")
+	}
+	syn6 := tcpSegment(true, true, false, 1440)
+	ack6 := tcpSegment(true, false, true, 0)
+	if flowHash(syn6) != flowHash(ack6) {
+		t.Errorf("Expect IPv6 packets of a flow hashed the same\n")
+	}
+
+	// flows apart by source port spread over the queues
+	const queues = 4
+	used := make(map[uint32]bool)
+	for port := 40000; port < 40064; port++ {
+		packet := copyBytes(syn)
+		binary.BigEndian.PutUint16(packet[20:], uint16(port))
+		used[flowHash(packet) % queues] = true
+	}
+	if len(used) != queues {
+		t.Errorf("Expect flows spread over %d queues but got %d\n", queues, len(used))
+	}
+
+	// fragments of a flow leave the ports out
+	fragment := copyBytes(syn)
+	binary.BigEndian.PutUint16(fragment[6:], 0x2000)
+	other := copyBytes(fragment)
+	binary.BigEndian.PutUint16(other[20:], 50000)
+	if flowHash(fragment) != flowHash(other) {
+		t.Errorf("Expect fragments hashed without ports\n")
+	}
+
+	frame := ethernetFrame(broadcastMAC, broadcastMAC, etherTypeIPv4, syn)
+	if frameFlowHash(frame) != flowHash(syn) {
+		t.Errorf("Expect frame hashed by the packet it carries\n")
+	}
+}
+
+func TestFlowHashMalformed(t *testing.T) {
+	syn := tcpSegment(false, true, false, 1460)
+	bogusIHL := copyBytes(syn[:24])
+	bogusIHL[0] = 0x4f
+	shortIHL := copyBytes(syn)
+	shortIHL[0] = 0x41
+	other := copyBytes(bogusIHL)
+	binary.BigEndian.PutUint16(other[20:], 50000)
+	if flowHash(bogusIHL) != flowHash(other) {
+		t.Errorf("Expect packet with a bad header length hashed by its addresses\n")
+	}
+	for _, packet := range [][]byte{ shortIHL, syn[:20], syn[:21], tcpSegment(true, true, false, 1440)[:42], { 0x60 }, nil } {
+		flowHash(packet)
+		frameFlowHash(ethernetFrame(broadcastMAC, broadcastMAC, etherTypeIPv4, packet))
+	}
+}
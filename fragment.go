@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fragmentMark leads the fragments of a packet too large for one tunnel
+// packet, followed by the packet id, the fragment index and the fragment count
+const (
+	fragmentMark byte = 0xf0
+	fragmentHeaderLength = 7
+	// fragmentMaxPending bounds the packets being reassembled by a tunnel
+	fragmentMaxPending = 1024
+)
+
+var fragmentTimeout = 5 * time.Second
+
+var fragmentIDs uint32
+
+var (
+	tunnelFragmented = NewCounter("tunnel_fragmented_total", "Packets split into fragments to fit into the tunnel")
+	tunnelReassembled = NewCounter("tunnel_reassembled_total", "Packets reassembled from their fragments")
+	tunnelFragmentTimeouts = NewCounter("tunnel_fragment_timeouts_total", "Packets given up for missing fragments")
+)
+
+// fragmentToFit returns packet alone if it is not larger than size, otherwise
+// its fragments each of which is not larger than size
+func fragmentToFit(packet []byte, size int) [][]byte {
+	if len(packet) <= size {
+		return [][]byte{ packet }
+	}
+	chunk := size - fragmentHeaderLength
+	if chunk <= 0 || (len(packet) + chunk - 1) / chunk > 255 {
+		Error.Printf("Packet of %d bytes can not be fragmented to %d bytes\n", len(packet), size)
+		return nil
+	}
+	tunnelFragmented.Inc()
+	id := atomic.AddUint32(&fragmentIDs, 1)
+	count := (len(packet) + chunk - 1) / chunk
+	fragments := make([][]byte, 0, count)
+	for index := 0; index < count; index++ {
+		end := (index + 1) * chunk
+		if end > len(packet) {
+			end = len(packet)
+		}
+		part := packet[index * chunk:end]
+		fragment := make([]byte, fragmentHeaderLength + len(part))
+		fragment[0] = fragmentMark
+		binary.BigEndian.PutUint32(fragment[1:], id)
+		fragment[5], fragment[6] = byte(index), byte(count)
+		copy(fragment[fragmentHeaderLength:], part)
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+type partialPacket struct {
+	parts [][]byte
+	got int
+	started int64
+}
+
+// Reassembler joins the fragments of packets from every peer of a tunnel
+type Reassembler struct {
+	lock sync.Mutex
+	pending map[string]*partialPacket
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{ sync.Mutex{}, make(map[string]*partialPacket) }
+}
+
+func (r *Reassembler) expire(now int64) {
+	for key, p := range r.pending {
+		if now - p.started > fragmentTimeout.Nanoseconds() {
+			delete(r.pending, key)
+			tunnelFragmentTimeouts.Inc()
+		}
+	}
+}
+
+// Reassemble returns packet from peer as it is unless it is a fragment, the
+// whole packet is returned with its last fragment
+func (r *Reassembler) Reassemble(peer string, packet []byte) []byte {
+	if len(packet) == 0 || packet[0] != fragmentMark {
+		return packet
+	}
+	if len(packet) < fragmentHeaderLength {
+		return nil
+	}
+	index, count := int(packet[5]), int(packet[6])
+	if index >= count {
+		return nil
+	}
+	key := peer + "#" + strconv.FormatUint(uint64(binary.BigEndian.Uint32(packet[1:])), 10)
+	now := time.Now().UnixNano()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p, ok := r.pending[key]
+	if !ok {
+		if r.expire(now); len(r.pending) >= fragmentMaxPending {
+			Debug.Printf("Too many packets being reassembled, drop fragment from %s\n", peer)
+			return nil
+		}
+		p = &partialPacket{ make([][]byte, count), 0, now }
+		r.pending[key] = p
+	}
+	if len(p.parts) != count || p.parts[index] != nil {
+		return nil
+	}
+	// the receive buffer is reused while the other fragments are waited for
+	p.parts[index] = copyBytes(packet[fragmentHeaderLength:])
+	if p.got++; p.got < count {
+		return nil
+	}
+	delete(r.pending, key)
+	tunnelReassembled.Inc()
+	var whole []byte
+	for _, part := range p.parts {
+		whole = append(whole, part...)
+	}
+	return whole
+}
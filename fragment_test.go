@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestFragment(t *testing.T) {
+	packet := make([]byte, 3000)
+	rand.Read(packet)
+	packet[0] = 0x45
+
+	if fragments := fragmentToFit(packet, 3000); len(fragments) != 1 || !bytes.Equal(fragments[0], packet) {
+		t.Errorf("Expect packet fitting left whole")
+	}
+	fragments := fragmentToFit(packet, 1000)
+	if len(fragments) != 4 {
+		t.Fatalf("Expect 4 fragments but got %d", len(fragments))
+	}
+	for _, fragment := range fragments {
+		if len(fragment) > 1000 {
+			t.Errorf("Expect fragments not larger than 1000 but got %d", len(fragment))
+		}
+	}
+
+	r := NewReassembler()
+	if received := r.Reassemble("peer", []byte{ 0x45, 1 }); !bytes.Equal(received, []byte{ 0x45, 1 }) {
+		t.Errorf("Expect packets passed through but got %x", received)
+	}
+	for _, i := range []int{ 3, 1, 1, 0 } {
+		if received := r.Reassemble("peer", fragments[i]); received != nil {
+			t.Errorf("Expect nothing before the last fragment but got %d bytes", len(received))
+		}
+		// fragments of another peer are not mixed in
+		r.Reassemble("other", fragments[2])
+	}
+	if received := r.Reassemble("peer", fragments[2]); !bytes.Equal(received, packet) {
+		t.Errorf("Expect packet reassembled but got %d bytes", len(received))
+	}
+	if len(r.pending) != 1 {
+		t.Errorf("Expect only the packet of the other peer pending but got %d", len(r.pending))
+	}
+}
+
+func TestUDPFragment(t *testing.T) {
+	server, err := UDPListen("127.0.0.1", 11118, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, content []byte) { session.Send(content) })
+	client, err := UDPConnect("127.0.0.1", 11118, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	replies := make(chan []byte, 1)
+	client.SetHandler(func(_ Tunnel, content []byte) { replies <- copyBytes(content) })
+
+	packet := make([]byte, 4000)
+	rand.Read(packet)
+	packet[0] = 0x45
+	client.Send(packet)
+	select {
+	case reply := <-replies:
+		if !bytes.Equal(reply, packet) {
+			t.Errorf("Expect %d bytes echoed but got %d", len(packet), len(reply))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect oversized packet carried in fragments")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Control messages share the tunnel with IP packets, they are told apart by
+// the high nibble of the first byte which is never 0 for IPv4 or IPv6
+const (
+	ctrlHello byte = 0x01
+	ctrlChallenge byte = 0x02
+	ctrlResponse byte = 0x03
+	ctrlWelcome byte = 0x04
+	ctrlReject byte = 0x05
+	ctrlKeepalive byte = 0x06
+	ctrlKeepaliveAck byte = 0x07
+	ctrlPMTUProbe byte = 0x08
+	ctrlPMTUAck byte = 0x09
+)
+
+const (
+	handshakeNonceSize = 16
+	handshakeMacSize = sha256.Size
+	handshakeTimeout = 10 * time.Second
+	handshakeMaxPending = 1024
+)
+
+var (
+	handshakeSucceeded = NewCounter("handshake_succeeded_total", "Client handshakes accepted by the server")
+	handshakeFailed = NewCounter("handshake_failed_total", "Client handshakes rejected by the server")
+	unauthenticatedDrops = NewCounter("tunnel_unauthenticated_total", "Packets dropped for not belonging to an authenticated session")
+)
+
+func isControl(packet []byte) bool {
+	return len(packet) > 0 && packet[0] >> 4 == 0
+}
+
+// isHandshakeMessage tells the control messages sealed with the shared secret,
+// the rest of a session is sealed with its own keys
+func isHandshakeMessage(packet []byte) bool {
+	return len(packet) > 0 && packet[0] >= ctrlHello && packet[0] <= ctrlReject
+}
+
+// sealedBySession tells whether packet was sealed with the key of a session
+// rather than the shared secret, the top bit of the salt tells them apart
+func sealedBySession(shared Obscurer, packet []byte) bool {
+	_, ok := shared.(*AEADObscurer)
+	return ok && len(packet) > 0 && packet[0] & 0x80 != 0
+}
+
+// sealerOf picks the obscurer of packet, handshake messages are sealed with
+// the shared secret and the rest with the key of the session if there is one
+func sealerOf(shared, session Obscurer, packet []byte) Obscurer {
+	if session == nil || isHandshakeMessage(packet) {
+		return shared
+	}
+	return session
+}
+
+func handshakeMac(secret []byte, label string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+func randomNonce() ([]byte, error) {
+	nonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// sessionObscurer seals the packets of one side of a session with a key of
+// its own and restores those of the other side with the other key
+type sessionObscurer struct {
+	seal *AEADObscurer
+	open *AEADObscurer
+}
+
+// newSessionObscurer derives the keys of a session from the credential and
+// both nonces of its handshake, client tells which side we are
+func newSessionObscurer(secret, clientNonce, serverNonce []byte, client bool) (*sessionObscurer, error) {
+	toServer, err := newAEADObscurer(handshakeMac(secret, "gotun session client", clientNonce, serverNonce), true)
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := newAEADObscurer(handshakeMac(secret, "gotun session server", clientNonce, serverNonce), true)
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &sessionObscurer{ toServer, toClient }, nil
+	}
+	return &sessionObscurer{ toClient, toServer }, nil
+}
+
+func (o *sessionObscurer) Obscure(mss int, packet []byte) ([]byte, error) {
+	return o.seal.Obscure(mss, packet)
+}
+
+func (o *sessionObscurer) ObscureTo(dst []byte, mss int, packet []byte) ([]byte, error) {
+	return o.seal.ObscureTo(dst, mss, packet)
+}
+
+func (o *sessionObscurer) Overhead() int {
+	return o.seal.Overhead()
+}
+
+func (o *sessionObscurer) Restore(packet []byte) ([]byte, uint64, error) {
+	return o.open.Restore(packet)
+}
+
+// pathSeparator joins the name of a client and the index of one of its bond
+// paths, every path handshakes for a session of its own under the credential
+// and lease of the client
+const pathSeparator = "#"
+
+// credentialName strips the bond path off a handshaked name
+func credentialName(name string) string {
+	if i := strings.Index(name, pathSeparator); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+type Credential struct {
+	name string
+	secret []byte
+}
+
+type pendingHandshake struct {
+	name string
+	clientNonce []byte
+	serverNonce []byte
+	expireAt int64
+}
+
+// Authenticator is the server side of the handshake, a client proves it knows
+// the credential of its name by a HMAC over both parties' nonces
+type Authenticator struct {
+	lock sync.Mutex
+	credentials map[string][]byte
+	pending map[string]*pendingHandshake
+	pool *AddressPool
+}
+
+func NewAuthenticator(credentials map[string]string) *Authenticator {
+	a := &Authenticator{
+		sync.Mutex{},
+		make(map[string][]byte),
+		make(map[string]*pendingHandshake),
+		nil,
+	}
+	for name, secret := range credentials {
+		a.credentials[name] = []byte(secret)
+	}
+	return a
+}
+
+func LoadAuthenticator(filename string) *Authenticator {
+	credentials := make(map[string]string)
+	ReadLine(filename, func(line string) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			Error.Printf("Bad credential line: %s\n", line)
+			return
+		}
+		credentials[fields[0]] = fields[1]
+	})
+	Info.Printf("Load %v credentials from %v\n", len(credentials), filename)
+	return NewAuthenticator(credentials)
+}
+
+func (a *Authenticator) expire(now int64) {
+	for key, p := range a.pending {
+		if p.expireAt < now {
+			delete(a.pending, key)
+		}
+	}
+}
+
+// Hello answers a ctrlHello from addr with a challenge, unknown names are
+// challenged as well so that names can not be probed
+func (a *Authenticator) Hello(addr string, msg []byte) []byte {
+	if len(msg) < 1 + handshakeNonceSize + 1 {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now().UnixNano()
+	a.expire(now)
+	if _, ok := a.pending[addr]; !ok && len(a.pending) >= handshakeMaxPending {
+		Warning.Printf("Too many pending handshakes, ignore hello from %s\n", addr)
+		return nil
+	}
+
+	serverNonce, err := randomNonce()
+	if err != nil {
+		Error.Printf("Failed to challenge %s: %v\n", addr, err)
+		return nil
+	}
+	p := &pendingHandshake{
+		string(msg[1+handshakeNonceSize:]),
+		copyBytes(msg[1:1+handshakeNonceSize]),
+		serverNonce,
+		now + handshakeTimeout.Nanoseconds(),
+	}
+	a.pending[addr] = p
+	return append([]byte{ ctrlChallenge }, p.serverNonce...)
+}
+
+// SetPool makes the welcome of every client carry a lease from pool
+func (a *Authenticator) SetPool(pool *AddressPool) {
+	a.pool = pool
+}
+
+// handshakeResult is what a successful handshake establishes
+type handshakeResult struct {
+	name string
+	lease *Lease
+	// obscurer seals the packets of the session once the client is welcomed
+	obscurer Obscurer
+	welcome []byte
+}
+
+// Response verifies a ctrlResponse from addr, on success it returns the
+// authenticated name, its lease if any, the keys of its session and the
+// welcome to send back
+func (a *Authenticator) Response(addr string, msg []byte) (*handshakeResult, bool) {
+	if len(msg) != 1 + handshakeMacSize {
+		return nil, false
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	p, ok := a.pending[addr]
+	if !ok || p.expireAt < time.Now().UnixNano() {
+		return nil, false
+	}
+	delete(a.pending, addr)
+
+	secret, ok := a.credentials[credentialName(p.name)]
+	if !ok {
+		handshakeFailed.Inc()
+		Warning.Printf("Handshake from %s with unknown name %q\n", addr, p.name)
+		return nil, false
+	}
+	expect := handshakeMac(secret, "gotun client", p.clientNonce, p.serverNonce, []byte(p.name))
+	if !hmac.Equal(expect, msg[1:]) {
+		handshakeFailed.Inc()
+		Warning.Printf("Handshake from %s with bad credential of %q\n", addr, p.name)
+		return nil, false
+	}
+
+	obscurer, err := newSessionObscurer(secret, p.clientNonce, p.serverNonce, false)
+	if err != nil {
+		Error.Printf("Failed to derive session keys of %s: %v\n", p.name, err)
+		return nil, false
+	}
+	var lease *Lease
+	var options []byte
+	if a.pool != nil {
+		if lease, err = a.pool.Lease(credentialName(p.name)); err != nil {
+			Error.Printf("Failed to lease address to %s: %v\n", p.name, err)
+			return nil, false
+		}
+		options = lease.Marshal()
+	}
+	handshakeSucceeded.Inc()
+	// the lease is covered by the mac so that it can not be altered on the way
+	welcome := append([]byte{ ctrlWelcome }, handshakeMac(secret, "gotun server", p.serverNonce, p.clientNonce, options)...)
+	return &handshakeResult{ p.name, lease, obscurer, append(welcome, options...) }, true
+}
+
+// ClientHandshake is the client side of the handshake, hello is repeated
+// every second until the server welcomes us
+type ClientHandshake struct {
+	credential Credential
+	send func([]byte)
+	onLease func(*Lease)
+	lock sync.Mutex
+	clientNonce []byte
+	serverNonce []byte
+	established int32
+	session atomic.Value
+}
+
+// clientSession holds the keys of a session and the replay window of the
+// packets the server sealed with them
+type clientSession struct {
+	obscurer *sessionObscurer
+	replay *ReplayWindow
+}
+
+// NewClientHandshake starts handshaking, onLease is called with the lease pushed
+// by the server, if any, before the handshake is regarded as established
+func NewClientHandshake(credential Credential, send func([]byte), onLease func(*Lease)) *ClientHandshake {
+	h := newClientHandshake(credential, send, onLease)
+	h.start()
+	return h
+}
+
+// newClientHandshake leaves starting to the tunnel, which may have more to set
+// up before the first hello is sent
+func newClientHandshake(credential Credential, send func([]byte), onLease func(*Lease)) *ClientHandshake {
+	return &ClientHandshake{ credential: credential, send: send, onLease: onLease }
+}
+
+func (h *ClientHandshake) start() {
+	if h != nil {
+		go h.helloLoop()
+	}
+}
+
+func (h *ClientHandshake) Established() bool {
+	return h == nil || atomic.LoadInt32(&h.established) == 1
+}
+
+// Obscurer seals the packets of the current session, nil before handshaked
+func (h *ClientHandshake) Obscurer() Obscurer {
+	if s := h.current(); s != nil {
+		return s.obscurer
+	}
+	return nil
+}
+
+func (h *ClientHandshake) current() *clientSession {
+	if h == nil {
+		return nil
+	}
+	s, _ := h.session.Load().(*clientSession)
+	return s
+}
+
+func (h *ClientHandshake) Restart() {
+	if atomic.CompareAndSwapInt32(&h.established, 1, 0) {
+		Warning.Printf("Session of %s lost, handshake again\n", h.credential.name)
+	}
+	h.session.Store((*clientSession)(nil))
+	h.hello()
+}
+
+func (h *ClientHandshake) hello() {
+	clientNonce, err := randomNonce()
+	if err != nil {
+		Error.Printf("Failed to handshake as %s: %v\n", h.credential.name, err)
+		return
+	}
+	h.lock.Lock()
+	h.clientNonce = clientNonce
+	h.serverNonce = nil
+	msg := append([]byte{ ctrlHello }, h.clientNonce...)
+	msg = append(msg, h.credential.name...)
+	h.lock.Unlock()
+	h.send(msg)
+}
+
+func (h *ClientHandshake) helloLoop() {
+	h.hello()
+	for range time.Tick(time.Second) {
+		if !h.Established() {
+			h.hello()
+		}
+	}
+}
+
+// Handle consumes a control message received from the server
+func (h *ClientHandshake) Handle(msg []byte) {
+	switch msg[0] {
+	case ctrlChallenge:
+		if len(msg) != 1 + handshakeNonceSize {
+			return
+		}
+		h.lock.Lock()
+		h.serverNonce = copyBytes(msg[1:])
+		mac := handshakeMac(h.credential.secret, "gotun client", h.clientNonce, h.serverNonce, []byte(h.credential.name))
+		h.lock.Unlock()
+		h.send(append([]byte{ ctrlResponse }, mac...))
+	case ctrlWelcome:
+		if len(msg) < 1 + handshakeMacSize {
+			return
+		}
+		session, lease, ok := h.welcome(msg[1:1+handshakeMacSize], msg[1+handshakeMacSize:])
+		if !ok {
+			return
+		}
+		h.session.Store(session)
+		if lease != nil && h.onLease != nil {
+			h.onLease(lease)
+		}
+		if atomic.CompareAndSwapInt32(&h.established, 0, 1) {
+			Info.Printf("Handshake of %s succeeded\n", h.credential.name)
+		}
+	case ctrlReject:
+		if h.Established() {
+			h.Restart()
+		}
+	}
+}
+
+// welcome verifies the welcome to the current hello and derives the keys of
+// the session from it. A welcome is taken once, a replayed one must not reset
+// the replay window of the session
+func (h *ClientHandshake) welcome(mac, options []byte) (*clientSession, *Lease, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.serverNonce == nil {
+		return nil, nil, false
+	}
+	if !hmac.Equal(mac, handshakeMac(h.credential.secret, "gotun server", h.serverNonce, h.clientNonce, options)) {
+		Error.Printf("Bad welcome from server, is credential of %s right?\n", h.credential.name)
+		return nil, nil, false
+	}
+	var lease *Lease
+	if len(options) > 0 {
+		var err error
+		if lease, err = ParseLease(options); err != nil {
+			Error.Printf("Bad lease from server: %v\n", err)
+			return nil, nil, false
+		}
+	}
+	obscurer, err := newSessionObscurer(h.credential.secret, h.clientNonce, h.serverNonce, true)
+	if err != nil {
+		Error.Printf("Failed to derive session keys of %s: %v\n", h.credential.name, err)
+		return nil, nil, false
+	}
+	h.serverNonce = nil
+	return &clientSession{ obscurer, NewReplayWindow() }, lease, true
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	auth := NewAuthenticator(map[string]string { "alice": "secret" })
+
+	tests := []struct { name string; secret string; expect bool } {
+		{ "alice", "secret", true },
+		{ "alice", "wrong", false },
+		{ "bob", "secret", false },
+	}
+
+	for _, test := range tests {
+		toServer := make(chan []byte, 4)
+		h := &ClientHandshake{
+			credential: Credential{ test.name, []byte(test.secret) },
+			send: func(msg []byte) { toServer <- msg },
+		}
+		h.hello()
+		challenge := auth.Hello("addr", <-toServer)
+		if challenge == nil {
+			t.Fatalf("Expect challenge for %s", test.name)
+		}
+		h.Handle(challenge)
+		result, ok := auth.Response("addr", <-toServer)
+		if ok != test.expect {
+			t.Errorf("Expect handshake of %s/%s is %v, but got %v", test.name, test.secret, test.expect, ok)
+			continue
+		}
+		if ok {
+			if result.name != test.name {
+				t.Errorf("Expect name %s, but got %s", test.name, result.name)
+			}
+			h.Handle(result.welcome)
+			if !h.Established() {
+				t.Errorf("Expect client of %s established", test.name)
+			}
+		}
+	}
+}
+
+func TestHandshakeReplayedResponse(t *testing.T) {
+	auth := NewAuthenticator(map[string]string { "alice": "secret" })
+	toServer := make(chan []byte, 4)
+	h := &ClientHandshake{
+		credential: Credential{ "alice", []byte("secret") },
+		send: func(msg []byte) { toServer <- msg },
+	}
+	h.hello()
+	h.Handle(auth.Hello("addr", <-toServer))
+	response := <-toServer
+	if _, ok := auth.Response("addr", response); !ok {
+		t.Fatalf("Expect first response accepted")
+	}
+	nonce, _ := randomNonce()
+	auth.Hello("addr", append([]byte{ ctrlHello }, append(nonce, "alice"...)...))
+	if _, ok := auth.Response("addr", response); ok {
+		t.Errorf("Expect replayed response rejected")
+	}
+}
+
+func TestUDPAuthenticated(t *testing.T) {
+	shared := func() Obscurer {
+		obscurer, _ := NewAEADObscurer("shared")
+		return obscurer
+	}
+	server, err := UDPListen("127.0.0.1", 11113, &TunnelOptions{
+		obscurer: shared(),
+		auth: NewAuthenticator(map[string]string { "alice": "secret" }),
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	received := make(chan string, 4)
+	server.SetHandler(func(session Tunnel, b []byte) {
+		received <- session.(*Session).Name() + ":" + string(b)
+	})
+
+	// the intruder knows the shared secret but not the credential
+	intruder, _ := UDPConnect("127.0.0.1", 11113, &TunnelOptions{
+		obscurer: shared(),
+		credential: &Credential{ "alice", []byte("guess") },
+	})
+	intruder.(*UDPTunnelImpl).sendTo(nil, nil, []byte("E intruder"))
+
+	client, _ := UDPConnect("127.0.0.1", 11113, &TunnelOptions{
+		obscurer: shared(),
+		credential: &Credential{ "alice", []byte("secret") },
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for !client.(*UDPTunnelImpl).handshake.Established() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.Send([]byte("E hello"))
+
+	select {
+	case r := <-received:
+		if r != "alice:E hello" {
+			t.Errorf("Want alice:E hello but got %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timeout waiting for data")
+	}
+	if intruder.(*UDPTunnelImpl).handshake.Established() {
+		t.Errorf("Expect intruder not established")
+	}
+}
+
+func TestHandshakeLease(t *testing.T) {
+	auth := NewAuthenticator(map[string]string { "alice": "secret" })
+	pool, _ := NewAddressPool("10.8.0.0/24", "8.8.8.8", 1400)
+	auth.SetPool(pool)
+
+	var leased *Lease
+	toServer := make(chan []byte, 4)
+	h := &ClientHandshake{
+		credential: Credential{ "alice", []byte("secret") },
+		send: func(msg []byte) { toServer <- msg },
+		onLease: func(lease *Lease) { leased = lease },
+	}
+	h.hello()
+	h.Handle(auth.Hello("addr", <-toServer))
+	result, ok := auth.Response("addr", <-toServer)
+	if !ok {
+		t.Fatalf("Expect handshake succeeded")
+	}
+	lease, welcome := result.lease, result.welcome
+
+	tampered := copyBytes(welcome)
+	tampered[len(tampered)-1] ^= 1
+	h.Handle(tampered)
+	if leased != nil || h.Established() {
+		t.Errorf("Expect tampered lease rejected")
+	}
+
+	h.Handle(welcome)
+	if leased == nil || !leased.addr.Equal(lease.addr) || leased.mtu != 1400 {
+		t.Errorf("Expect lease %v, but got %v", lease, leased)
+	}
+	if !h.Established() {
+		t.Errorf("Expect client established")
+	}
+}
+
+func TestHandshakeSessionKeys(t *testing.T) {
+	auth := NewAuthenticator(map[string]string { "alice": "secret" })
+	toServer := make(chan []byte, 4)
+	h := &ClientHandshake{
+		credential: Credential{ "alice", []byte("secret") },
+		send: func(msg []byte) { toServer <- msg },
+	}
+	h.hello()
+	h.Handle(auth.Hello("addr", <-toServer))
+	result, ok := auth.Response("addr", <-toServer)
+	if !ok {
+		t.Fatalf("Expect handshake succeeded")
+	}
+	if h.Obscurer() != nil {
+		t.Errorf("Expect no session key before welcomed")
+	}
+	h.Handle(result.welcome)
+	session := h.current()
+	if session == nil {
+		t.Fatalf("Expect session key once welcomed")
+	}
+
+	shared, _ := NewAEADObscurer("secret")
+	sealed, _ := h.Obscurer().Obscure(1400, []byte("E to server"))
+	if !sealedBySession(shared, sealed) {
+		t.Errorf("Expect packet told sealed by session")
+	}
+	if _, _, err := shared.Restore(copyBytes(sealed)); err == nil {
+		t.Errorf("Expect shared secret not restoring session packet")
+	}
+	if restored, _, err := result.obscurer.Restore(sealed); err != nil || string(restored) != "E to server" {
+		t.Errorf("Expect server restoring packet of client but got %q, %v", restored, err)
+	}
+	sealed, _ = result.obscurer.Obscure(1400, []byte("E to client"))
+	if restored, _, err := session.obscurer.Restore(sealed); err != nil || string(restored) != "E to client" {
+		t.Errorf("Expect client restoring packet of server but got %q, %v", restored, err)
+	}
+
+	h.Handle(result.welcome)
+	if h.current() != session {
+		t.Errorf("Expect replayed welcome not resetting the session")
+	}
+	h.Restart()
+	if h.Obscurer() != nil {
+		t.Errorf("Expect session key dropped on restart")
+	}
+}
+
+func TestSealerOf(t *testing.T) {
+	shared, _ := NewAEADObscurer("shared")
+	session := &sessionObscurer{}
+	tests := []struct { session Obscurer; packet []byte; expect Obscurer } {
+		{ nil, []byte{ 0x45 }, shared },
+		{ session, []byte{ 0x45 }, session },
+		{ session, []byte{ ctrlKeepalive }, session },
+		{ session, []byte{ ctrlHello }, shared },
+		{ session, []byte{ ctrlReject }, shared },
+	}
+	for _, test := range tests {
+		if sealer := sealerOf(shared, test.session, test.packet); sealer != test.expect {
+			t.Errorf("Expect %x sealed by %T but got %T", test.packet, test.expect, sealer)
+		}
+	}
+}
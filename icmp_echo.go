@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// icmpEchoHeaderLength is the ICMP header plus the direction mark
+const icmpEchoHeaderLength = 8 + 1
+
+// the kernel of the server may answer our requests by itself with the same
+// data, marking the direction keeps the client from taking those as replies
+const (
+	icmpEchoRequestMark byte = 0xa5
+	icmpEchoReplyMark byte = 0x5a
+)
+
+// icmpEchoPendingLength bounds the sequence numbers of requests kept by the
+// server to be answered
+const icmpEchoPendingLength = 64
+
+// icmpEchoMaxFlows bounds the flows of a server, they are created before the
+// pings carried are authenticated
+const icmpEchoMaxFlows = 4096
+
+var (
+	icmpEchoNoPeer = NewCounter("icmp_echo_no_peer_total", "Packets dropped by icmp tunnels for the peer not having pinged yet")
+	icmpEchoFlowsRefused = NewCounter("icmp_echo_flows_refused_total", "Ping flows refused by icmp servers for having too many")
+)
+
+// icmpAddr is a peer of the server, ids tell apart clients behind one NAT
+type icmpAddr struct {
+	IP net.IP
+	ID int
+}
+
+func (a *icmpAddr) Network() string {
+	return "icmp"
+}
+
+func (a *icmpAddr) String() string {
+	return fmt.Sprintf("%v#%d", a.IP, a.ID)
+}
+
+type icmpEchoFlow struct {
+	lock sync.Mutex
+	remote *icmpAddr
+	pending []int
+	lastSeq int
+	lastSeen int64
+}
+
+// reply picks the sequence number for a reply, the oldest request not answered
+// or the latest one if every request is answered already
+func (flow *icmpEchoFlow) reply() int {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if len(flow.pending) == 0 {
+		return flow.lastSeq
+	}
+	seq := flow.pending[0]
+	flow.pending = flow.pending[1:]
+	return seq
+}
+
+func (flow *icmpEchoFlow) request(seq int) {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+	if len(flow.pending) >= icmpEchoPendingLength {
+		flow.pending = flow.pending[1:]
+	}
+	flow.pending = append(flow.pending, seq)
+	flow.lastSeq = seq
+}
+
+// ICMPEcho carries packets of a raw tunnel in pings, the client sends Echo
+// Requests and the server answers with Echo Replies of the same identifier
+// and sequence number so that NATs and firewalls take them as ordinary pings
+type ICMPEcho struct {
+	client bool
+	v6 bool
+	id int
+	seq uint32
+	lastSent int64
+	lock sync.RWMutex
+	flows map[string]*icmpEchoFlow
+	sendPacket func(addr net.Addr, packet []byte)
+	// timeout is how long the server remembers an idle flow
+	timeout time.Duration
+}
+
+// NewICMPEchoClient starts pinging, an empty request is sent every second when
+// idle so that the server always has requests to answer
+func NewICMPEchoClient(v6 bool, sendPacket func(net.Addr, []byte)) *ICMPEcho {
+	e := &ICMPEcho{ client: true, v6: v6, id: rand.Intn(0x10000), seq: rand.Uint32(), sendPacket: sendPacket }
+	go e.pollLoop()
+	return e
+}
+
+func NewICMPEchoServer(v6 bool, timeout time.Duration, sendPacket func(net.Addr, []byte)) *ICMPEcho {
+	e := &ICMPEcho{ v6: v6, flows: make(map[string]*icmpEchoFlow), sendPacket: sendPacket, timeout: timeout }
+	go e.expireLoop()
+	return e
+}
+
+func (e *ICMPEcho) pollLoop() {
+	for range time.Tick(time.Second) {
+		if time.Now().UnixNano() - atomic.LoadInt64(&e.lastSent) >= time.Second.Nanoseconds() {
+			if packet, _ := e.Wrap(nil, nil); packet != nil {
+				e.sendPacket(nil, packet)
+			}
+		}
+	}
+}
+
+func (e *ICMPEcho) expireLoop() {
+	for range time.Tick(time.Minute) {
+		deadline := time.Now().UnixNano() - e.timeout.Nanoseconds()
+		e.lock.Lock()
+		for key, flow := range e.flows {
+			if atomic.LoadInt64(&flow.lastSeen) < deadline {
+				delete(e.flows, key)
+			}
+		}
+		e.lock.Unlock()
+	}
+}
+
+func (e *ICMPEcho) requestType() icmp.Type {
+	if e.v6 {
+		return ipv6.ICMPTypeEchoRequest
+	}
+	return ipv4.ICMPTypeEcho
+}
+
+func (e *ICMPEcho) replyType() icmp.Type {
+	if e.v6 {
+		return ipv6.ICMPTypeEchoReply
+	}
+	return ipv4.ICMPTypeEchoReply
+}
+
+func icmpTypeValue(icmpType icmp.Type) uint32 {
+	switch t := icmpType.(type) {
+	case ipv4.ICMPType:
+		return uint32(t)
+	case ipv6.ICMPType:
+		return uint32(t)
+	}
+	return 0
+}
+
+// Restart does nothing, the next ping opens the NAT mapping again by itself
+func (e *ICMPEcho) Restart(_, _ net.IP) {
+}
+
+func (e *ICMPEcho) Overhead() int {
+	return icmpEchoHeaderLength
+}
+
+// Filter lets Echo Replies into the socket of the client and Echo Requests
+// into the one of the server
+func (e *ICMPEcho) Filter() []bpf.Instruction {
+	icmpType := e.requestType()
+	if e.client {
+		icmpType = e.replyType()
+	}
+	return []bpf.Instruction{
+		bpf.LoadIndirect{ Off: 0, Size: 1 },
+		bpf.JumpIf{ Cond: bpf.JumpEqual, Val: icmpTypeValue(icmpType), SkipFalse: 1 },
+		bpf.RetConstant{ Val: 0xffff },
+		bpf.RetConstant{ Val: 0 },
+	}
+}
+
+func (e *ICMPEcho) Wrap(addr net.Addr, payload []byte) ([]byte, net.Addr) {
+	data := make([]byte, 1 + len(payload))
+	copy(data[1:], payload)
+	var msg icmp.Message
+	if e.client {
+		data[0] = icmpEchoRequestMark
+		atomic.StoreInt64(&e.lastSent, time.Now().UnixNano())
+		seq := int(uint16(atomic.AddUint32(&e.seq, 1)))
+		msg = icmp.Message{ Type: e.requestType(), Body: &icmp.Echo{ ID: e.id, Seq: seq, Data: data } }
+	} else {
+		e.lock.RLock()
+		flow := e.flows[addr.String()]
+		e.lock.RUnlock()
+		if flow == nil {
+			icmpEchoNoPeer.Inc()
+			Debug.Printf("%v has not pinged, skip %d bytes\n", addr, len(payload))
+			return nil, nil
+		}
+		data[0] = icmpEchoReplyMark
+		addr = &net.IPAddr{ IP: flow.remote.IP }
+		msg = icmp.Message{ Type: e.replyType(), Body: &icmp.Echo{ ID: flow.remote.ID, Seq: flow.reply(), Data: data } }
+	}
+	// the kernel computes the checksum of ICMPv6 which covers a pseudo header
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		Error.Printf("Failed to marshal icmp message: %v\n", err)
+		return nil, nil
+	}
+	return packet, addr
+}
+
+func (e *ICMPEcho) Unwrap(_, remote net.IP, packet []byte) (net.Addr, []byte) {
+	protocol := 1
+	if e.v6 {
+		protocol = 58
+	}
+	msg, err := icmp.ParseMessage(protocol, packet)
+	if err != nil {
+		return nil, nil
+	}
+	echo, ok := msg.Body.(*icmp.Echo)
+	if !ok || len(echo.Data) == 0 {
+		return nil, nil
+	}
+
+	if e.client {
+		if msg.Type != e.replyType() || echo.ID != e.id || echo.Data[0] != icmpEchoReplyMark {
+			return nil, nil
+		}
+		if len(echo.Data) == 1 {
+			return nil, nil
+		}
+		return &net.IPAddr{ IP: remote }, echo.Data[1:]
+	}
+
+	if msg.Type != e.requestType() || echo.Data[0] != icmpEchoRequestMark {
+		return nil, nil
+	}
+	flow := e.serverFlow(remote, echo.ID, len(echo.Data) > 1)
+	if flow == nil {
+		return nil, nil
+	}
+	atomic.StoreInt64(&flow.lastSeen, time.Now().UnixNano())
+	flow.request(echo.Seq)
+	if len(echo.Data) == 1 {
+		return nil, nil
+	}
+	return flow.remote, echo.Data[1:]
+}
+
+func (e *ICMPEcho) serverFlow(remote net.IP, id int, create bool) *icmpEchoFlow {
+	addr := &icmpAddr{ copyIP(remote), id }
+	key := addr.String()
+	e.lock.RLock()
+	flow, ok := e.flows[key]
+	e.lock.RUnlock()
+	if ok || !create {
+		// polls alone do not deserve a flow
+		return flow
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if flow, ok = e.flows[key]; ok {
+		return flow
+	}
+	if len(e.flows) >= icmpEchoMaxFlows {
+		icmpEchoFlowsRefused.Inc()
+		Debug.Printf("Too many ping flows, ignore %s\n", key)
+		return nil
+	}
+	flow = &icmpEchoFlow{ remote: addr }
+	e.flows[key] = flow
+	return flow
+}
+
+func icmpProtocol(ip net.IP) uint8 {
+	if isIPv6(ip) {
+		return 58
+	}
+	return 1
+}
+
+func ICMPConnect(addr string, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newRawTunnel(icmpProtocol(ipAddr.IP), nil, ipAddr, addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.startDisguised(NewICMPEchoClient(tunnel.v6, tunnel.sendSegment), opts)
+	return tunnel, nil
+}
+
+func ICMPListen(addr string, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newRawTunnel(icmpProtocol(ipAddr.IP), ipAddr, nil, "", opts)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.v6 {
+		Warning.Printf("Stop kernel from answering pings, e.g. sysctl -w net.ipv6.icmp.echo_ignore_all=1\n")
+	} else {
+		Warning.Printf("Stop kernel from answering pings, e.g. sysctl -w net.ipv4.icmp_echo_ignore_all=1\n")
+	}
+	tunnel.startDisguised(NewICMPEchoServer(tunnel.v6, opts.getSessionTimeout(), tunnel.sendSegment), opts)
+	return tunnel, nil
+}
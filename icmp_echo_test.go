@@ -0,0 +1,118 @@
+package main
+
+import (
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"testing"
+)
+
+func parseEcho(t *testing.T, packet []byte) (icmp.Type, *icmp.Echo) {
+	msg, err := icmp.ParseMessage(1, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Type, msg.Body.(*icmp.Echo)
+}
+
+func TestICMPEchoRoundTrip(t *testing.T) {
+	clientIP := net.IPv4(10, 0, 0, 1).To4()
+	serverIP := net.IPv4(10, 0, 0, 2).To4()
+	client := &ICMPEcho{ client: true, id: 1234, seq: 99 }
+	server := &ICMPEcho{ flows: make(map[string]*icmpEchoFlow) }
+
+	if packet, _ := server.Wrap(&icmpAddr{ clientIP, 1234 }, []byte("early")); packet != nil {
+		t.Errorf("Expect nothing sent before the client pings")
+	}
+
+	request, _ := client.Wrap(nil, []byte("hello"))
+	icmpType, echo := parseEcho(t, request)
+	if icmpType != ipv4.ICMPTypeEcho || echo.ID != 1234 || echo.Seq != 100 {
+		t.Errorf("Expect echo request 1234/100 but got %v %d/%d", icmpType, echo.ID, echo.Seq)
+	}
+	if checksumFold(checksumAdd(0, request)) != 0 {
+		t.Errorf("Expect valid checksum of request")
+	}
+	from, payload := server.Unwrap(serverIP, clientIP, request)
+	if string(payload) != "hello" || from.String() != "10.0.0.1#1234" {
+		t.Errorf("Expect hello from 10.0.0.1#1234 but got %q from %v", payload, from)
+	}
+	// polls only add sequence numbers to answer
+	poll, _ := client.Wrap(nil, nil)
+	if _, payload = server.Unwrap(serverIP, clientIP, poll); payload != nil {
+		t.Errorf("Expect nothing from poll but got %q", payload)
+	}
+
+	for _, expect := range []int{ 100, 101, 101 } {
+		reply, addr := server.Wrap(from, []byte("world"))
+		if !addr.(*net.IPAddr).IP.Equal(clientIP) {
+			t.Errorf("Expect reply to %v but got %v", clientIP, addr)
+		}
+		icmpType, echo = parseEcho(t, reply)
+		if icmpType != ipv4.ICMPTypeEchoReply || echo.ID != 1234 || echo.Seq != expect {
+			t.Errorf("Expect echo reply 1234/%d but got %v %d/%d", expect, icmpType, echo.ID, echo.Seq)
+		}
+		if _, payload = client.Unwrap(clientIP, serverIP, reply); string(payload) != "world" {
+			t.Errorf("Expect world but got %q", payload)
+		}
+	}
+}
+
+func TestICMPEchoIgnoreKernelReply(t *testing.T) {
+	client := &ICMPEcho{ client: true, id: 1234 }
+	request, _ := client.Wrap(nil, []byte("hello"))
+	// what the kernel of the server answers to our request
+	msg, _ := icmp.ParseMessage(1, request)
+	msg.Type = ipv4.ICMPTypeEchoReply
+	reply, _ := msg.Marshal(nil)
+	if _, payload := client.Unwrap(nil, net.IPv4(10, 0, 0, 2), reply); payload != nil {
+		t.Errorf("Expect kernel reply ignored but got %q", payload)
+	}
+
+	other := &ICMPEcho{ flows: make(map[string]*icmpEchoFlow) }
+	other.serverFlow(net.IPv4(10, 0, 0, 1), 4321, true)
+	reply, _ = other.Wrap(&icmpAddr{ net.IPv4(10, 0, 0, 1), 4321 }, []byte("hello"))
+	if _, payload := client.Unwrap(nil, net.IPv4(10, 0, 0, 2), reply); payload != nil {
+		t.Errorf("Expect reply of other id ignored but got %q", payload)
+	}
+}
+
+func TestICMPEchoMaxFlows(t *testing.T) {
+	client := &ICMPEcho{ client: true }
+	server := &ICMPEcho{ flows: make(map[string]*icmpEchoFlow) }
+	serverIP := net.IPv4(10, 0, 0, 2).To4()
+	for id := 0; id <= icmpEchoMaxFlows; id++ {
+		client.id = id
+		request, _ := client.Wrap(nil, []byte("hello"))
+		server.Unwrap(serverIP, net.IPv4(10, 0, 0, 1).To4(), request)
+	}
+	if len(server.flows) != icmpEchoMaxFlows {
+		t.Errorf("Expect %d flows at most but got %d", icmpEchoMaxFlows, len(server.flows))
+	}
+	// flows already known keep working
+	client.id = 0
+	request, _ := client.Wrap(nil, []byte("hello"))
+	if _, payload := server.Unwrap(serverIP, net.IPv4(10, 0, 0, 1).To4(), request); string(payload) != "hello" {
+		t.Errorf("Expect payload of a known flow but got %q", payload)
+	}
+}
+
+func TestICMPv6EchoRoundTrip(t *testing.T) {
+	client := &ICMPEcho{ client: true, v6: true, id: 1234 }
+	server := &ICMPEcho{ v6: true, flows: make(map[string]*icmpEchoFlow) }
+
+	request, _ := client.Wrap(nil, []byte("hello"))
+	msg, err := icmp.ParseMessage(58, request)
+	if err != nil || msg.Type != ipv6.ICMPTypeEchoRequest {
+		t.Fatalf("Expect ICMPv6 echo request but got %v, %v", msg, err)
+	}
+	from, payload := server.Unwrap(nil, net.ParseIP("2001:db8::1"), request)
+	if string(payload) != "hello" {
+		t.Errorf("Expect hello but got %q", payload)
+	}
+	reply, _ := server.Wrap(from, []byte("world"))
+	if _, payload = client.Unwrap(nil, net.ParseIP("2001:db8::2"), reply); string(payload) != "world" {
+		t.Errorf("Expect world but got %q", payload)
+	}
+}
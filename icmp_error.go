@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// unreachable is why a packet could not be sent through a tunnel
+type unreachable int
+
+const (
+	// unreachableNet means the tunnel has nowhere to send the packet
+	unreachableNet unreachable = iota
+	// unreachableHost means the tunnel can not take the packet now, e.g. it
+	// is congested or not connected
+	unreachableHost
+	// unreachableTooBig means the packet does not fit into the tunnel
+	unreachableTooBig
+)
+
+func (u unreachable) String() string {
+	switch u {
+	case unreachableNet:
+		return "net unreachable"
+	case unreachableHost:
+		return "host unreachable"
+	case unreachableTooBig:
+		return "too big"
+	}
+	return "unknown"
+}
+
+// undeliverableHandler receives the packets a tunnel drops, mtu is the largest
+// packet the tunnel takes if the packet is too big
+type undeliverableHandler func(packet []byte, reason unreachable, mtu int)
+
+func (h undeliverableHandler) report(packet []byte, reason unreachable, mtu int) {
+	if h != nil {
+		h(packet, reason, mtu)
+	}
+}
+
+// Quoting as much of the packet as fits into the minimum MTU, as RFC 1812
+// and RFC 4443 suggest
+const (
+	icmpv4ErrorMaxLength = 576
+	icmpv6ErrorMaxLength = 1280
+)
+
+// icmpErrorRate bounds the ICMP errors sent to the device every second
+var icmpErrorRate = 100
+
+var (
+	icmpErrorsSent = NewCounter("icmp_errors_sent_total", "ICMP errors sent to the device for packets the tunnel dropped")
+	icmpErrorsLimited = NewCounter("icmp_errors_limited_total", "ICMP errors not sent for exceeding the rate limit")
+)
+
+// icmpErrorLimiter lets icmpErrorRate errors through every second
+type icmpErrorLimiter struct {
+	lock sync.Mutex
+	second int64
+	sent int
+}
+
+func (l *icmpErrorLimiter) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if second := now.Unix(); second != l.second {
+		l.second, l.sent = second, 0
+	}
+	if l.sent >= icmpErrorRate {
+		return false
+	}
+	l.sent++
+	return true
+}
+
+// icmpErrorsTo returns the handler which answers the packets dropped by a
+// tunnel with ICMP errors sent to device
+func icmpErrorsTo(device TunTap) undeliverableHandler {
+	limiter := &icmpErrorLimiter{}
+	return func(packet []byte, reason unreachable, mtu int) {
+		reply := icmpError(packet, reason, mtu)
+		if reply == nil {
+			return
+		}
+		if !limiter.allow(time.Now()) {
+			icmpErrorsLimited.Inc()
+			return
+		}
+		icmpErrorsSent.Inc()
+		Debug.Printf("Send %v to %v for %d bytes\n", reason, packetSrcIP(packet), len(packet))
+		device.Send(reply)
+	}
+}
+
+// icmpError builds the ICMP error telling the sender of packet why it is not
+// delivered, from the destination of packet as the device has no address of
+// its own to send from. Nil if no error must be sent for packet, e.g. it is an
+// ICMP error itself, a non-first fragment or sent to a group
+func icmpError(packet []byte, reason unreachable, mtu int) []byte {
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		return icmpv4Error(packet, reason, mtu)
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		return icmpv6Error(packet, reason, mtu)
+	}
+	return nil
+}
+
+func icmpv4Error(packet []byte, reason unreachable, mtu int) []byte {
+	headerLength := int(packet[0] & 0x0f) * 4
+	src, dst := net.IP(packet[12:16]), net.IP(packet[16:20])
+	if headerLength < 20 || len(packet) < headerLength ||
+		binary.BigEndian.Uint16(packet[6:]) & 0x1fff != 0 ||
+		dst.IsMulticast() || dst.Equal(net.IPv4bcast) || src.IsUnspecified() || src.IsMulticast() {
+		return nil
+	}
+	if packet[9] == 1 {
+		// only queries are answered, never errors
+		if len(packet) < headerLength + 1 {
+			return nil
+		}
+		switch packet[headerLength] {
+		case 0, 8, 13, 14:
+		default:
+			return nil
+		}
+	}
+	code := byte(0)
+	switch reason {
+	case unreachableHost:
+		code = 1
+	case unreachableTooBig:
+		// fragmentation needed is for packets with don't fragment only
+		if packet[6] & 0x40 != 0 {
+			code = 4
+		} else {
+			code = 1
+		}
+	}
+	quoted := packet
+	if len(quoted) > icmpv4ErrorMaxLength - 20 - 8 {
+		quoted = quoted[:icmpv4ErrorMaxLength - 20 - 8]
+	}
+	reply := make([]byte, 20 + 8 + len(quoted))
+	reply[0] = 0x45
+	binary.BigEndian.PutUint16(reply[2:], uint16(len(reply)))
+	reply[8], reply[9] = 64, 1
+	copy(reply[12:16], dst)
+	copy(reply[16:20], src)
+	binary.BigEndian.PutUint16(reply[10:], checksumFold(checksumAdd(0, reply[:20])))
+
+	icmp := reply[20:]
+	icmp[0], icmp[1] = 3, code
+	if code == 4 {
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+	}
+	copy(icmp[8:], quoted)
+	binary.BigEndian.PutUint16(icmp[2:], checksumFold(checksumAdd(0, icmp)))
+	return reply
+}
+
+func icmpv6Error(packet []byte, reason unreachable, mtu int) []byte {
+	src, dst := net.IP(packet[8:24]), net.IP(packet[24:40])
+	if dst.IsMulticast() || src.IsUnspecified() || src.IsMulticast() {
+		return nil
+	}
+	// errors have types below 128, extension headers are not walked through
+	if packet[6] == 58 && (len(packet) < 41 || packet[40] < 128) {
+		return nil
+	}
+	kind, code := byte(1), byte(0)
+	switch reason {
+	case unreachableHost:
+		code = 3
+	case unreachableTooBig:
+		kind = 2
+		if mtu < 1280 {
+			mtu = 1280
+		}
+	}
+	quoted := packet
+	if len(quoted) > icmpv6ErrorMaxLength - 40 - 8 {
+		quoted = quoted[:icmpv6ErrorMaxLength - 40 - 8]
+	}
+	reply := make([]byte, 40 + 8 + len(quoted))
+	reply[0] = 0x60
+	binary.BigEndian.PutUint16(reply[4:], uint16(8 + len(quoted)))
+	reply[6], reply[7] = 58, 64
+	copy(reply[8:24], dst)
+	copy(reply[24:40], src)
+
+	icmp := reply[40:]
+	icmp[0], icmp[1] = kind, code
+	if kind == 2 {
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	}
+	copy(icmp[8:], quoted)
+	binary.BigEndian.PutUint16(icmp[2:], pseudoHeaderChecksum(dst, src, 58, icmp))
+	return reply
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+	"testing"
+	"time"
+)
+
+func TestICMPError(t *testing.T) {
+	syn4 := tcpSegment(false, true, false, 1460)
+	df4 := copyBytes(syn4)
+	df4[6] |= 0x40
+	syn6 := tcpSegment(true, true, false, 1440)
+	tests := []struct {
+		packet []byte
+		reason unreachable
+		mtu int
+		kind uint8
+		code uint8
+	}{
+		{ syn4, unreachableNet, 0, layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeNet },
+		{ syn4, unreachableHost, 0, layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost },
+		// fragmentation needed only with don't fragment
+		{ syn4, unreachableTooBig, 1400, layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeHost },
+		{ df4, unreachableTooBig, 1400, layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded },
+		{ syn6, unreachableNet, 0, layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeNoRouteToDst },
+		{ syn6, unreachableHost, 0, layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable },
+		{ syn6, unreachableTooBig, 1400, layers.ICMPv6TypePacketTooBig, 0 },
+	}
+	for i, test := range tests {
+		reply := icmpError(test.packet, test.reason, test.mtu)
+		if reply == nil {
+			t.Errorf("Expect error for packet %d but got nil\n", i)
+			continue
+		}
+		if !packetSrcIP(reply).Equal(packetDstIP(test.packet)) || !packetDstIP(reply).Equal(packetSrcIP(test.packet)) {
+			t.Errorf("Expect error of packet %d sent back but got %v to %v\n", i, packetSrcIP(reply), packetDstIP(reply))
+		}
+		if !checksumValid(reply) {
+			t.Errorf("Expect valid checksum of error %d\n", i)
+		}
+		packet := decodePacket(reply)
+		var kind, code uint8
+		var quoted []byte
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			kind, code = icmp.TypeCode.Type(), icmp.TypeCode.Code()
+			quoted = icmp.Payload
+			if code == layers.ICMPv4CodeFragmentationNeeded && int(icmp.Seq) != test.mtu {
+				t.Errorf("Expect next hop MTU %d of error %d but got %d\n", test.mtu, i, icmp.Seq)
+			}
+		} else if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			kind, code = icmp.TypeCode.Type(), icmp.TypeCode.Code()
+			quoted = icmp.Payload[4:]
+		}
+		if kind != test.kind || code != test.code {
+			t.Errorf("Expect type %d code %d of error %d but got %d %d\n", test.kind, test.code, i, kind, code)
+		}
+		if string(quoted) != string(test.packet) {
+			t.Errorf("Expect packet %d quoted but got % x\n", i, quoted)
+		}
+	}
+
+	// errors are never answered with errors, nor are non-IP packets
+	reply := icmpError(syn4, unreachableHost, 0)
+	if got := icmpError(reply, unreachableHost, 0); got != nil {
+		t.Errorf("Expect no error for an ICMP error but got % x\n", got)
+	}
+	reply = icmpError(syn6, unreachableHost, 0)
+	if got := icmpError(reply, unreachableHost, 0); got != nil {
+		t.Errorf("Expect no error for an ICMPv6 error but got % x\n", got)
+	}
+	if got := icmpError(ethernetFrame(broadcastMAC, broadcastMAC, etherTypeIPv4, syn4), unreachableHost, 0); got != nil {
+		t.Errorf("Expect no error for a frame but got % x\n", got)
+	}
+
+	large := make([]byte, 1500)
+	copy(large, syn4)
+	large[2], large[3] = 1500 >> 8, 1500 & 0xff
+	if got := icmpError(large, unreachableHost, 0); len(got) != icmpv4ErrorMaxLength {
+		t.Errorf("Expect error of %d bytes but got %d\n", icmpv4ErrorMaxLength, len(got))
+	}
+}
+
+func TestICMPErrorLimiter(t *testing.T) {
+	limiter := &icmpErrorLimiter{}
+	now := time.Unix(1000, 0)
+	for i := 0; i < icmpErrorRate; i++ {
+		if !limiter.allow(now) {
+			t.Fatalf("Expect error %d allowed\n", i)
+		}
+	}
+	if limiter.allow(now) {
+		t.Errorf("Expect error over the rate limited\n")
+	}
+	if !limiter.allow(now.Add(time.Second)) {
+		t.Errorf("Expect error allowed in the next second\n")
+	}
+}
+
+func TestUDPUndeliverable(t *testing.T) {
+	reported := make(chan unreachable, 1)
+	opts := &TunnelOptions{
+		credential: &Credential{ "client", []byte("secret") },
+		onUndeliverable: func(_ []byte, reason unreachable, _ int) { reported <- reason },
+	}
+	// nothing listens, so the handshake never completes
+	tunnel, err := UDPConnect("127.0.0.1", 11122, opts)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v\n", err)
+	}
+	tunnel.Send(tcpSegment(false, true, false, 1460))
+	select {
+	case reason := <-reported:
+		if reason != unreachableHost {
+			t.Errorf("Expect %v but got %v\n", unreachableHost, reason)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect packet reported undeliverable\n")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var (
+	keepalivesSent = NewCounter("keepalive_sent_total", "Keepalives sent by clients")
+	deadPeers = NewCounter("keepalive_dead_peer_total", "Times the server went silent for longer than the peer timeout")
+)
+
+// Keepalive pings the server every interval so that NAT mappings on the way
+// stay open, the server acknowledges each of them. If nothing is heard from
+// the server for longer than timeout, onDead is called to reconnect
+type Keepalive struct {
+	interval time.Duration
+	timeout time.Duration
+	send func([]byte)
+	onDead func()
+	lastReceived int64
+	lastReconnect int64
+}
+
+// NewKeepalive starts pinging, nothing is sent with a zero interval and the
+// peer is never regarded as dead with a zero timeout
+func NewKeepalive(interval, timeout time.Duration, send func([]byte), onDead func()) *Keepalive {
+	now := time.Now().UnixNano()
+	k := &Keepalive{ interval, timeout, send, onDead, now, now }
+	if interval > 0 {
+		go k.loop()
+	}
+	return k
+}
+
+// Received records that the peer is alive
+func (k *Keepalive) Received() {
+	if k != nil {
+		atomic.StoreInt64(&k.lastReceived, time.Now().UnixNano())
+	}
+}
+
+// Alive tells whether the peer was heard within the timeout, a peer is always
+// alive if it is not pinged or has no timeout
+func (k *Keepalive) Alive() bool {
+	if k == nil || k.interval <= 0 || k.timeout <= 0 {
+		return true
+	}
+	return time.Now().UnixNano() - atomic.LoadInt64(&k.lastReceived) <= k.timeout.Nanoseconds()
+}
+
+func (k *Keepalive) loop() {
+	for range time.Tick(k.interval) {
+		k.send([]byte{ ctrlKeepalive })
+		keepalivesSent.Inc()
+
+		now := time.Now().UnixNano()
+		silent := time.Duration(now - atomic.LoadInt64(&k.lastReceived))
+		// give every new connection another timeout before trying again
+		if k.timeout > 0 && silent > k.timeout && now - k.lastReconnect > k.timeout.Nanoseconds() {
+			deadPeers.Inc()
+			Warning.Printf("Nothing heard from server for %v, reconnect\n", silent.Truncate(time.Second))
+			k.lastReconnect = now
+			k.onDead()
+		}
+	}
+}
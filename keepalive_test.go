@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveDeadPeer(t *testing.T) {
+	var sent, dead int32
+	k := NewKeepalive(10 * time.Millisecond, 50 * time.Millisecond,
+		func([]byte) { atomic.AddInt32(&sent, 1) }, func() { atomic.AddInt32(&dead, 1) })
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		k.Received()
+	}
+	if atomic.LoadInt32(&sent) == 0 {
+		t.Errorf("Expect keepalives sent")
+	}
+	if atomic.LoadInt32(&dead) != 0 {
+		t.Errorf("Expect peer alive but got %d reconnects", dead)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&dead) == 0 {
+		t.Errorf("Expect silent peer regarded as dead")
+	}
+}
+
+func TestUDPKeepalive(t *testing.T) {
+	opts := &TunnelOptions{ keepalive: 20 * time.Millisecond, peerTimeout: 100 * time.Millisecond }
+	server, err := UDPListen("127.0.0.1", 11115, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(Tunnel, []byte) {})
+	client, err := UDPConnect("127.0.0.1", 11115, opts)
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	client.SetHandler(func(Tunnel, []byte) {})
+
+	time.Sleep(300 * time.Millisecond)
+	lastReceived := atomic.LoadInt64(&client.(*UDPTunnelImpl).keepalive.lastReceived)
+	if silent := time.Duration(time.Now().UnixNano() - lastReceived); silent > 100 * time.Millisecond {
+		t.Errorf("Expect keepalives acknowledged but nothing heard for %v", silent)
+	}
+	if len(server.(*UDPTunnelImpl).sessions.Sessions()) != 1 {
+		t.Errorf("Expect keepalives to create the session of the client")
+	}
+}
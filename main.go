@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/ini.v1"
+	"os"
 	"runtime"
+	"time"
 )
 
 var (
@@ -26,6 +28,18 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "explain" {
+		// logs of loading the lists are kept apart from the explanations
+		Info.SetOutput(os.Stderr)
+		Warning.SetOutput(os.Stderr)
+		Error.SetOutput(os.Stderr)
+		if err := runExplain(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	if !serverMode && !clientMode {
@@ -45,14 +59,24 @@ func main() {
 		return
 	}
 
+	if err := configureQueues(cfg.Section("common")); err != nil {
+		fmt.Printf("Bad config: %s\n", err)
+		return
+	}
+
 	var device TunTap
 	mode := cfg.Section("common").Key("mode").String()
 	name := cfg.Section("common").Key("device").String()
+	queues := cfg.Section("common").Key("device_queues").MustInt(1)
 	fmt.Printf("tuntap mode: %s, device: %s\n", mode, name)
 	if mode == "tun" {
-		device, err = StartTun(name)
+		device, err = StartTun(name, queues)
 	} else if mode == "tap" {
-		device, err = StartTap(name)
+		if device, err = StartTap(name, queues); err == nil {
+			device, err = NewEthernetDevice(device)
+		}
+	} else if mode == "bridge" {
+		device, err = StartTap(name, queues)
 	} else {
 		fmt.Printf("Bad mode: %s\n", mode)
 		return
@@ -69,13 +93,22 @@ func main() {
 	defer watcher.Close()
 
 	fmt.Printf("Runtime OS: %s\n", runtime.GOOS)
+	if address := cfg.Section("common").Key("metrics_listen").String(); address != "" {
+		if err := StartMetrics(address); err != nil {
+			fmt.Printf("Failed to serve metrics: %s\n", err)
+			return
+		}
+	}
 	if clientMode {
 		startClient(device, cfg.Section("common"), cfg.Section("client"), watcher)
 	} else {
 		startServer(device, cfg.Section("common"), cfg.Section("server"))
 	}
 
-	//go metrics.Log(metrics.DefaultRegistry, 5 * time.Second, log.New(os.Stderr, "metrics: ", log.Lmicroseconds))
+	statsInterval := cfg.Section("common").Key("stats_interval").MustInt(60)
+	if statsInterval > 0 {
+		go LogCounters(time.Duration(statsInterval) * time.Second)
+	}
 
 	q := make(chan int)
 	_ = <- q
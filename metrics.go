@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// metricsNamespace prefixes the names exported, as they sit among the
+// metrics of every other exporter scraped
+const metricsNamespace = "gotun_"
+
+var metricsHelpEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+type metricSample struct {
+	name string
+	help string
+	kind string
+	value string
+}
+
+// WriteMetrics writes every counter and gauge in the Prometheus text format
+func WriteMetrics(w io.Writer) error {
+	var samples []metricSample
+	for _, c := range AllCounters() {
+		samples = append(samples, metricSample{ c.name, c.help, "counter", fmt.Sprint(c.Value()) })
+	}
+	for _, g := range AllGauges() {
+		samples = append(samples, metricSample{ g.name, g.help, "gauge", fmt.Sprint(g.Value()) })
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].name < samples[j].name
+	})
+	for _, s := range samples {
+		name := metricsNamespace + s.name
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+			name, metricsHelpEscaper.Replace(s.help), name, s.kind, name, s.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := WriteMetrics(w); err != nil {
+		Debug.Printf("Failed to write metrics: %v\n", err)
+	}
+}
+
+// StartMetrics serves the metrics at /metrics of address for Prometheus to
+// scrape
+func StartMetrics(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			Error.Printf("Metrics server stopped: %v\n", err)
+		}
+	}()
+	Info.Printf("Serving metrics at http://%v/metrics\n", listener.Addr())
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := NewCounter("test_metrics_total", "Counted by\na test")
+	c.Add(3)
+	size := 7
+	NewGaugeFunc("test_metrics_size", "Read from a func", func() int64 { return int64(size) })
+
+	var sb strings.Builder
+	if err := WriteMetrics(&sb); err != nil {
+		t.Fatalf("Expect metrics written but got %v\n", err)
+	}
+	for _, expect := range []string{
+		"# HELP gotun_test_metrics_total Counted by\\na test\n# TYPE gotun_test_metrics_total counter\ngotun_test_metrics_total 3\n",
+		"# TYPE gotun_test_metrics_size gauge\ngotun_test_metrics_size 7\n",
+		"# TYPE gotun_tunnel_to_device_bytes_total counter\n",
+	} {
+		if !strings.Contains(sb.String(), expect) {
+			t.Errorf("Expect %q in metrics but got:\n%s", expect, sb.String())
+		}
+	}
+
+	size = 8
+	recorder := httptest.NewRecorder()
+	serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expect Prometheus text format but got %s\n", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "gotun_test_metrics_size 8\n") {
+		t.Errorf("Expect gauge read again but got:\n%s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+var mssClamped = NewCounter("tcp_mss_clamped_total", "TCP SYN segments whose MSS was lowered to fit into the tunnel")
+
+// payloadSizer is implemented by tunnels which carry packets up to a size
+// without fragmenting them
+type payloadSizer interface {
+
+	payloadMTU() int
+
+}
+
+// tunnelPayloadMTU is the largest packet tunnel carries whole, 0 if unlimited
+func tunnelPayloadMTU(tunnel Tunnel) int {
+	if sizer, ok := tunnel.(payloadSizer); ok {
+		return sizer.payloadMTU()
+	}
+	return 0
+}
+
+// isTCPSyn tells whether packet is a TCP SYN or SYN-ACK without decoding it
+func isTCPSyn(packet []byte) bool {
+	var segment []byte
+	if len(packet) >= 20 && packet[0] >> 4 == 4 && packet[9] == 6 {
+		// the header length comes from the peer, it may point anywhere
+		headerLength := int(packet[0] & 0x0f) * 4
+		if headerLength < 20 || headerLength > len(packet) {
+			return false
+		}
+		segment = packet[headerLength:]
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 && packet[6] == 6 {
+		segment = packet[40:]
+	}
+	return len(segment) >= 20 && segment[13] & 0x02 != 0
+}
+
+// clampMSS lowers the MSS option of a TCP SYN so that full segments fit into
+// packets of mtu bytes, it tells whether the packet is changed
+func clampMSS(h *packetHeader, mtu int) bool {
+	if mtu <= 0 || h.transport == 0 || h.protocol != 6 {
+		return false
+	}
+	segment := h.packet[h.transport:]
+	dataOffset := int(segment[12] >> 4) * 4
+	if segment[13] & 0x02 == 0 || dataOffset < 20 || dataOffset > len(segment) {
+		return false
+	}
+	mss := mtu - 20 - 20
+	if h.v6 {
+		mss = mtu - 40 - 20
+	}
+	for i := 20; i < dataOffset; {
+		switch segment[i] {
+		case 0:
+			return false
+		case 1:
+			i++
+			continue
+		}
+		if i + 1 >= dataOffset || segment[i + 1] < 2 || i + int(segment[i + 1]) > dataOffset {
+			return false
+		}
+		if segment[i] != 2 || segment[i + 1] != 4 {
+			i += int(segment[i + 1])
+			continue
+		}
+		if int(binary.BigEndian.Uint16(segment[i + 2:])) <= mss {
+			return false
+		}
+		// the checksum is updated by the 16 bits words the MSS lies in
+		from, to := (i + 2) &^ 1, (i + 5) &^ 1
+		var old [4]byte
+		copy(old[:], segment[from:to])
+		binary.BigEndian.PutUint16(segment[i + 2:], uint16(mss))
+		checksum := checksumUpdate(binary.BigEndian.Uint16(segment[16:]), old[:to - from], segment[from:to])
+		binary.BigEndian.PutUint16(segment[16:], checksum)
+		mssClamped.Inc()
+		return true
+	}
+	return false
+}
+
+// clampPacketMSS clamps the MSS of content in place to fit into tunnel if it
+// is a TCP SYN, content is returned
+func clampPacketMSS(content []byte, tunnel Tunnel) []byte {
+	var header packetHeader
+	if isTCPSyn(content) && parseHeader(content, &header) {
+		clampMSS(&header, tunnelPayloadMTU(tunnel))
+	}
+	return content
+}
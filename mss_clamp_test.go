@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+type sizedTunnel struct {
+	fakeTunnel
+	mtu int
+}
+
+func (t *sizedTunnel) payloadMTU() int {
+	return t.mtu
+}
+
+func tcpSegment(v6, syn, ack bool, mss uint16) []byte {
+	tcp := &layers.TCP{ SrcPort: 40000, DstPort: 443, Seq: 1, SYN: syn, ACK: ack, Window: 65535 }
+	if mss != 0 {
+		option := layers.TCPOption{ OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: make([]byte, 2) }
+		binary.BigEndian.PutUint16(option.OptionData, mss)
+		tcp.Options = append(tcp.Options, option)
+	}
+	var network gopacket.SerializableLayer
+	if v6 {
+		ipv6 := &layers.IPv6{ Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2") }
+		tcp.SetNetworkLayerForChecksum(ipv6)
+		network = ipv6
+	} else {
+		ipv4 := &layers.IPv4{ Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.IPv4(10, 0, 0, 1).To4(), DstIP: net.IPv4(10, 0, 0, 2).To4() }
+		tcp.SetNetworkLayerForChecksum(ipv4)
+		network = ipv4
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ FixLengths: true, ComputeChecksums: true }
+	if err := gopacket.SerializeLayers(buffer, opts, network, tcp); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func segmentMSS(packet []byte) int {
+	tcp, ok := decodePacket(packet).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return -1
+	}
+	for _, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindMSS {
+			return int(binary.BigEndian.Uint16(option.OptionData))
+		}
+	}
+	return 0
+}
+
+// checksumValid recomputes the checksum of packet, which must come out the same
+func checksumValid(packet []byte) bool {
+	return string(recomputeChecksums(packet)) == string(packet)
+}
+
+func TestIsTCPSyn(t *testing.T) {
+	bogusIHL := copyBytes(tcpSegment(false, true, false, 1460)[:24])
+	bogusIHL[0] = 0x4f
+	shortIHL := tcpSegment(false, true, false, 1460)
+	shortIHL[0] = 0x41
+	tests := []struct {
+		packet []byte
+		expect bool
+	}{
+		{ tcpSegment(false, true, false, 1460), true },
+		{ tcpSegment(false, true, true, 1460), true },
+		{ tcpSegment(false, false, true, 0), false },
+		{ tcpSegment(true, true, false, 1440), true },
+		{ tcpSegment(true, false, true, 0), false },
+		{ []byte{ 0x45, 0 }, false },
+		{ nil, false },
+		{ bogusIHL, false },
+		{ shortIHL, false },
+	}
+	for i, test := range tests {
+		if got := isTCPSyn(test.packet); got != test.expect {
+			t.Errorf("Expect %v for packet %d but got %v\n", test.expect, i, got)
+		}
+	}
+}
+
+// TestClampMalformed feeds packets a peer may forge, which must be passed
+// on untouched rather than crash the reader
+func TestClampMalformed(t *testing.T) {
+	syn := tcpSegment(false, true, false, 1460)
+	bogusIHL := copyBytes(syn[:24])
+	bogusIHL[0] = 0x4f
+	shortIHL := copyBytes(syn)
+	shortIHL[0] = 0x41
+	badOffset := copyBytes(syn)
+	badOffset[20 + 12] = 0xf0
+	tests := [][]byte{
+		bogusIHL,
+		shortIHL,
+		badOffset,
+		syn[:20],
+		syn[:33],
+		tcpSegment(true, true, false, 1440)[:50],
+	}
+	tunnel := &sizedTunnel{ mtu: 1400 }
+	for i, packet := range tests {
+		original := copyBytes(packet)
+		clampPacketMSS(packet, tunnel)
+		if string(packet) != string(original) {
+			t.Errorf("Expect malformed packet %d untouched\n", i)
+		}
+	}
+}
+
+func TestClampPacketMSS(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		mtu int
+		expect int
+	}{
+		// 1400 - 20 - 20
+		{ tcpSegment(false, true, false, 1460), 1400, 1360 },
+		{ tcpSegment(false, true, true, 1460), 1400, 1360 },
+		// 1400 - 40 - 20
+		{ tcpSegment(true, true, false, 1440), 1400, 1340 },
+		// small enough already
+		{ tcpSegment(false, true, false, 1200), 1400, 1200 },
+		// unknown payload MTU
+		{ tcpSegment(false, true, false, 1460), 0, 1460 },
+		{ tcpSegment(false, true, false, 0), 1400, 0 },
+	}
+	for i, test := range tests {
+		packet := clampPacketMSS(copyBytes(test.packet), &sizedTunnel{ mtu: test.mtu })
+		if got := segmentMSS(packet); got != test.expect {
+			t.Errorf("Expect MSS %d of packet %d but got %d\n", test.expect, i, got)
+		}
+		if !checksumValid(packet) {
+			t.Errorf("Expect valid checksum of packet %d\n", i)
+		}
+	}
+
+	// the MSS at an odd offset spans two 16 bits words of the checksum
+	tcp := &layers.TCP{ SrcPort: 40000, DstPort: 443, SYN: true, Window: 65535, Options: []layers.TCPOption{
+		{ OptionType: layers.TCPOptionKindNop, OptionLength: 1 },
+		{ OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{ 0x05, 0xb4 } },
+	} }
+	ipv4 := &layers.IPv4{ Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.IPv4(10, 0, 0, 1).To4(), DstIP: net.IPv4(10, 0, 0, 2).To4() }
+	_ = tcp.SetNetworkLayerForChecksum(ipv4)
+	buffer := gopacket.NewSerializeBuffer()
+	_ = gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{ FixLengths: true, ComputeChecksums: true }, ipv4, tcp)
+	odd := clampPacketMSS(buffer.Bytes(), &sizedTunnel{ mtu: 1400 })
+	if got := segmentMSS(odd); got != 1360 || !checksumValid(odd) {
+		t.Errorf("Expect MSS 1360 with valid checksum but got %d, % x\n", got, odd)
+	}
+
+	ack := tcpSegment(false, false, true, 0)
+	if got := clampPacketMSS(ack, &sizedTunnel{ mtu: 1000 }); string(got) != string(ack) {
+		t.Errorf("Expect packet other than SYN untouched but got % x\n", got)
+	}
+	syn := tcpSegment(false, true, false, 1460)
+	if got := clampPacketMSS(syn, &fakeTunnel{}); string(got) != string(syn) {
+		t.Errorf("Expect SYN untouched through tunnel of unknown MTU but got % x\n", got)
+	}
+}
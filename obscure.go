@@ -44,7 +44,25 @@ func fastXor(dst, src, key []byte) {
 	xor(dst[current:], src[current:], key)
 }
 
+// samePlace tells whether a and b start at the same byte, so that copying b
+// to a can be skipped
+func samePlace(a, b []byte) bool {
+	return len(a) > 0 && len(b) > 0 && &a[0] == &b[0]
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func obscure(mss int, packet []byte) ([]byte, error) {
+	return obscureTo(nil, mss, packet)
+}
+
+// obscureTo obscures packet into dst if it has room, in place if packet lies
+// at dst[8:] and the padding goes last
+func obscureTo(dst []byte, mss int, packet []byte) ([]byte, error) {
 	packetLength := len(packet)
 	remainLength := mss - 8 - len(packet)
 	if remainLength < 0 {
@@ -55,37 +73,45 @@ func obscure(mss int, packet []byte) ([]byte, error) {
 	if doPadding {
 		padLength = rand.Intn(256)
 	}
-	var ret []byte
+	length := 8 + packetLength
 	if doPadding {
-		ret = make([]byte, 8 + packetLength + 1 + padLength)
-	} else {
-		ret = make([]byte, 8 + packetLength)
+		length += 1 + padLength
 	}
+	if cap(dst) < length {
+		dst = make([]byte, length)
+	}
+	ret := dst[:length]
 
 	key := rand.Uint32()
-	binary.BigEndian.PutUint32(ret, key)
+	placePadFirst := key & 0x80000000 != 0
+	offset := 8
+	if doPadding && placePadFirst {
+		offset = 8 + 1 + padLength
+	}
+	// the payload is moved first as the header may overlap where it was
+	encrypted := ret[offset:offset+packetLength]
+	if !samePlace(encrypted, packet) {
+		copy(encrypted, packet)
+	}
 
-	placePadFirst := (ret[0] & 0x80) != 0
+	binary.BigEndian.PutUint32(ret, key)
+	// buffers may be reused, nothing but zeros must be sent in the clear
+	zeroBytes(ret[4:8])
 	if doPadding != placePadFirst {
 		ret[0] = ret[0] | 0x40
 	} else {
 		ret[0] = ret[0] & 0xBF
 	}
 
-	var encrypted []byte
-	if !doPadding || (doPadding && !placePadFirst) {
-		fastXor(ret[8:], packet, ret[0:4])
-		if doPadding {
-			ret[len(ret)-1] = byte(padLength)
-		}
-		encrypted = ret[8:8+packetLength]
-	} else {
-		fastXor(ret[8+1+padLength:], packet, ret[0:4])
+	fastXor(encrypted, encrypted, ret[0:4])
+	if doPadding && !placePadFirst {
+		zeroBytes(ret[8+packetLength:len(ret)-1])
+		ret[len(ret)-1] = byte(padLength)
+	} else if doPadding {
 		ret[8] = byte(padLength)
-		encrypted = ret[8+1+padLength:8+1+padLength+packetLength]
+		zeroBytes(ret[9:offset])
 	}
 
-	_ = encrypted
 	//sha := sha256.Sum256(encrypted)
 	//toUint32Array(ret[4:])[0] = toUint32Array(sha[:])[0]
 
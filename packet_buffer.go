@@ -0,0 +1,54 @@
+package main
+
+// packetBufferSize fits the largest packet read from a device, obscured with
+// the largest padding, so that packets are sealed where they are copied to
+const (
+	packetBufferSize = 2048
+	// packetBuffersKept bounds the buffers idle in the pool
+	packetBuffersKept = 4096
+)
+
+var packetBuffersAllocated = NewCounter("packet_buffers_allocated_total", "Packet buffers allocated for the pool running short")
+
+// The pool is a free list rather than sync.Pool, putting a slice into an
+// interface would allocate on every put
+var packetBuffers = make(chan []byte, packetBuffersKept)
+
+// getPacketBuffer returns a buffer of packetBufferSize bytes, to be handed
+// back with putPacketBuffer once written out
+func getPacketBuffer() []byte {
+	select {
+	case buf := <-packetBuffers:
+		return buf
+	default:
+		packetBuffersAllocated.Inc()
+		return make([]byte, packetBufferSize)
+	}
+}
+
+// putPacketBuffer takes buf back unless it is not of the pool, e.g. grown for
+// a packet too large. buf must not be used afterwards
+func putPacketBuffer(buf []byte) {
+	if cap(buf) != packetBufferSize {
+		return
+	}
+	select {
+	case packetBuffers <- buf[:packetBufferSize]:
+	default:
+	}
+}
+
+// packetBufferOf returns a pooled buffer of length bytes if it fits
+func packetBufferOf(length int) []byte {
+	if length > packetBufferSize {
+		return make([]byte, length)
+	}
+	return getPacketBuffer()[:length]
+}
+
+// copyToPacketBuffer copies content into a pooled buffer if it fits
+func copyToPacketBuffer(content []byte) []byte {
+	buf := packetBufferOf(len(content))
+	copy(buf, content)
+	return buf
+}
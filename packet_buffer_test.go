@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestPacketBuffer(t *testing.T) {
+	buf := getPacketBuffer()
+	if len(buf) != packetBufferSize {
+		t.Fatalf("Expect buffer of %d bytes but got %d\n", packetBufferSize, len(buf))
+	}
+	putPacketBuffer(buf[:10])
+	// buffers not of the pool are not taken
+	putPacketBuffer(make([]byte, 100))
+	if got := packetBufferOf(3000); len(got) != 3000 {
+		t.Errorf("Expect buffer of 3000 bytes but got %d\n", len(got))
+	}
+	content := []byte("hello")
+	if got := copyToPacketBuffer(content); !bytes.Equal(got, content) || cap(got) != packetBufferSize {
+		t.Errorf("Expect %q in a pooled buffer but got %q of %d\n", content, got, cap(got))
+	}
+}
+
+func TestObscureTo(t *testing.T) {
+	aead, _ := NewAEADObscurer("secret")
+	for _, obscurer := range []Obscurer{ xorObscurer{}, aead } {
+		for n := 0; n < 100; n++ {
+			p := make([]byte, rand.Intn(1400) + 1)
+			rand.Read(p)
+			dst := getPacketBuffer()
+			// dirty buffers must not leak into padding
+			for i := range dst {
+				dst[i] = 0xff
+			}
+			var packet []byte
+			switch n % 3 {
+			case 0:
+				packet = p
+			case 1:
+				// in place, behind the nonce or the xor key
+				header := 8
+				if obscurer == Obscurer(aead) {
+					header = aeadNonceSize
+				}
+				packet = dst[header:header + len(p)]
+				copy(packet, p)
+			case 2:
+				// overlapping where the header goes
+				packet = dst[:len(p)]
+				copy(packet, p)
+			}
+			obscured, err := obscurer.ObscureTo(dst, 1500 - 28, packet)
+			if err != nil {
+				t.Fatalf("Failed to obscure %d bytes: %v\n", len(p), err)
+			}
+			if !samePlace(obscured, dst) {
+				t.Errorf("Expect %d bytes obscured into dst\n", len(p))
+			}
+			restored, _, err := obscurer.Restore(obscured)
+			if err != nil || !bytes.Equal(restored, p) {
+				t.Errorf("Failed to restore %d bytes obscured by %T case %d: %v\n", len(p), obscurer, n % 3, err)
+			}
+			putPacketBuffer(dst)
+		}
+	}
+
+	// dst short of room is not used
+	obscured, _ := aead.ObscureTo(make([]byte, 10), 1500, make([]byte, 100))
+	if restored, _, err := aead.Restore(obscured); err != nil || len(restored) != 100 {
+		t.Errorf("Expect 100 bytes restored but got %d, %v\n", len(restored), err)
+	}
+}
+
+func benchmarkObscure(b *testing.B, obscurer Obscurer, pooled bool) {
+	packet := make([]byte, 1400)
+	rand.Read(packet)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	for i := 0; i < b.N; i++ {
+		if pooled {
+			buf := getPacketBuffer()
+			obscured, _ := obscurer.ObscureTo(buf, 1472, packet)
+			putPacketBuffer(obscured)
+		} else {
+			_, _ = obscurer.Obscure(1472, packet)
+		}
+	}
+}
+
+func BenchmarkObscureXor(b *testing.B) {
+	benchmarkObscure(b, xorObscurer{}, false)
+}
+
+func BenchmarkObscureXorPooled(b *testing.B) {
+	benchmarkObscure(b, xorObscurer{}, true)
+}
+
+func BenchmarkObscureAEAD(b *testing.B) {
+	aead, _ := NewAEADObscurer("secret")
+	benchmarkObscure(b, aead, false)
+}
+
+func BenchmarkObscureAEADPooled(b *testing.B) {
+	aead, _ := NewAEADObscurer("secret")
+	benchmarkObscure(b, aead, true)
+}
+
+var benchUDPClient Tunnel
+
+// BenchmarkUDPSend covers a packet from the device handler to WriteBatch, the
+// tunnel is set up once as the benchmark runs several times
+func BenchmarkUDPSend(b *testing.B) {
+	if benchUDPClient == nil {
+		server, err := UDPListen("127.0.0.1", 11123, nil)
+		if err != nil {
+			b.Fatalf("Failed to listen: %v\n", err)
+		}
+		server.SetHandler(func (Tunnel, []byte) {})
+		if benchUDPClient, err = UDPConnect("127.0.0.1", 11123, nil); err != nil {
+			b.Fatalf("Failed to connect: %v\n", err)
+		}
+	}
+	packet := make([]byte, 1400)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		benchUDPClient.Send(packet)
+	}
+}
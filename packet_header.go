@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// packetHeader is an IPv4 or IPv6 packet parsed only as far as routing it
+// takes, without allocating. The addresses alias the packet, which is
+// rewritten in place with its checksums updated rather than recomputed
+type packetHeader struct {
+	packet []byte
+	v6 bool
+	protocol byte
+	src net.IP
+	dst net.IP
+	// transport is the offset of the TCP, UDP or ICMPv6 header, 0 if there is
+	// none such as in fragments other than the first
+	transport int
+	srcPort uint16
+	dstPort uint16
+}
+
+// transportHeaderLength is the least a header of protocol takes, 0 for the
+// protocols whose checksum does not cover the addresses
+func transportHeaderLength(v6 bool, protocol byte) int {
+	switch protocol {
+	case 6:
+		return 20
+	case 17:
+		return 8
+	case 58:
+		if v6 {
+			return 4
+		}
+	}
+	return 0
+}
+
+// parseHeader parses packet into h and tells whether it is an IP packet at
+// all. IPv6 extension headers are not walked, packets carrying them are
+// routed by their addresses only
+func parseHeader(packet []byte, h *packetHeader) bool {
+	*h = packetHeader{ packet: packet }
+	transport := 0
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		headerLength := int(packet[0] & 0x0f) * 4
+		if headerLength < 20 || len(packet) < headerLength {
+			return false
+		}
+		h.protocol = packet[9]
+		h.src, h.dst = packet[12:16], packet[16:20]
+		if binary.BigEndian.Uint16(packet[6:]) & 0x1fff == 0 {
+			transport = headerLength
+		}
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		h.v6 = true
+		h.protocol = packet[6]
+		h.src, h.dst = packet[8:24], packet[24:40]
+		transport = 40
+	} else {
+		return false
+	}
+	length := transportHeaderLength(h.v6, h.protocol)
+	if transport == 0 || length == 0 || len(packet) < transport + length {
+		return true
+	}
+	h.transport = transport
+	if h.protocol == 6 || h.protocol == 17 {
+		h.srcPort = binary.BigEndian.Uint16(packet[transport:])
+		h.dstPort = binary.BigEndian.Uint16(packet[transport + 2:])
+	}
+	return true
+}
+
+// hasPorts tells whether the ports are parsed, i.e. of a TCP or UDP packet
+func (h *packetHeader) hasPorts() bool {
+	return h.transport != 0 && (h.protocol == 6 || h.protocol == 17)
+}
+
+func (h *packetHeader) isUDP() bool {
+	return h.transport != 0 && h.protocol == 17
+}
+
+// dns returns the DNS message of a UDP packet from or to port 53, nil for
+// other packets
+func (h *packetHeader) dns() dnsMessage {
+	if !h.isUDP() || (h.srcPort != 53 && h.dstPort != 53) {
+		return nil
+	}
+	end := h.transport + int(binary.BigEndian.Uint16(h.packet[h.transport + 4:]))
+	if end < h.transport + 8 || end > len(h.packet) {
+		return nil
+	}
+	if msg := dnsMessage(h.packet[h.transport + 8:end]); len(msg) >= dnsHeaderLength {
+		return msg
+	}
+	return nil
+}
+
+// setSrc rewrites the source address, ip must be of the version of the packet
+func (h *packetHeader) setSrc(ip net.IP) bool {
+	return h.rewrite(h.src, ip)
+}
+
+// setDst rewrites the destination address, ip must be of the version of the packet
+func (h *packetHeader) setDst(ip net.IP) bool {
+	return h.rewrite(h.dst, ip)
+}
+
+func (h *packetHeader) rewrite(addr, ip net.IP) bool {
+	if h.v6 {
+		if ip.To4() != nil {
+			return false
+		}
+		ip = ip.To16()
+	} else {
+		ip = ip.To4()
+	}
+	if addr == nil || ip == nil {
+		return false
+	}
+	if !h.v6 {
+		checksum := binary.BigEndian.Uint16(h.packet[10:])
+		binary.BigEndian.PutUint16(h.packet[10:], checksumUpdate(checksum, addr, ip))
+	}
+	// the pseudo header the transport checksum covers has the addresses
+	if h.transport != 0 {
+		at := h.transport + 16
+		if h.protocol == 17 {
+			at = h.transport + 6
+		} else if h.protocol == 58 {
+			at = h.transport + 2
+		}
+		checksum := binary.BigEndian.Uint16(h.packet[at:])
+		// UDP over IPv4 may go without checksum, which is left as it is
+		if h.protocol != 17 || h.v6 || checksum != 0 {
+			checksum = checksumUpdate(checksum, addr, ip)
+			if checksum == 0 && h.protocol == 17 {
+				checksum = 0xffff
+			}
+			binary.BigEndian.PutUint16(h.packet[at:], checksum)
+		}
+	}
+	copy(addr, ip)
+	return true
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+)
+
+var decodeOptions = gopacket.DecodeOptions{
+	Lazy: true,
+	NoCopy: true,
+	SkipDecodeRecovery: true,
+}
+
+func decodePacket(content []byte) gopacket.Packet {
+	if len(content) > 0 && content[0] >> 4 == 6 {
+		return gopacket.NewPacket(content, layers.LayerTypeIPv6, decodeOptions)
+	}
+	return gopacket.NewPacket(content, layers.LayerTypeIPv4, decodeOptions)
+}
+
+// recomputeChecksums serializes packet again through gopacket, computing its
+// checksums from scratch
+func recomputeChecksums(content []byte) []byte {
+	packet := decodePacket(copyBytes(content))
+	network := packet.NetworkLayer()
+	switch transport := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		_ = transport.SetNetworkLayerForChecksum(network)
+	case *layers.UDP:
+		_ = transport.SetNetworkLayerForChecksum(network)
+	}
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		_ = icmp.SetNetworkLayerForChecksum(network)
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{ ComputeChecksums: true, FixLengths: true }
+	if err := gopacket.SerializePacket(buffer, options, packet); err != nil {
+		return nil
+	}
+	return buffer.Bytes()
+}
+
+func udpPacket(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	udp := &layers.UDP{ SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dstPort) }
+	var network gopacket.SerializableLayer
+	if src.To4() == nil {
+		ipv6 := &layers.IPv6{ Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: dst }
+		_ = udp.SetNetworkLayerForChecksum(ipv6)
+		network = ipv6
+	} else {
+		ipv4 := &layers.IPv4{ Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src.To4(), DstIP: dst.To4() }
+		_ = udp.SetNetworkLayerForChecksum(ipv4)
+		network = ipv4
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{ FixLengths: true, ComputeChecksums: true }
+	if err := gopacket.SerializeLayers(buffer, opts, network, udp, gopacket.Payload(payload)); err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestParseHeader(t *testing.T) {
+	fragment := tcpSegment(false, true, false, 1460)
+	fragment[6], fragment[7] = 0x00, 0x10
+	tests := []struct {
+		packet []byte
+		ok bool
+		v6 bool
+		protocol byte
+		srcPort uint16
+		dstPort uint16
+	}{
+		{ tcpSegment(false, true, false, 1460), true, false, 6, 40000, 443 },
+		{ tcpSegment(true, true, false, 1440), true, true, 6, 40000, 443 },
+		{ udpPacket(net.IPv4(10, 0, 0, 1), net.IPv4(8, 8, 8, 8), 5353, 53, []byte("query")), true, false, 17, 5353, 53 },
+		{ udpPacket(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 1, 2, nil), true, true, 17, 1, 2 },
+		// fragments other than the first carry no ports
+		{ fragment, true, false, 6, 0, 0 },
+		{ []byte{ 0x45, 0 }, false, false, 0, 0, 0 },
+		{ nil, false, false, 0, 0, 0 },
+	}
+	for i, test := range tests {
+		var h packetHeader
+		ok := parseHeader(test.packet, &h)
+		if ok != test.ok || h.v6 != test.v6 || h.protocol != test.protocol || h.srcPort != test.srcPort || h.dstPort != test.dstPort {
+			t.Errorf("Expect %v %v %d %d %d of packet %d but got %v %v %d %d %d\n",
+				test.ok, test.v6, test.protocol, test.srcPort, test.dstPort, i, ok, h.v6, h.protocol, h.srcPort, h.dstPort)
+		}
+		if ok && (!h.src.Equal(packetSrcIP(test.packet)) || !h.dst.Equal(packetDstIP(test.packet))) {
+			t.Errorf("Expect addresses of packet %d but got %v to %v\n", i, h.src, h.dst)
+		}
+	}
+}
+
+func TestRewriteAddress(t *testing.T) {
+	noChecksum := udpPacket(net.IPv4(10, 0, 0, 1), net.IPv4(8, 8, 8, 8), 1000, 53, []byte("query"))
+	noChecksum[26], noChecksum[27] = 0, 0
+	tests := []struct {
+		packet []byte
+		src net.IP
+		dst net.IP
+	}{
+		{ tcpSegment(false, true, false, 1460), net.IPv4(192, 168, 1, 2), net.IPv4(1, 2, 3, 4) },
+		{ tcpSegment(true, true, false, 1440), net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::ffff") },
+		{ udpPacket(net.IPv4(10, 0, 0, 1), net.IPv4(8, 8, 8, 8), 1000, 5000, []byte("query")), net.IPv4(10, 0, 0, 255), net.IPv4(114, 114, 114, 114) },
+		{ udpPacket(net.ParseIP("fd00::1"), net.ParseIP("fd00::2"), 1000, 5000, []byte("odd")), net.ParseIP("fd00::3"), net.ParseIP("fe80::4") },
+	}
+	for i, test := range tests {
+		var h packetHeader
+		parseHeader(test.packet, &h)
+		if !h.setSrc(test.src) || !h.setDst(test.dst) {
+			t.Errorf("Expect addresses of packet %d rewritten\n", i)
+			continue
+		}
+		if !packetSrcIP(test.packet).Equal(test.src) || !packetDstIP(test.packet).Equal(test.dst) {
+			t.Errorf("Expect %v to %v of packet %d but got %v to %v\n", test.src, test.dst, i, packetSrcIP(test.packet), packetDstIP(test.packet))
+		}
+		if !checksumValid(test.packet) {
+			t.Errorf("Expect valid checksum of packet %d\n", i)
+		}
+	}
+
+	var h packetHeader
+	parseHeader(noChecksum, &h)
+	h.setDst(net.IPv4(114, 114, 114, 114))
+	if noChecksum[26] != 0 || noChecksum[27] != 0 {
+		t.Errorf("Expect UDP without checksum left without but got % x\n", noChecksum[26:28])
+	}
+	if h.setDst(net.ParseIP("fd00::1")) {
+		t.Errorf("Expect IPv6 address not written into IPv4 packet\n")
+	}
+}
+
+func TestParseHeaderAllocs(t *testing.T) {
+	packet := udpPacket(net.IPv4(10, 0, 0, 1), net.IPv4(8, 8, 8, 8), 1000, 53, make([]byte, dnsHeaderLength))
+	server := net.IPv4(114, 114, 114, 114)
+	allocs := testing.AllocsPerRun(100, func() {
+		var h packetHeader
+		parseHeader(packet, &h)
+		h.setDst(server)
+		h.dns().id()
+	})
+	if allocs != 0 {
+		t.Errorf("Expect no allocation but got %v\n", allocs)
+	}
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	packet := tcpSegment(false, true, false, 1460)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if ipv4, ok := decodePacket(packet).NetworkLayer().(*layers.IPv4); !ok || ipv4.DstIP == nil {
+			b.Fatal("Expect IPv4 packet")
+		}
+	}
+}
+
+func BenchmarkParseHeader(b *testing.B) {
+	packet := tcpSegment(false, true, false, 1460)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var h packetHeader
+		if !parseHeader(packet, &h) || h.dst == nil {
+			b.Fatal("Expect IPv4 packet")
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pmtuProbeHeaderLength is the ctrlPMTUProbe and the size of the IP packet
+// the probe is sent in, zeros pad the probe to that size
+const pmtuProbeHeaderLength = 3
+
+var (
+	// pmtuDefault is the MTU assumed until the path is probed, e.g. of PPPoE
+	pmtuDefault = 1492
+	pmtuMax = 1500
+	pmtuProbeInterval = time.Second
+	// pmtuProbeAttempts is how many times a size is probed before it is regarded as too large
+	pmtuProbeAttempts = 2
+	pmtuRecheckInterval = 10 * time.Minute
+	// pmtuGranularity is how close to the path MTU the search gets
+	pmtuGranularity = 8
+)
+
+var (
+	pmtuProbesSent = NewCounter("pmtu_probes_sent_total", "Path MTU probes sent by clients")
+	pmtuChanges = NewCounter("pmtu_changed_total", "Times a client changed the path MTU in use")
+	pmtuTooLarge = NewCounter("pmtu_too_large_total", "Packets skipped as the kernel refused them as larger than the interface MTU")
+)
+
+func pmtuMin(v6 bool) int {
+	if v6 {
+		return 1280
+	}
+	return 576
+}
+
+// interfaceMTU returns the MTU of the interface ip is on, 0 if it is not found
+func interfaceMTU(ip net.IP) int {
+	if ip == nil || ip.IsUnspecified() {
+		return 0
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
+
+// pmtuProbe builds a probe of length bytes for an IP packet of size bytes
+func pmtuProbe(size, length int) []byte {
+	if length < pmtuProbeHeaderLength {
+		return nil
+	}
+	probe := make([]byte, length)
+	probe[0] = ctrlPMTUProbe
+	binary.BigEndian.PutUint16(probe[1:], uint16(size))
+	return probe
+}
+
+// PathMTU searches the largest IP packet reaching the server by probing sizes
+// in between the largest acknowledged and the smallest lost. As the path may
+// change, the search starts over every pmtuRecheckInterval. Sizes above max,
+// the MTU of the interface, are never probed
+type PathMTU struct {
+	lock sync.Mutex
+	mtu int32
+	min int
+	max int
+	low int
+	high int
+	probing int
+	attempts int
+	acked bool
+	searched time.Time
+	ready func() bool
+	send func(size int)
+	onChange func(mtu int)
+}
+
+// NewPathMTU probes through send once ready tells the server would answer,
+// onChange receives every new MTU found. max is the MTU of the interface, 0 if
+// unknown
+func NewPathMTU(v6 bool, max int, ready func() bool, send func(int), onChange func(int)) *PathMTU {
+	if max <= 0 || max > pmtuMax {
+		max = pmtuMax
+	}
+	if max < pmtuMin(v6) {
+		max = pmtuMin(v6)
+	}
+	mtu := pmtuDefault
+	if mtu > max {
+		mtu = max
+	}
+	p := &PathMTU{ mtu: int32(mtu), min: pmtuMin(v6), max: max, ready: ready, send: send, onChange: onChange }
+	p.restart()
+	go p.loop()
+	return p
+}
+
+// MTU is the largest IP packet to send, pmtuDefault until probed
+func (p *PathMTU) MTU() int {
+	if p == nil {
+		return pmtuDefault
+	}
+	return int(atomic.LoadInt32(&p.mtu))
+}
+
+// Restart searches again at once, e.g. after reconnecting through another path
+func (p *PathMTU) Restart() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.restart()
+}
+
+func (p *PathMTU) restart() {
+	p.low, p.high = p.min, p.max + 1
+	p.probing, p.attempts = 0, 0
+	p.acked = false
+	p.searched = time.Time{}
+}
+
+// Handle takes msg if it is a ctrlPMTUAck and probes the next size at once
+func (p *PathMTU) Handle(msg []byte) bool {
+	if p == nil || len(msg) < pmtuProbeHeaderLength || msg[0] != ctrlPMTUAck {
+		return false
+	}
+	size := int(binary.BigEndian.Uint16(msg[1:]))
+	p.lock.Lock()
+	probe, changed := 0, 0
+	if size == p.probing {
+		p.low, p.acked = size, true
+		p.probing, p.attempts = 0, 0
+		probe, changed = p.next(time.Now())
+	}
+	p.lock.Unlock()
+	p.act(probe, changed)
+	return true
+}
+
+// TooLarge takes a packet of size bytes the kernel refused to send as larger
+// than the interface MTU, sizes from it on are not probed any more. If the MTU
+// in use is not below, the largest size known to pass is used until searched
+// again
+func (p *PathMTU) TooLarge(size int) {
+	pmtuTooLarge.Inc()
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	changed := 0
+	if size <= p.max {
+		p.max = size - 1
+	}
+	if size < p.high {
+		p.high = size
+	}
+	if p.probing >= size {
+		p.probing, p.attempts = 0, 0
+	}
+	if p.low >= size {
+		p.low, p.acked = p.min, false
+	}
+	if p.MTU() >= size {
+		changed = p.min
+		if p.acked {
+			changed = p.low
+		}
+		atomic.StoreInt32(&p.mtu, int32(changed))
+		pmtuChanges.Inc()
+		Warning.Printf("Packet of %d bytes is larger than the interface, path MTU is %d until searched again\n", size, changed)
+		p.searched = time.Time{}
+	}
+	p.lock.Unlock()
+	p.act(0, changed)
+}
+
+// next chooses the size to probe, the largest one first as most paths take
+// it and then pmtuDefault. Once the search is over the MTU found is returned
+func (p *PathMTU) next(now time.Time) (int, int) {
+	if p.high - p.low <= pmtuGranularity {
+		p.searched = now
+		if !p.acked {
+			Warning.Printf("No path MTU probe answered, keep %d\n", p.MTU())
+			return 0, 0
+		}
+		if p.low == p.MTU() {
+			return 0, 0
+		}
+		atomic.StoreInt32(&p.mtu, int32(p.low))
+		pmtuChanges.Inc()
+		Info.Printf("Path MTU is %d\n", p.low)
+		return 0, p.low
+	}
+	size := (p.low + p.high) / 2
+	if p.high > p.max {
+		size = p.max
+	} else if p.low < pmtuDefault && pmtuDefault < p.high {
+		size = pmtuDefault
+	}
+	p.probing, p.attempts = size, 1
+	return size, 0
+}
+
+// tick probes again or moves on if the probe in flight is lost
+func (p *PathMTU) tick(now time.Time) (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.searched.IsZero() {
+		if now.Sub(p.searched) < pmtuRecheckInterval {
+			return 0, 0
+		}
+		p.restart()
+	}
+	if !p.ready() {
+		return 0, 0
+	}
+	if p.probing != 0 {
+		if p.attempts < pmtuProbeAttempts {
+			p.attempts++
+			return p.probing, 0
+		}
+		p.high, p.probing = p.probing, 0
+	}
+	return p.next(now)
+}
+
+func (p *PathMTU) act(probe, changed int) {
+	if probe != 0 {
+		pmtuProbesSent.Inc()
+		p.send(probe)
+	}
+	if changed != 0 && p.onChange != nil {
+		p.onChange(changed)
+	}
+}
+
+func (p *PathMTU) loop() {
+	for now := range time.Tick(pmtuProbeInterval) {
+		p.act(p.tick(now))
+	}
+}
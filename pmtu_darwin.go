@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// not exported by package syscall on darwin
+const (
+	ipDontFrag = 28
+	ipv6DontFrag = 62
+)
+
+// setDontFragment makes conn send with DF set, so that probes larger than the
+// path are lost instead of fragmented
+func setDontFragment(conn syscall.Conn, v6 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6DontFrag, 1)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipDontFrag, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// SetDeviceMTU changes the MTU of the device only
+func SetDeviceMTU(name string, mtu int) error {
+	return runCommand("ifconfig", name, "mtu", strconv.Itoa(mtu))
+}
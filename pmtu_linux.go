@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// setDontFragment makes conn send with DF set regardless of the path MTU the
+// kernel learned, so that probes larger than the path are lost instead of
+// fragmented
+func setDontFragment(conn syscall.Conn, v6 bool) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if v6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// SetDeviceMTU changes the MTU of the device only
+func SetDeviceMTU(name string, mtu int) error {
+	return runCommand("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+}
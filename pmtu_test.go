@@ -0,0 +1,168 @@
+package main
+
+import (
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestPathMTU(path int) (*PathMTU, *int) {
+	var probes []int
+	changed := 0
+	var p *PathMTU
+	p = &PathMTU{
+		mtu: int32(pmtuDefault),
+		min: pmtuMin(false),
+		max: pmtuMax,
+		ready: func() bool { return true },
+		send: func(size int) { probes = append(probes, size) },
+		onChange: func(mtu int) { changed = mtu },
+	}
+	p.restart()
+	now := time.Now()
+	for i := 0; i < 100 && p.searched.IsZero(); i++ {
+		p.act(p.tick(now))
+		for len(probes) > 0 {
+			size := probes[0]
+			probes = probes[1:]
+			if size <= path {
+				p.Handle([]byte{ ctrlPMTUAck, byte(size >> 8), byte(size) })
+			}
+		}
+	}
+	return p, &changed
+}
+
+func TestPathMTU(t *testing.T) {
+	for _, path := range []int{ 1500, 1492, 1400, 1280, 600 } {
+		p, changed := newTestPathMTU(path)
+		if p.searched.IsZero() {
+			t.Errorf("Expect search over a path of %d finished", path)
+			continue
+		}
+		if mtu := p.MTU(); mtu > path || mtu < path - pmtuGranularity {
+			t.Errorf("Expect path MTU close to %d but got %d", path, mtu)
+		}
+		if p.MTU() != pmtuDefault && *changed != p.MTU() {
+			t.Errorf("Expect change to %d notified but got %d", p.MTU(), *changed)
+		}
+		if probe, _ := p.tick(time.Now().Add(time.Minute)); probe != 0 {
+			t.Errorf("Expect no probe before recheck but got %d", probe)
+		}
+		if probe, _ := p.tick(time.Now().Add(pmtuRecheckInterval + time.Minute)); probe != pmtuMax {
+			t.Errorf("Expect search started over with %d but got %d", pmtuMax, probe)
+		}
+	}
+
+	// nothing answered keeps the MTU
+	if p, changed := newTestPathMTU(0); p.MTU() != pmtuDefault || *changed != 0 {
+		t.Errorf("Expect %d kept without answers but got %d", pmtuDefault, p.MTU())
+	}
+}
+
+func TestUDPPathMTU(t *testing.T) {
+	pmtuProbeInterval = 10 * time.Millisecond
+	defer func() { pmtuProbeInterval = time.Second }()
+	server, err := UDPListen("127.0.0.1", 11119, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(Tunnel, []byte) {})
+	mtus := make(chan int, 1)
+	client, err := UDPConnect("127.0.0.1", 11119, &TunnelOptions{ pmtu: true, onMTU: func(mtu int) { mtus <- mtu } })
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	client.SetHandler(func(Tunnel, []byte) {})
+
+	select {
+	case mtu := <-mtus:
+		// loopback takes the largest probe
+		if expect := pmtuMax - 20 - 8 - 8; mtu != expect {
+			t.Errorf("Expect payload MTU %d but got %d", expect, mtu)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expect path MTU probed")
+	}
+}
+
+// tooLargeConn refuses messages larger than mtu as the kernel does
+type tooLargeConn struct {
+	mtu int
+	sent []int
+}
+
+func (c *tooLargeConn) ReadBatch([]ipv4.Message, int) (int, error) {
+	return 0, nil
+}
+
+func (c *tooLargeConn) WriteBatch(ms []ipv4.Message, _ int) (int, error) {
+	for i, m := range ms {
+		if len(m.Buffers[0]) > c.mtu {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, &net.OpError{ Op: "write", Net: "udp", Err: os.NewSyscallError("sendmmsg", syscall.EMSGSIZE) }
+		}
+		c.sent = append(c.sent, len(m.Buffers[0]))
+	}
+	return len(ms), nil
+}
+
+func (c *tooLargeConn) SetBPF([]bpf.RawInstruction) error {
+	return nil
+}
+
+func (c *tooLargeConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *tooLargeConn) Close() error {
+	return nil
+}
+
+func TestPathMTUTooLarge(t *testing.T) {
+	conn := &tooLargeConn{ mtu: 1492 }
+	p := NewPathMTU(false, 0, func() bool { return false }, func(int) {}, nil)
+	var messages []ipv4.Message
+	for _, size := range []int{ 100, 1500, 200, 1500, 300 } {
+		messages = append(messages, ipv4.Message{ Buffers: [][]byte{ make([]byte, size) } })
+	}
+	var refused []int
+	n, err := writeMessages(conn, messages, func(packet []byte) {
+		refused = append(refused, len(packet))
+		p.TooLarge(len(packet))
+	})
+	if n != len(messages) || err != nil {
+		t.Errorf("Expect every message done with but got %d, %v", n, err)
+	}
+	if !reflect.DeepEqual(conn.sent, []int{ 100, 200, 300 }) || !reflect.DeepEqual(refused, []int{ 1500, 1500 }) {
+		t.Errorf("Expect packets after the refused ones sent but got %v sent and %v refused", conn.sent, refused)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if probe, _ := p.next(time.Now()); probe != 1499 {
+		t.Errorf("Expect 1499 probed below the refused size but got %d", probe)
+	}
+	if p.high != 1500 || p.max != 1499 {
+		t.Errorf("Expect sizes from 1500 on left out but got high %d max %d", p.high, p.max)
+	}
+}
+
+func TestNewPathMTUInterface(t *testing.T) {
+	p := NewPathMTU(false, 1400, func() bool { return false }, func(int) {}, nil)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.MTU() != 1400 {
+		t.Errorf("Expect MTU of the interface used until probed but got %d", p.MTU())
+	}
+	if probe, _ := p.next(time.Now()); probe != 1400 {
+		t.Errorf("Expect probing from the MTU of the interface but got %d", probe)
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"golang.org/x/net/bpf"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"net"
 	"strconv"
 	"sync/atomic"
-	"unsafe"
 )
 
 var rawTxLength = 64
@@ -13,20 +14,62 @@ var rawRxLength = 64
 
 type RawTunnelImpl struct {
 	protocol uint8
-	sendCh chan []byte
+	queue *SendQueue
 	handler func (Tunnel, []byte)
-	conn *ipv4.PacketConn
-	destination *net.IPAddr
+	conn atomic.Value
+	v6 bool
+	filter []bpf.RawInstruction
+	destination atomic.Value
 	preConnected bool
+	obscurer Obscurer
+	replay *ReplayWindow
+	sessions *SessionTable
+	handshake *ClientHandshake
+	keepalive *Keepalive
+	remote string
+	disguise Disguise
+	local net.IP
+	pmtu *PathMTU
+	reassembler *Reassembler
+	undeliverable undeliverableHandler
+}
+
+// Disguise makes packets of a raw tunnel look like another protocol, e.g. a
+// TCP flow or pings, for middleboxes to let them through
+type Disguise interface {
+	// Wrap prepends the header for addr, it returns nil if payload can not be
+	// sent yet, the address returned is where the raw socket sends to
+	Wrap(addr net.Addr, payload []byte) ([]byte, net.Addr)
+
+	// Unwrap strips the header of a packet sent from remote to local, it
+	// returns the peer and the payload carried or nil if there is nothing
+	Unwrap(local, remote net.IP, packet []byte) (net.Addr, []byte)
+
+	// Overhead is the length of the header prepended by Wrap
+	Overhead() int
+
+	// Filter is the BPF program letting only relevant packets in, it starts
+	// with the offset of the transport header in register X
+	Filter() []bpf.Instruction
+
+	// Restart starts over from local to remote after a client reconnected
+	Restart(local, remote net.IP)
 }
 
 func newIPAddr() *net.IPAddr {
 	return &net.IPAddr{ IP: net.ParseIP("::") }
 }
 
-func dupIPAddr(dst, src *net.IPAddr) {
-	copy(dst.IP, src.IP.To16())
-	dst.Zone = src.Zone
+func copyIPAddr(addr *net.IPAddr) *net.IPAddr {
+	return &net.IPAddr{ IP: copyIP(addr.IP), Zone: addr.Zone }
+}
+
+// localIPAddr is the address to dial from, nil if ip is not set
+func localIPAddr(ip net.IP) *net.IPAddr {
+	if ip == nil {
+		return nil
+	}
+	return &net.IPAddr{ IP: ip }
 }
 
 func equalIPAddr(l, r *net.IPAddr) bool {
@@ -39,138 +82,361 @@ func equalIPAddr(l, r *net.IPAddr) bool {
 	return l.IP.Equal(r.IP)
 }
 
-func initRawTunnel(protocol uint8, listen, connect *net.IPAddr) (Tunnel, error) {
+func rawNetwork(protocol uint8, ip net.IP) string {
+	return underlayNetwork("ip", ip) + ":" + strconv.Itoa(int(protocol))
+}
+
+// newRawTunnel listens on listen or connects to connect, remote is the name
+// connect is resolved from and is resolved again when reconnecting
+func newRawTunnel(protocol uint8, listen, connect *net.IPAddr, remote string, opts *TunnelOptions) (*RawTunnelImpl, error) {
+	destination := connect
+	if destination == nil {
+		destination = newIPAddr()
+	}
+
+	tunnel := &RawTunnelImpl{
+		protocol, NewSendQueue("raw_tunnel", tunnelQueueLength, sendQueuePolicy), nil, atomic.Value{}, false, nil, atomic.Value{}, connect != nil, opts.getObscurer(), NewReplayWindow(), nil, nil, nil, remote, nil, opts.getLocal(), nil, NewReassembler(), opts.getOnUndeliverable(),
+	}
+	tunnel.destination.Store(destination)
+
 	var conn *net.IPConn
 	var err error
 	if listen == nil {
-		conn, err = net.DialIP("ip4:" + strconv.Itoa(int(protocol)), nil, connect)
+		tunnel.v6 = isIPv6(connect.IP)
+		conn, err = net.DialIP(rawNetwork(protocol, connect.IP), localIPAddr(tunnel.local), connect)
 	} else {
-		conn, err = net.ListenIP("ip4:" + strconv.Itoa(int(protocol)), listen)
+		tunnel.v6 = isIPv6(listen.IP)
+		conn, err = net.ListenIP(rawNetwork(protocol, listen.IP), listen)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if err = tunnel.setConn(conn); err != nil {
+		return nil, err
+	}
+
+	if !tunnel.preConnected {
+		tunnel.sessions = NewSessionTable(tunnel, opts.getAuth(), opts.getSessionTimeout())
+	} else {
+		// the handshake is only started on start
+		if credential := opts.getCredential(); credential != nil {
+			tunnel.handshake = newClientHandshake(*credential, func(msg []byte) { tunnel.sendTo(nil, nil, msg) }, opts.getOnLease())
+		}
+		tunnel.pmtu = opts.newPathMTU(conn, tunnel.v6, tunnel.handshake.Established, tunnel.sendProbe, tunnel.payloadMTU)
+	}
+	return tunnel, nil
+}
+
+func (t *RawTunnelImpl) getConn() batchConn {
+	return t.conn.Load().(batchConn)
+}
+
+// setConn configures conn and puts it in use
+func (t *RawTunnelImpl) setConn(conn *net.IPConn) error {
+	if err := conn.SetWriteBuffer(256 * 1024); err != nil {
+		return err
+	}
+	c := newBatchConn(conn, t.v6)
+	if t.filter != nil {
+		if err := c.SetBPF(t.filter); err != nil {
+			Warning.Printf("Failed to set BPF filter, all packets will be inspected: %v\n", err)
+		}
+	}
+	if t.pmtu != nil {
+		if err := setDontFragment(conn, t.v6); err != nil {
+			return err
+		}
+	}
+	if t.v6 && t.protocol == 6 {
+		// raw IPv6 sockets do not know the source address we send from
+		if err := c.(*ipv6.PacketConn).SetChecksum(true, 16); err != nil {
+			return err
+		}
+	}
+	t.conn.Store(c)
+	return nil
+}
 
-	err = conn.SetWriteBuffer(256 * 1024)
+func (t *RawTunnelImpl) getDestination() *net.IPAddr {
+	return t.destination.Load().(*net.IPAddr)
+}
+
+func (t *RawTunnelImpl) currentDestination() string {
+	return t.getDestination().String()
+}
+
+// redial replaces the connection with a new one to destination
+func (t *RawTunnelImpl) redial(destination *net.IPAddr) error {
+	conn, err := net.DialIP(rawNetwork(t.protocol, destination.IP), localIPAddr(t.local), destination)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	old := t.getConn()
+	if err = t.setConn(conn); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	t.destination.Store(destination)
+	if err = old.Close(); err != nil {
+		Error.Printf("Failed to close old connection, err: %v\n", err)
 	}
+	return nil
+}
 
-	sendCh := make(chan []byte, rawTxLength)
+// reconnect resolves the server again and redials it, the address family is
+// kept as the framing depends on it
+func (t *RawTunnelImpl) reconnect() {
+	ipAddr, err := net.ResolveIPAddr(underlayNetwork("ip", t.getDestination().IP), t.remote)
+	if err != nil {
+		Error.Printf("Failed to resolve %v, err: %v\n", t.remote, err)
+		return
+	}
+	if err = t.redial(ipAddr); err != nil {
+		Error.Printf("Failed to re-dial to %v, err: %v\n", ipAddr, err)
+		return
+	}
+	tunnelDestinationChanges.Inc()
+	Info.Printf("tunnel reconnected to %v\n", ipAddr)
+	if t.disguise != nil {
+		t.disguise.Restart(t.getConn().LocalAddr().(*net.IPAddr).IP, ipAddr.IP)
+	}
+	t.pmtu.Restart()
+	if t.handshake != nil {
+		t.handshake.Restart()
+	}
+}
 
-	destination := connect
-	if destination == nil {
-		destination = newIPAddr()
+func (t *RawTunnelImpl) start(opts *TunnelOptions) {
+	if t.preConnected {
+		t.keepalive = opts.newKeepalive(func(msg []byte) { t.sendTo(nil, t.handshake.Obscurer(), msg) }, t.reconnect)
+		t.handshake.start()
 	}
+	go t.send()
+	go t.receive()
+}
 
-	tunnel := RawTunnelImpl{
-		protocol, sendCh, nil, ipv4.NewPacketConn(conn), destination, connect != nil,
+func initRawTunnel(protocol uint8, listen, connect *net.IPAddr, remote string, opts *TunnelOptions) (Tunnel, error) {
+	tunnel, err := newRawTunnel(protocol, listen, connect, remote, opts)
+	if err != nil {
+		return nil, err
 	}
-	go tunnel.send()
-	go tunnel.receive()
-	return &tunnel, nil
+	tunnel.start(opts)
+	return tunnel, nil
 }
 
-func RawConnect(addr string, protocol uint8) (Tunnel, error) {
-	ipAddr, err := net.ResolveIPAddr("ip4", addr)
+// assembleFilter completes filter of a disguise with loading the offset of the
+// transport header, raw IPv6 sockets do not see the IP header at all
+func assembleFilter(v6 bool, filter []bpf.Instruction) ([]bpf.RawInstruction, error) {
+	var load bpf.Instruction = bpf.LoadMemShift{ Off: 0 }
+	if v6 {
+		load = bpf.LoadConstant{ Dst: bpf.RegX, Val: 0 }
+	}
+	return bpf.Assemble(append([]bpf.Instruction{ load }, filter...))
+}
+
+// startDisguised starts tunnel after letting only packets relevant to disguise
+// into its raw socket
+func (t *RawTunnelImpl) startDisguised(disguise Disguise, opts *TunnelOptions) {
+	t.disguise = disguise
+	filter, err := assembleFilter(t.v6, disguise.Filter())
+	if err == nil {
+		t.filter = filter
+		err = t.getConn().SetBPF(filter)
+	}
+	if err != nil {
+		Warning.Printf("Failed to set BPF filter, all packets will be inspected: %v\n", err)
+	}
+	t.start(opts)
+}
+
+func RawConnect(addr string, protocol uint8, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
 	if err != nil {
 		return nil, err
 	}
-	return initRawTunnel(protocol, nil, ipAddr)
+	return initRawTunnel(protocol, nil, ipAddr, addr, opts)
 }
 
-func RawListen(addr string, protocol uint8) (Tunnel, error) {
-	ipAddr, err := net.ResolveIPAddr("ip4", addr)
+func RawListen(addr string, protocol uint8, opts *TunnelOptions) (Tunnel, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
 	if err != nil {
 		return nil, err
 	}
-	return initRawTunnel(protocol, ipAddr, nil)
+	return initRawTunnel(protocol, ipAddr, nil, "", opts)
 }
 
 func (t *RawTunnelImpl) Send(content []byte) {
-	t.sendCh <- t.obscure(content)
+	if !t.preConnected {
+		Warning.Printf("No destination, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableNet, 0)
+		return
+	}
+	if !t.handshake.Established() {
+		Debug.Printf("Handshake not established, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableHost, 0)
+		return
+	}
+	t.sendTo(nil, t.handshake.Obscurer(), content)
+}
+
+func (t *RawTunnelImpl) sendTo(addr net.Addr, sealer Obscurer, content []byte) {
+	priority := isPriorityPacket(content)
+	if len(content) <= t.payloadMTU() {
+		t.sendPacket(addr, sealer, content, content, priority)
+		return
+	}
+	fragments := fragmentToFit(content, t.payloadMTU())
+	if fragments == nil {
+		t.undeliverable.report(content, unreachableTooBig, t.payloadMTU())
+	}
+	for _, packet := range fragments {
+		if !t.sendPacket(addr, sealer, content, packet, priority) {
+			return
+		}
+	}
+}
+
+// sendPacket queues packet, content or a fragment of it, content is reported
+// undeliverable if packet is not queued
+func (t *RawTunnelImpl) sendPacket(addr net.Addr, sealer Obscurer, content, packet []byte, priority bool) bool {
+	obscured := t.obscure(sealer, packet)
+	if obscured == nil {
+		t.undeliverable.report(content, unreachableTooBig, t.payloadMTU())
+		return false
+	}
+	if !t.sendObscured(addr, obscured, priority) {
+		t.undeliverable.report(content, unreachableHost, 0)
+		return false
+	}
+	return true
+}
+
+// sendProbe sends a path MTU probe in an IP packet of size bytes
+func (t *RawTunnelImpl) sendProbe(size int) {
+	mss := size - underlayHeaderLength(t.v6) - t.disguiseOverhead()
+	if probe := pmtuProbe(size, mss - obscurerOverhead(t.obscurer)); probe != nil {
+		t.sendObscured(nil, obscureWith(sealerOf(t.obscurer, t.handshake.Obscurer(), probe), mss, probe), false)
+	}
+}
+
+// tooLarge takes a packet the interface MTU is too small for
+func (t *RawTunnelImpl) tooLarge(packet []byte) {
+	t.pmtu.TooLarge(len(packet) + underlayHeaderLength(t.v6))
+}
+
+// sendObscured tells whether obscured is queued, the disguise may not be able
+// to send it yet or the queue is full
+func (t *RawTunnelImpl) sendObscured(addr net.Addr, obscured []byte, priority bool) bool {
+	if obscured == nil {
+		return false
+	}
+	if t.disguise != nil {
+		// the disguise copies the payload behind its header
+		wrapped, wrappedAddr := t.disguise.Wrap(addr, obscured)
+		putPacketBuffer(obscured)
+		if wrapped == nil {
+			return false
+		}
+		return t.queue.Push(outPacket{ wrapped, wrappedAddr, nil }, priority)
+	}
+	if !t.queue.Push(outPacket{ obscured, addr, nil }, priority) {
+		putPacketBuffer(obscured)
+		return false
+	}
+	return true
+}
+
+// sendSegment queues a segment of the disguise, e.g. a handshake of fake TCP
+func (t *RawTunnelImpl) sendSegment(addr net.Addr, segment []byte) {
+	t.queue.Push(outPacket{ segment, addr, nil }, true)
+}
+
+// Alive tells whether the server is handshaked and heard from recently
+func (t *RawTunnelImpl) Alive() bool {
+	return t.handshake.Established() && t.keepalive.Alive()
 }
 
 func (t *RawTunnelImpl) SetHandler(handler func (Tunnel, []byte)) {
 	t.handler = handler
 }
 
-func (t *RawTunnelImpl) obscure(packet []byte) []byte {
-	ret, err := obscure(1492 - 20, packet)
-	if err != nil {
-		Error.Printf("Error when obscure packet: %v\n", err)
-		return nil
+func (t *RawTunnelImpl) disguiseOverhead() int {
+	if t.disguise == nil {
+		return 0
 	}
-	return ret
+	return t.disguise.Overhead()
 }
 
-func (t *RawTunnelImpl) restore(packet []byte) []byte {
-	ret, err := restore(packet)
-	if err != nil {
-		Error.Printf("Error when restore packet: %v\n", err)
-		return nil
+// mss is the largest obscured packet fitting into the path MTU
+func (t *RawTunnelImpl) mss() int {
+	return t.pmtu.MTU() - underlayHeaderLength(t.v6) - t.disguiseOverhead()
+}
+
+// payloadMTU is the largest packet carried without fragmenting it
+func (t *RawTunnelImpl) payloadMTU() int {
+	return t.mss() - obscurerOverhead(t.obscurer)
+}
+
+// obscure seals packet into a pooled buffer, handed back once sent
+func (t *RawTunnelImpl) obscure(sealer Obscurer, packet []byte) []byte {
+	buf := getPacketBuffer()
+	obscured := obscureInto(sealerOf(t.obscurer, sealer, packet), buf, t.mss(), packet)
+	if !samePlace(obscured, buf) {
+		putPacketBuffer(buf)
 	}
-	return ret
+	return obscured
+}
+
+func (t *RawTunnelImpl) restore(packet []byte) []byte {
+	return restoreFromServer(t.obscurer, t.replay, t.handshake, packet)
 }
 
 func (t *RawTunnelImpl) send() {
 	messages := make([]ipv4.Message, rawTxLength)
 	for i := 0; i < len(messages); i++ {
 		messages[i].Buffers = [][]byte { nil }
-		if !t.preConnected {
-			messages[i].Addr = t.destination
-		}
 	}
 
-	for  {
+	for range t.queue.Ready() {
 		count := 0
 		bytes := 0
-
-		toSend := <- t.sendCh
-		messages[count].Buffers[0] = toSend
-		count++
-		bytes += len(toSend)
-	getToSendLoop:
-		for {
-			if count >= len(messages) {
+		for count < len(messages) {
+			toSend, ok := t.queue.Pop()
+			if !ok {
 				break
 			}
-			select {
-			case toSend := <- t.sendCh:
-				messages[count].Buffers[0] = toSend
-				count++
-				bytes += len(toSend)
-			default:
-				break getToSendLoop
-			}
+			messages[count].Buffers[0] = toSend.data
+			messages[count].Addr = toSend.addr
+			count++
+			bytes += len(toSend.data)
 		}
-
-		if t.destination.IP.IsUnspecified() {
-			Warning.Printf("No destination, skip %v bytes\n", bytes)
+		if count == 0 {
 			continue
 		}
 
 		msgSent := 0
 		for msgSent < count {
-			n, err := t.conn.WriteBatch(messages[msgSent:count], 0)
+			n, err := writeMessages(t.getConn(), messages[msgSent:count], t.tooLarge)
+			msgSent += n
 			if err != nil {
-				Error.Printf("Failed to send to %v, err: %v\n", t.destination, err)
-
-				conn, err := net.DialIP("ip4:" + strconv.Itoa(int(t.protocol)), nil, t.destination)
-				if err != nil {
-					Error.Printf("Failed to re-dial to %v, err: %v\n", t.destination, err)
+				Error.Printf("Failed to send to %v, err: %v\n", t.getDestination(), err)
+				if !t.preConnected {
 					break
 				}
-				n = 0
-				old := atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(&t.conn)), unsafe.Pointer(ipv4.NewPacketConn(conn)))
-				err = (*ipv4.PacketConn)(old).Close()
-				if err != nil {
-					Error.Printf("Failed to close old connection to %v, err: %v\n", t.destination, err)
+
+				if err = t.redial(t.getDestination()); err != nil {
+					Error.Printf("Failed to re-dial to %v, err: %v\n", t.getDestination(), err)
+					break
 				}
 			}
-			msgSent += n
 		}
-		Debug.Printf("sent to %v %d bytes\n", t.destination, bytes)
+		Debug.Printf("sent to %v %d bytes\n", t.getDestination(), bytes)
+		if t.disguise == nil {
+			for i := 0; i < count; i++ {
+				putPacketBuffer(messages[i].Buffers[0])
+				messages[i].Buffers[0] = nil
+			}
+		}
 	}
 }
 
@@ -181,37 +447,24 @@ func (t *RawTunnelImpl) receive() {
 		messages[i].N = len(messages[i].Buffers[0])
 	}
 	for {
-		n, err := t.conn.ReadBatch(messages[:], ReadBatchFlags)
+		n, err := t.getConn().ReadBatch(messages[:], ReadBatchFlags)
 		if err != nil {
 			Error.Printf("Failed to receive, err: %v\n", err)
 			continue
 		}
 
-		if t.handler == nil {
-			Warning.Printf("no receive handler set, ignored %d * N bytes", n)
-			continue
-		}
-
 		for i := 0; i < n; i++ {
 			msg := &messages[i]
 			remoteAddr := msg.Addr.(*net.IPAddr)
-			if !equalIPAddr(remoteAddr, t.destination) {
-				if t.preConnected {
-					Error.Printf("cannot change destination from %v to %v\n", t.destination, remoteAddr)
-					break
-				} else {
-					Info.Printf("tunnel destination changed from %v to %v\n", t.destination, remoteAddr)
-					dupIPAddr(t.destination, remoteAddr)
-				}
-			}
 			if len(msg.Buffers) != 1 {
 				Error.Printf("Bad msg Buffers size: %d, Flags: %d\n", len(msg.Buffers), msg.Flags)
 				continue
 			}
-			received := t.restore(msg.Buffers[0][20:msg.N])
-			if received != nil {
-				t.handler(t, received)
+			if destination := t.getDestination(); t.preConnected && !equalIPAddr(remoteAddr, destination) {
+				Error.Printf("cannot change destination from %v to %v\n", destination, remoteAddr)
+				break
 			}
+			t.received(remoteAddr, msg.Buffers[0][:msg.N])
 
 			Debug.Printf("received from %v %d bytes\n", remoteAddr, msg.N)
 			msg.N = len(msg.Buffers[0])
@@ -219,3 +472,50 @@ func (t *RawTunnelImpl) receive() {
 	}
 }
 
+// received handles one packet read from the raw socket, the IP header is only
+// included for IPv4
+func (t *RawTunnelImpl) received(remoteAddr *net.IPAddr, packet []byte) {
+	payload := packet
+	var local net.IP
+	if !t.v6 {
+		if len(packet) < 20 || len(packet) < int(packet[0] & 0x0f) * 4 {
+			return
+		}
+		payload = packet[int(packet[0] & 0x0f) * 4:]
+		local = net.IP(packet[16:20])
+	}
+
+	var peer net.Addr = remoteAddr
+	if t.disguise != nil {
+		var from net.Addr
+		if from, payload = t.disguise.Unwrap(local, remoteAddr.IP, payload); payload == nil {
+			return
+		}
+		peer = from
+	}
+
+	if t.preConnected {
+		received := t.restore(payload)
+		if received == nil {
+			return
+		}
+		t.keepalive.Received()
+		if t.pmtu.Handle(received) {
+			return
+		}
+		if received = t.reassembler.Reassemble("", received); received != nil {
+			dispatch(t, t.handshake, t.handler, received)
+		}
+		return
+	}
+	// only authenticated packets are allowed to create a session
+	if peer == remoteAddr {
+		peer = copyIPAddr(remoteAddr)
+	}
+	session, received := t.sessions.Receive(peer.String(), peer, payload, t.obscurer)
+	if received != nil {
+		if received = t.reassembler.Reassemble(peer.String(), received); received != nil {
+			dispatch(session, nil, t.handler, received)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+)
+
+var (
+	errTooFewShards = errors.New("too few shards to reconstruct")
+	errSingularMatrix = errors.New("singular matrix")
+)
+
+// Arithmetic over GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, the
+// exponents are doubled so that products need no modulo
+var (
+	gfExp [510]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i + 255] = byte(x)
+		gfLog[x] = i
+		if x <<= 1; x & 0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a] + gfLog[b]]
+}
+
+// gfInv returns the inverse of a which must not be 0
+func gfInv(a byte) byte {
+	return gfExp[255 - gfLog[a]]
+}
+
+// gfMulAdd adds c times src to dst
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	logC := gfLog[c]
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[gfLog[s] + logC]
+		}
+	}
+}
+
+// rsCoefficient is the Cauchy matrix element of parity shard i over data
+// shard j, as any square submatrix of a Cauchy matrix is invertible, a group
+// is recovered from any of its shards as many as its data shards
+func rsCoefficient(i, j int) byte {
+	return gfInv(byte(fecMaxData + i) ^ byte(j))
+}
+
+// rsEncode computes parity shards over data shards of the same length
+func rsEncode(data [][]byte, parity int) [][]byte {
+	shards := make([][]byte, parity)
+	for i := range shards {
+		shards[i] = make([]byte, len(data[0]))
+		for j, d := range data {
+			gfMulAdd(shards[i], d, rsCoefficient(i, j))
+		}
+	}
+	return shards
+}
+
+// gfInvert inverts a square matrix by Gauss-Jordan elimination
+func gfInvert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2 * n)
+		copy(work[r], matrix[r])
+		work[r][n + r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingularMatrix
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		scale := gfInv(work[c][c])
+		for k := range work[c] {
+			work[c][k] = gfMul(work[c][k], scale)
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				gfMulAdd(work[r], work[c], work[r][c])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range inverse {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
+
+// rsReconstruct fills the nil data shards from the parity shards present,
+// all shards present must be of the same length
+func rsReconstruct(data, parity [][]byte) error {
+	var missing, rows []int
+	for j, d := range data {
+		if d == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for i, p := range parity {
+		if p != nil && len(rows) < len(missing) {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < len(missing) {
+		return errTooFewShards
+	}
+
+	// the parity shards less the data shards present are the missing shards
+	// multiplied by the submatrix of their coefficients
+	matrix := make([][]byte, len(rows))
+	sums := make([][]byte, len(rows))
+	for r, i := range rows {
+		sums[r] = copyBytes(parity[i])
+		for j, d := range data {
+			if d != nil {
+				gfMulAdd(sums[r], d, rsCoefficient(i, j))
+			}
+		}
+		matrix[r] = make([]byte, len(missing))
+		for c, j := range missing {
+			matrix[r][c] = rsCoefficient(i, j)
+		}
+	}
+	inverse, err := gfInvert(matrix)
+	if err != nil {
+		return err
+	}
+	for c, j := range missing {
+		data[j] = make([]byte, len(sums[0]))
+		for r := range rows {
+			gfMulAdd(data[j], sums[r], inverse[c][r])
+		}
+	}
+	return nil
+}
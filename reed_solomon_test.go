@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Errorf("Expect %d times its inverse to be 1", a)
+		}
+	}
+	if gfMul(0x53, 0xca) != gfMul(0xca, 0x53) || gfMul(2, 0x80) != 0x1d {
+		t.Errorf("Expect multiplication modulo 0x11d")
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	const data, parity = 4, 3
+	shards := make([][]byte, data)
+	for j := range shards {
+		shards[j] = make([]byte, 100)
+		rand.Read(shards[j])
+	}
+	parities := rsEncode(shards, parity)
+
+	// lose every combination of up to parity shards
+	for lost := 0; lost < 1 << (data + parity); lost++ {
+		count := 0
+		for bits := lost; bits != 0; bits &= bits - 1 {
+			count++
+		}
+		if count > parity {
+			continue
+		}
+		received := make([][]byte, data)
+		for j := range received {
+			if lost & (1 << uint(j)) == 0 {
+				received[j] = shards[j]
+			}
+		}
+		receivedParity := make([][]byte, parity)
+		for i := range receivedParity {
+			if lost & (1 << uint(data + i)) == 0 {
+				receivedParity[i] = parities[i]
+			}
+		}
+		if err := rsReconstruct(received, receivedParity); err != nil {
+			t.Fatalf("Expect shards recovered after losing %b but got %v", lost, err)
+		}
+		for j := range shards {
+			if !bytes.Equal(received[j], shards[j]) {
+				t.Fatalf("Expect shard %d recovered after losing %b", j, lost)
+			}
+		}
+	}
+
+	if err := rsReconstruct(make([][]byte, data), parities); err != errTooFewShards {
+		t.Errorf("Expect %v but got %v", errTooFewShards, err)
+	}
+}
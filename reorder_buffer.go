@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	reorderDuplicates = NewCounter("reorder_duplicates_total", "Bonded packets dropped as duplicated or too late")
+	reorderGaps = NewCounter("reorder_gaps_total", "Bonded packets given up waiting for")
+)
+
+type heldPacket struct {
+	seq uint32
+	packet []byte
+	arrived int64
+}
+
+// ReorderBuffer puts packets of a sequence sent over several paths back in
+// order. A missing packet is waited for until window packets after it are held
+// or the first of them has waited for delay, then it is skipped
+type ReorderBuffer struct {
+	lock sync.Mutex
+	started bool
+	next uint32
+	// head is the slot of next, slots go by the offset from next so the ring
+	// stays in order as the sequence wraps whatever its size
+	head int
+	ring []*heldPacket
+	held int
+	delay time.Duration
+	deliver func([]byte)
+}
+
+func NewReorderBuffer(window int, delay time.Duration, deliver func([]byte)) *ReorderBuffer {
+	if window < 1 {
+		window = 1
+	}
+	return &ReorderBuffer{ ring: make([]*heldPacket, window), delay: delay, deliver: deliver }
+}
+
+// slot returns where seq is held, seq must be within the window from next
+func (b *ReorderBuffer) slot(seq uint32) int {
+	return (b.head + int(seq - b.next)) % len(b.ring)
+}
+
+// advance moves next on with the slot it is held in
+func (b *ReorderBuffer) advance() {
+	b.next++
+	b.head = (b.head + 1) % len(b.ring)
+}
+
+// Push delivers packet with all the packets held after it if it is the next
+// one expected, otherwise holds it
+func (b *ReorderBuffer) Push(seq uint32, packet []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !b.started {
+		b.started = true
+		b.next = seq
+	}
+	if int32(seq - b.next) < 0 {
+		reorderDuplicates.Inc()
+		return
+	}
+	if window := uint32(len(b.ring)); seq - b.next >= window {
+		b.skipTo(seq - window + 1)
+	}
+	if h := b.ring[b.slot(seq)]; h != nil {
+		reorderDuplicates.Inc()
+		return
+	}
+	b.ring[b.slot(seq)] = &heldPacket{ seq, packet, time.Now().UnixNano() }
+	b.held++
+	b.flush()
+}
+
+// Expire skips the missing packets which the packets held after them have
+// waited for longer than delay
+func (b *ReorderBuffer) Expire(now time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	deadline := now.UnixNano() - b.delay.Nanoseconds()
+	for b.held > 0 {
+		first := b.first()
+		if first.arrived > deadline {
+			return
+		}
+		b.skipTo(first.seq)
+		b.flush()
+	}
+}
+
+// first returns the earliest packet held, there must be one
+func (b *ReorderBuffer) first() *heldPacket {
+	for i := uint32(0); ; i++ {
+		if h := b.ring[b.slot(b.next + i)]; h != nil {
+			return h
+		}
+	}
+}
+
+// flush delivers the packets held in a row from next
+func (b *ReorderBuffer) flush() {
+	for {
+		h := b.ring[b.slot(b.next)]
+		if h == nil {
+			return
+		}
+		b.ring[b.slot(b.next)] = nil
+		b.held--
+		b.advance()
+		b.deliver(h.packet)
+	}
+}
+
+// skipTo gives up the packets missing before seq, those held are delivered
+func (b *ReorderBuffer) skipTo(seq uint32) {
+	for b.next != seq {
+		if b.held == 0 {
+			reorderGaps.Add(int(seq - b.next))
+			b.next = seq
+			b.head = 0
+			return
+		}
+		if h := b.ring[b.slot(b.next)]; h != nil {
+			b.ring[b.slot(b.next)] = nil
+			b.held--
+			b.deliver(h.packet)
+		} else {
+			reorderGaps.Inc()
+		}
+		b.advance()
+	}
+}
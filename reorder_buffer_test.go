@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	var delivered []byte
+	b := NewReorderBuffer(4, time.Hour, func(packet []byte) { delivered = append(delivered, packet[0]) })
+
+	tests := []struct { seq uint32; expect []byte } {
+		{ 10, []byte{ 10 } },
+		{ 12, []byte{ 10 } },
+		{ 11, []byte{ 10, 11, 12 } },
+		{ 11, []byte{ 10, 11, 12 } },
+		{ 9, []byte{ 10, 11, 12 } },
+		{ 14, []byte{ 10, 11, 12 } },
+		{ 14, []byte{ 10, 11, 12 } },
+		// 13 is given up once the window is full
+		{ 17, []byte{ 10, 11, 12, 14 } },
+		{ 13, []byte{ 10, 11, 12, 14 } },
+		{ 15, []byte{ 10, 11, 12, 14, 15 } },
+		{ 16, []byte{ 10, 11, 12, 14, 15, 16, 17 } },
+		// far ahead the window moves on but what is missing just before is waited for
+		{ 100, []byte{ 10, 11, 12, 14, 15, 16, 17 } },
+		{ 99, []byte{ 10, 11, 12, 14, 15, 16, 17 } },
+		{ 97, []byte{ 10, 11, 12, 14, 15, 16, 17, 97 } },
+		{ 98, []byte{ 10, 11, 12, 14, 15, 16, 17, 97, 98, 99, 100 } },
+	}
+	for idx, test := range tests {
+		b.Push(test.seq, []byte{ byte(test.seq) })
+		if !reflect.DeepEqual(delivered, test.expect) {
+			t.Errorf("Expect %v after %dth sequence %d but got %v", test.expect, idx+1, test.seq, delivered)
+		}
+	}
+}
+
+func TestReorderBufferExpire(t *testing.T) {
+	var delivered []byte
+	b := NewReorderBuffer(64, 50 * time.Millisecond, func(packet []byte) { delivered = append(delivered, packet[0]) })
+
+	b.Push(0xfffffffe, []byte{ 1 })
+	b.Push(1, []byte{ 4 })
+	b.Push(0, []byte{ 3 })
+	b.Expire(time.Now())
+	if !reflect.DeepEqual(delivered, []byte{ 1 }) {
+		t.Errorf("Expect the gap waited for but got %v", delivered)
+	}
+	b.Expire(time.Now().Add(time.Second))
+	if !reflect.DeepEqual(delivered, []byte{ 1, 3, 4 }) {
+		t.Errorf("Expect the gap skipped across wrapping but got %v", delivered)
+	}
+	b.Push(0xffffffff, []byte{ 2 })
+	if !reflect.DeepEqual(delivered, []byte{ 1, 3, 4 }) {
+		t.Errorf("Expect the late packet dropped but got %v", delivered)
+	}
+}
+
+func TestReorderBufferWrapOddWindow(t *testing.T) {
+	var delivered []byte
+	b := NewReorderBuffer(5, time.Hour, func(packet []byte) { delivered = append(delivered, packet[0]) })
+
+	// with 5 slots 0xfffffffe and 2 would share one if slots followed seq
+	for _, seq := range []uint32{ 0xfffffffd, 2, 0xffffffff, 0, 1, 0xfffffffe } {
+		b.Push(seq, []byte{ byte(seq + 3) })
+	}
+	if expect := []byte{ 0, 1, 2, 3, 4, 5 }; !reflect.DeepEqual(delivered, expect) {
+		t.Errorf("Expect %v across wrapping but got %v", expect, delivered)
+	}
+}
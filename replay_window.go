@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	replayBlockBits = 64
+	replayRingBlocks = 32
+	replayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+var (
+	errReplayDuplicate = errors.New("duplicated sequence number")
+	errReplayTooOld = errors.New("sequence number out of replay window")
+)
+
+var (
+	tunnelReplayDuplicates = NewCounter("tunnel_replay_duplicates_total", "Received tunnel packets dropped as duplicates")
+	tunnelReplayTooOld = NewCounter("tunnel_replay_too_old_total", "Received tunnel packets dropped as older than the replay window")
+)
+
+// ReplayWindow is a sliding bitmap of recently accepted sequence numbers,
+// kept as a ring of blocks so that moving forward only clears whole words
+type ReplayWindow struct {
+	lock sync.Mutex
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+func NewReplayWindow() *ReplayWindow {
+	return &ReplayWindow{}
+}
+
+func (w *ReplayWindow) Check(seq uint64) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	block := seq / replayBlockBits
+	if seq > w.last {
+		current := w.last / replayBlockBits
+		diff := block - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; diff > 0; i, diff = i+1, diff-1 {
+			w.ring[i % replayRingBlocks] = 0
+		}
+		w.last = seq
+	} else if w.last - seq > replayWindowSize {
+		return errReplayTooOld
+	}
+
+	index := block % replayRingBlocks
+	bit := uint64(1) << (seq % replayBlockBits)
+	if w.ring[index] & bit != 0 {
+		return errReplayDuplicate
+	}
+	w.ring[index] |= bit
+	return nil
+}
+
+// Accept checks seq against the window and counts rejections, zero means the packet is unsequenced
+func (w *ReplayWindow) Accept(seq uint64) bool {
+	if seq == 0 || w == nil {
+		return true
+	}
+	switch w.Check(seq) {
+	case nil:
+		return true
+	case errReplayDuplicate:
+		tunnelReplayDuplicates.Inc()
+	case errReplayTooOld:
+		tunnelReplayTooOld.Inc()
+	}
+	Debug.Printf("Drop replayed packet of sequence %d\n", seq)
+	return false
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	w := NewReplayWindow()
+	base := uint64(1000000)
+
+	tests := []struct { seq uint64; expect error } {
+		{ base, nil },
+		{ base, errReplayDuplicate },
+		{ base + 2, nil },
+		{ base + 1, nil },
+		{ base + 1, errReplayDuplicate },
+		{ base + 100, nil },
+		{ base + 3, nil },
+		{ base + 3, errReplayDuplicate },
+		{ base + replayWindowSize + 200, nil },
+		{ base + 100, errReplayTooOld },
+		{ base + 200, nil },
+		{ base + 200, errReplayDuplicate },
+		{ base + 10 * replayWindowSize, nil },
+		{ base + 10 * replayWindowSize - 1, nil },
+		{ base + replayWindowSize + 200, errReplayTooOld },
+	}
+
+	for idx, test := range tests {
+		result := w.Check(test.seq)
+		if result != test.expect {
+			t.Errorf("Expect check on %dth sequence %d is %v, but got %v", idx+1, test.seq, test.expect, result)
+		}
+	}
+}
+
+func TestReplayWindowUnsequenced(t *testing.T) {
+	w := NewReplayWindow()
+	if !w.Accept(0) || !w.Accept(0) {
+		t.Errorf("Expect unsequenced packets always accepted")
+	}
+	var nilWindow *ReplayWindow
+	if !nilWindow.Accept(1) {
+		t.Errorf("Expect nil window accepts everything")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type route struct {
+	tunnel Tunnel
+	lastSeen int64
+}
+
+// RouteTable maps inner addresses, IP or MAC ones in bridge mode, to the
+// session they were learned from
+type RouteTable struct {
+	lock sync.RWMutex
+	routes map[string]*route
+	timeout time.Duration
+}
+
+// NewRouteTable creates routes which are forgotten once idle for timeout
+func NewRouteTable(timeout time.Duration) *RouteTable {
+	rt := &RouteTable{
+		sync.RWMutex{},
+		make(map[string]*route),
+		timeout,
+	}
+	go rt.expireLoop()
+	return rt
+}
+
+// Claim learns the route of ip from tunnel unless another tunnel owns it and
+// is not idle, it reports whether ip is routed to tunnel
+func (rt *RouteTable) Claim(ip net.IP, tunnel Tunnel) bool {
+	return rt.learn(string(ip), ip, tunnel, false)
+}
+
+// LearnMAC learns the route of mac from tunnel, a host may move between the
+// networks bridged
+func (rt *RouteTable) LearnMAC(mac net.HardwareAddr, tunnel Tunnel) {
+	rt.learn(string(mac), mac, tunnel, true)
+}
+
+func (rt *RouteTable) learn(key string, addr fmt.Stringer, tunnel Tunnel, moves bool) bool {
+	now := time.Now().UnixNano()
+	rt.lock.RLock()
+	r, ok := rt.routes[key]
+	rt.lock.RUnlock()
+	if ok && r.tunnel == tunnel {
+		atomic.StoreInt64(&r.lastSeen, now)
+		return true
+	}
+
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	r, ok = rt.routes[key]
+	if ok && r.tunnel == tunnel {
+		atomic.StoreInt64(&r.lastSeen, now)
+		return true
+	}
+	if ok && !moves && atomic.LoadInt64(&r.lastSeen) >= now - rt.timeout.Nanoseconds() {
+		return false
+	}
+	if ok {
+		Info.Printf("route of %v moved from %v to %v\n", addr, r.tunnel, tunnel)
+	} else {
+		Info.Printf("route of %v learned from %v\n", addr, tunnel)
+	}
+	rt.routes[key] = &route{ tunnel, now }
+	return true
+}
+
+func (rt *RouteTable) Lookup(ip net.IP) Tunnel {
+	return rt.lookup(string(ip))
+}
+
+func (rt *RouteTable) LookupMAC(mac net.HardwareAddr) Tunnel {
+	return rt.lookup(string(mac))
+}
+
+func (rt *RouteTable) lookup(key string) Tunnel {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	if r, ok := rt.routes[key]; ok {
+		return r.tunnel
+	}
+	return nil
+}
+
+// Tunnels lists every tunnel some route is learned from, once each
+func (rt *RouteTable) Tunnels() []Tunnel {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+	seen := make(map[Tunnel]bool)
+	var tunnels []Tunnel
+	for _, r := range rt.routes {
+		if !seen[r.tunnel] {
+			seen[r.tunnel] = true
+			tunnels = append(tunnels, r.tunnel)
+		}
+	}
+	return tunnels
+}
+
+func (rt *RouteTable) expire() {
+	deadline := time.Now().UnixNano() - rt.timeout.Nanoseconds()
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	for key, r := range rt.routes {
+		if atomic.LoadInt64(&r.lastSeen) < deadline {
+			delete(rt.routes, key)
+		}
+	}
+}
+
+func (rt *RouteTable) expireLoop() {
+	for range time.Tick(time.Minute) {
+		rt.expire()
+	}
+}
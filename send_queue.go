@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/ini.v1"
+	"sync"
+)
+
+// dropPolicy tells which packet a full SendQueue drops
+type dropPolicy int
+
+const (
+	// dropTail drops the packet pushed
+	dropTail dropPolicy = iota
+	// dropOldest drops the packet queued longest, which is likely stale anyway
+	dropOldest
+)
+
+func parseDropPolicy(value string) (dropPolicy, error) {
+	switch value {
+	case "", "tail":
+		return dropTail, nil
+	case "oldest":
+		return dropOldest, nil
+	}
+	return dropTail, errors.New("bad queue_drop " + value + ", expect tail or oldest")
+}
+
+var (
+	// deviceQueueLength and tunnelQueueLength bound the packets waiting to be
+	// written to the device and to the underlay of a tunnel
+	deviceQueueLength = 50
+	tunnelQueueLength = 64
+	sendQueuePolicy = dropTail
+)
+
+// configureQueues sets the queue tunables from [common] before any device or
+// tunnel is started
+func configureQueues(common *ini.Section) error {
+	policy, err := parseDropPolicy(common.Key("queue_drop").String())
+	if err != nil {
+		return err
+	}
+	sendQueuePolicy = policy
+	deviceQueueLength = common.Key("device_queue_length").MustInt(deviceQueueLength)
+	tunnelQueueLength = common.Key("queue_length").MustInt(tunnelQueueLength)
+	if deviceQueueLength < 1 || tunnelQueueLength < 1 {
+		return errors.New("queue lengths must be positive")
+	}
+	return nil
+}
+
+// isPriorityPacket tells whether packet goes ahead of bulk traffic: control
+// messages of tunnels, ICMP and DNS. Other packets keep the order they are sent
+// in whatever their size, a small packet overtaking its own flow would look
+// like loss to TCP
+func isPriorityPacket(packet []byte) bool {
+	if len(packet) >= bondHeaderLength && packet[0] == bondData {
+		packet = packet[bondHeaderLength:]
+	}
+	if len(packet) == 0 {
+		return false
+	}
+	switch packet[0] {
+	case ctrlHello, ctrlChallenge, ctrlResponse, ctrlWelcome, ctrlReject,
+		ctrlKeepalive, ctrlKeepaliveAck, ctrlPMTUProbe, ctrlPMTUAck, bondProbe, bondProbeAck:
+		return true
+	}
+	return isICMPOrDNS(packet)
+}
+
+// queueMetrics are shared by the queues of a kind, e.g. all udp tunnels
+type queueMetrics struct {
+	length *Gauge
+	dropped *Counter
+}
+
+var (
+	queueMetricsLock sync.Mutex
+	queueMetricsByKind = make(map[string]*queueMetrics)
+)
+
+func metricsOfQueue(kind string) *queueMetrics {
+	queueMetricsLock.Lock()
+	defer queueMetricsLock.Unlock()
+	m, ok := queueMetricsByKind[kind]
+	if !ok {
+		m = &queueMetrics{
+			NewGauge(kind + "_queue_length", "Packets waiting in " + kind + " send queues"),
+			NewCounter(kind + "_queue_dropped_total", "Packets dropped by full " + kind + " send queues"),
+		}
+		queueMetricsByKind[kind] = m
+	}
+	return m
+}
+
+// packetRing is a fixed size FIFO of packets
+type packetRing struct {
+	packets []outPacket
+	head int
+	count int
+}
+
+func (r *packetRing) full() bool {
+	return r.count == len(r.packets)
+}
+
+func (r *packetRing) push(packet outPacket) {
+	r.packets[(r.head + r.count) % len(r.packets)] = packet
+	r.count++
+}
+
+func (r *packetRing) pop() outPacket {
+	packet := r.packets[r.head]
+	r.packets[r.head] = outPacket{}
+	r.head = (r.head + 1) % len(r.packets)
+	r.count--
+	return packet
+}
+
+// SendQueue holds the packets for a writer goroutine without ever blocking
+// the pusher, so that a slow underlay does not stall the reader of the other
+// direction. Priority packets have a queue of their own and are taken first,
+// each queue holds up to length packets
+type SendQueue struct {
+	lock sync.Mutex
+	high packetRing
+	low packetRing
+	policy dropPolicy
+	ready chan struct{}
+	metrics *queueMetrics
+}
+
+func NewSendQueue(kind string, length int, policy dropPolicy) *SendQueue {
+	return &SendQueue{
+		high: packetRing{ packets: make([]outPacket, length) },
+		low: packetRing{ packets: make([]outPacket, length) },
+		policy: policy,
+		ready: make(chan struct{}, 1),
+		metrics: metricsOfQueue(kind),
+	}
+}
+
+// Push queues packet and tells whether it is queued, a full queue drops
+// either packet or its oldest one by the drop policy
+func (q *SendQueue) Push(packet outPacket, priority bool) bool {
+	ring := &q.low
+	if priority {
+		ring = &q.high
+	}
+	q.lock.Lock()
+	if ring.full() {
+		q.metrics.dropped.Inc()
+		if q.policy == dropTail {
+			q.lock.Unlock()
+			return false
+		}
+		ring.pop()
+		q.metrics.length.Add(-1)
+	}
+	ring.push(packet)
+	q.lock.Unlock()
+	q.metrics.length.Add(1)
+	q.signal()
+	return true
+}
+
+// Pop takes the next packet, priority ones first, without waiting
+func (q *SendQueue) Pop() (outPacket, bool) {
+	q.lock.Lock()
+	var packet outPacket
+	if q.high.count > 0 {
+		packet = q.high.pop()
+	} else if q.low.count > 0 {
+		packet = q.low.pop()
+	} else {
+		q.lock.Unlock()
+		return packet, false
+	}
+	left := q.high.count + q.low.count
+	q.lock.Unlock()
+	q.metrics.length.Add(-1)
+	if left > 0 {
+		// writers taking a batch at a time come back for the rest
+		q.signal()
+	}
+	return packet, true
+}
+
+// Ready is signaled whenever there may be packets to pop
+func (q *SendQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Drain drops every packet queued, e.g. for a stream that broke
+func (q *SendQueue) Drain() {
+	for {
+		if _, ok := q.Pop(); !ok {
+			return
+		}
+	}
+}
+
+func (q *SendQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.high.count + q.low.count
+}
+
+func (q *SendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
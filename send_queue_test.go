@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+)
+
+func queued(q *SendQueue) string {
+	var got []byte
+	for packet, ok := q.Pop(); ok; packet, ok = q.Pop() {
+		got = append(got, packet.data...)
+	}
+	return string(got)
+}
+
+func TestSendQueue(t *testing.T) {
+	tests := []struct {
+		policy dropPolicy
+		pushes []string
+		priority []bool
+		expect string
+		dropped int
+	}{
+		{ dropTail, []string{ "a", "b", "c" }, []bool{ false, false, false }, "abc", 0 },
+		{ dropTail, []string{ "a", "b", "c", "d", "e" }, []bool{ false, false, false, false, false }, "abc", 2 },
+		{ dropOldest, []string{ "a", "b", "c", "d", "e" }, []bool{ false, false, false, false, false }, "cde", 2 },
+		// priority packets go first and have room of their own
+		{ dropTail, []string{ "a", "b", "c", "X", "d", "Y" }, []bool{ false, false, false, true, false, true }, "XYabc", 1 },
+		{ dropOldest, []string{ "X", "Y", "Z", "W", "a" }, []bool{ true, true, true, true, false }, "YZWa", 1 },
+	}
+	for i, test := range tests {
+		q := NewSendQueue("test", 3, test.policy)
+		dropped := q.metrics.dropped.Value()
+		refused := 0
+		for j, push := range test.pushes {
+			if !q.Push(outPacket{ []byte(push), nil, nil }, test.priority[j]) {
+				refused++
+			}
+		}
+		if got := queued(q); got != test.expect {
+			t.Errorf("Expect %q popped from queue %d but got %q\n", test.expect, i, got)
+		}
+		if got := int(q.metrics.dropped.Value() - dropped); got != test.dropped {
+			t.Errorf("Expect %d dropped by queue %d but got %d\n", test.dropped, i, got)
+		}
+		if test.policy == dropTail && refused != test.dropped {
+			t.Errorf("Expect %d refused by queue %d but got %d\n", test.dropped, i, refused)
+		}
+		if q.Len() != 0 {
+			t.Errorf("Expect queue %d empty but got %d\n", i, q.Len())
+		}
+	}
+}
+
+func TestSendQueueReady(t *testing.T) {
+	q := NewSendQueue("test", 4, dropTail)
+	select {
+	case <-q.Ready():
+		t.Errorf("Expect empty queue not ready\n")
+	default:
+	}
+	q.Push(outPacket{ []byte("a"), nil, nil }, false)
+	q.Push(outPacket{ []byte("b"), nil, nil }, false)
+	<-q.Ready()
+	if _, ok := q.Pop(); !ok {
+		t.Fatalf("Expect packet popped\n")
+	}
+	// a writer taking one packet at a time is woken for the rest
+	select {
+	case <-q.Ready():
+	default:
+		t.Errorf("Expect queue ready with a packet left\n")
+	}
+	q.Drain()
+	if q.Len() != 0 {
+		t.Errorf("Expect queue drained but got %d\n", q.Len())
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	tests := []struct {
+		value string
+		expect dropPolicy
+		ok bool
+	}{
+		{ "", dropTail, true },
+		{ "tail", dropTail, true },
+		{ "oldest", dropOldest, true },
+		{ "head", dropTail, false },
+	}
+	for _, test := range tests {
+		got, err := parseDropPolicy(test.value)
+		if (err == nil) != test.ok || (test.ok && got != test.expect) {
+			t.Errorf("Expect %v, %v for %q but got %v, %v\n", test.expect, test.ok, test.value, got, err)
+		}
+	}
+}
+
+func TestIsPriorityPacket(t *testing.T) {
+	packet := func(protocol, dport byte, length int) []byte {
+		packet := make([]byte, length)
+		packet[0], packet[9], packet[23] = 0x45, protocol, dport
+		return packet
+	}
+	bonded := func(packet []byte) []byte {
+		header := make([]byte, bondHeaderLength)
+		header[0] = bondData
+		return append(header, packet...)
+	}
+	tests := []struct { packet []byte; expect bool } {
+		{ packet(17, 53, 512), true },
+		{ packet(1, 0, 512), true },
+		{ bonded(packet(17, 53, 100)), true },
+		// small packets of a flow stay behind the large ones sent before
+		{ packet(6, 80, 40), false },
+		{ packet(17, 80, 100), false },
+		{ bonded(packet(6, 80, 40)), false },
+		{ []byte{ ctrlKeepalive, 0, 0, 0 }, true },
+		{ []byte{ bondProbe, 0, 0, 0 }, true },
+		{ markFrame(make([]byte, etherHeaderLength)), false },
+		{ nil, false },
+	}
+	for idx, test := range tests {
+		if isPriorityPacket(test.packet) != test.expect {
+			t.Errorf("Expect %dth packet priority %v\n", idx+1, test.expect)
+		}
+	}
+}
@@ -2,16 +2,64 @@ package main
 
 import (
 	"gopkg.in/ini.v1"
+	"net"
 )
 
+var (
+	svrNoRoute = NewCounter("server_no_route_total", "Packets from device dropped for having no client route")
+	svrSpoofed = NewCounter("server_spoofed_total", "Packets from clients dropped for not using their leased address")
+	svrClaimed = NewCounter("server_claimed_total", "Packets from clients dropped for using an address another client owns")
+)
+
+// leaseHolder is implemented by the sessions of clients which may be leased an address
+type leaseHolder interface {
+
+	Lease() *Lease
+
+}
+
+type ServerContext struct {
+	routes *RouteTable
+	undeliverable undeliverableHandler
+}
+
 func startServer(device TunTap, common, server *ini.Section) {
-	tunnel, err := NewServerTunnel(common, server)
+	var pool *AddressPool
+	if cidr := server.Key("pool").String(); cidr != "" {
+		var err error
+		pool, err = NewAddressPool(cidr, server.Key("pool_dns").String(), server.Key("pool_mtu").MustInt(0))
+		if err != nil {
+			Error.Printf("Bad address pool %s: %v\n", cidr, err)
+			return
+		}
+		if err := ConfigureDevice(device.Name(), pool.Gateway(), pool.Gateway(), pool.Prefix(), pool.mtu); err != nil {
+			Error.Printf("Failed to configure %s: %v\n", device.Name(), err)
+		}
+	}
+	var onUndeliverable undeliverableHandler
+	if common.Key("mode").String() != "bridge" {
+		// bridged frames are not answered, they are not IP packets
+		onUndeliverable = icmpErrorsTo(device)
+	}
+	tunnel, err := NewServerTunnel(common, server, pool, onUndeliverable)
 	if err != nil {
 		Error.Printf("Failed to start server tunnel: %v\n", err)
 		return
 	}
-	device.SetHandler(func (_ TunTap, content []byte) { svrDeviceReceived(device, tunnel, content) })
-	tunnel.SetHandler(func (_ Tunnel, content []byte) { svrTunnelReceived(device, tunnel, content) })
+	if common.Key("mode").String() == "bridge" {
+		startBridgeServer(device, tunnel, serverSessionTimeout(server))
+		return
+	}
+	ctx := ServerContext{
+		NewRouteTable(serverSessionTimeout(server)),
+		onUndeliverable,
+	}
+	if ethernet, ok := device.(*EthernetDevice); ok {
+		// clients are behind the device once a route to them is learned
+		ethernet.SetOwned(func (ip net.IP) bool { return ctx.routes.Lookup(ip) != nil })
+	}
+	device.SetHandler(func (_ TunTap, content []byte) { ctx.svrDeviceReceived(device, content) })
+	tunnel.SetHandler(func (session Tunnel, content []byte) { ctx.svrTunnelReceived(device, session, content) })
 
 	//f, err := os.Create("profiling")
 	//if err != nil {
@@ -27,10 +75,35 @@ func startServer(device TunTap, common, server *ini.Section) {
 	//}()
 }
 
-func svrDeviceReceived(_ TunTap, tunnel Tunnel, content []byte) {
-	tunnel.Send(content)
+func (ctx *ServerContext) svrDeviceReceived(_ TunTap, content []byte) {
+	dst := packetDstIP(content)
+	if dst == nil {
+		return
+	}
+	session := ctx.routes.Lookup(dst)
+	if session == nil {
+		svrNoRoute.Inc()
+		Debug.Printf("no route to %v, skip %d bytes\n", dst, len(content))
+		ctx.undeliverable.report(content, unreachableHost, 0)
+		return
+	}
+	deviceToTunnel.Count(content)
+	session.Send(clampPacketMSS(content, session))
 }
 
-func svrTunnelReceived(device TunTap, _ Tunnel, content []byte) {
-	device.Send(content)
-}
\ No newline at end of file
+func (ctx *ServerContext) svrTunnelReceived(device TunTap, session Tunnel, content []byte) {
+	if src := packetSrcIP(content); src != nil {
+		if s, ok := session.(leaseHolder); ok && s.Lease() != nil && !s.Lease().addr.Equal(src) {
+			svrSpoofed.Inc()
+			Debug.Printf("%v sent from %v instead of its lease\n", s, src)
+			return
+		}
+		if !ctx.routes.Claim(src, session) {
+			svrClaimed.Inc()
+			Debug.Printf("%v sent from %v which %v owns\n", session, src, ctx.routes.Lookup(src))
+			return
+		}
+	}
+	tunnelToDevice.Count(content)
+	device.Send(clampPacketMSS(content, session))
+}
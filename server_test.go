@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerRouteClaimed(t *testing.T) {
+	device := &fakeTunTap{}
+	ctx := ServerContext{ NewRouteTable(100 * time.Millisecond), nil }
+	alice, bob := &fakeTunnel{}, &fakeTunnel{}
+	inner, outer := net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8")
+
+	ctx.svrTunnelReceived(device, alice, udpPacket(inner, outer, 1000, 53, []byte("alice")))
+	ctx.svrTunnelReceived(device, bob, udpPacket(inner, outer, 1000, 53, []byte("bob")))
+	if len(device.sent) != 1 {
+		t.Errorf("Expect the packet of bob dropped but got %d packets", len(device.sent))
+	}
+	ctx.svrDeviceReceived(device, udpPacket(outer, inner, 53, 1000, []byte("reply")))
+	if len(alice.sent) != 1 || len(bob.sent) != 0 {
+		t.Errorf("Expect the reply to alice but got %d %d", len(alice.sent), len(bob.sent))
+	}
+
+	// the address is free again once alice is idle
+	time.Sleep(150 * time.Millisecond)
+	ctx.svrTunnelReceived(device, bob, udpPacket(inner, outer, 1000, 53, []byte("bob")))
+	ctx.svrTunnelReceived(device, alice, udpPacket(inner, outer, 1000, 53, []byte("alice")))
+	if len(device.sent) != 2 {
+		t.Errorf("Expect the packet of alice dropped but got %d packets", len(device.sent))
+	}
+	ctx.svrDeviceReceived(device, udpPacket(outer, inner, 53, 1000, []byte("reply")))
+	if len(alice.sent) != 1 || len(bob.sent) != 1 {
+		t.Errorf("Expect the reply to bob but got %d %d", len(alice.sent), len(bob.sent))
+	}
+}
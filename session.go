@@ -0,0 +1,335 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSessionTimeout is how long an idle peer is remembered unless
+// session_timeout says otherwise
+const defaultSessionTimeout = 10 * time.Minute
+
+var (
+	sessionsCreated = NewCounter("tunnel_sessions_created_total", "Sessions created by listening tunnels")
+	sessionsExpired = NewCounter("tunnel_sessions_expired_total", "Sessions removed after being idle")
+)
+
+// sessionOwner is the listening tunnel which actually writes the packets of its
+// sessions, sealed with sealer or the shared secret if it is nil
+type sessionOwner interface {
+
+	sendTo(addr net.Addr, sealer Obscurer, content []byte)
+
+	SetHandler(handler func (Tunnel, []byte))
+
+}
+
+// senderTeller is implemented by obscurers whose packets tell the process
+// which sealed them. It can not be forged without the secret, so the replay
+// window of a sender follows it across addresses
+type senderTeller interface {
+
+	sender(packet []byte) (uint32, bool)
+
+}
+
+// senderWindow is the replay window of a sender, kept as long as its sessions
+type senderWindow struct {
+	replay *ReplayWindow
+	lastSeen int64
+}
+
+// Session is one remote peer of a listening tunnel, it is handed to the tunnel
+// handler so that replies sent through it reach only that peer
+type Session struct {
+	id string
+	name string
+	owner sessionOwner
+	addr atomic.Value
+	replay *ReplayWindow
+	lastSeen int64
+	lease *Lease
+	// obscurer holds the keys of a handshaked session, nil without authentication
+	obscurer Obscurer
+}
+
+func (s *Session) Send(content []byte) {
+	s.owner.sendTo(s.Addr(), s.obscurer, content)
+}
+
+// payloadMTU is that of the listening tunnel, 0 if it is unknown
+func (s *Session) payloadMTU() int {
+	if sizer, ok := s.owner.(payloadSizer); ok {
+		return sizer.payloadMTU()
+	}
+	return 0
+}
+
+func (s *Session) SetHandler(handler func (Tunnel, []byte)) {
+	s.owner.SetHandler(handler)
+}
+
+func (s *Session) Addr() net.Addr {
+	return s.addr.Load().(net.Addr)
+}
+
+func (s *Session) ID() string {
+	return s.id
+}
+
+func (s *Session) Name() string {
+	return s.name
+}
+
+// Lease returns the inner addressing leased to the peer, nil if no pool is configured
+func (s *Session) Lease() *Lease {
+	return s.lease
+}
+
+func (s *Session) String() string {
+	if s.name == "" {
+		return s.Addr().String()
+	}
+	return s.name + "@" + s.Addr().String()
+}
+
+func (s *Session) touch(now int64) {
+	atomic.StoreInt64(&s.lastSeen, now)
+}
+
+type SessionTable struct {
+	lock sync.RWMutex
+	owner sessionOwner
+	sessions map[string]*Session
+	senders map[uint32]*senderWindow
+	auth *Authenticator
+	timeout time.Duration
+}
+
+// NewSessionTable creates the sessions of a listening tunnel, with auth set
+// only peers which completed the handshake get a session. Sessions idle for
+// timeout are removed
+func NewSessionTable(owner sessionOwner, auth *Authenticator, timeout time.Duration) *SessionTable {
+	st := &SessionTable{
+		sync.RWMutex{},
+		owner,
+		make(map[string]*Session),
+		make(map[uint32]*senderWindow),
+		auth,
+		timeout,
+	}
+	go st.expireLoop()
+	return st
+}
+
+func (st *SessionTable) get(id string) *Session {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return st.sessions[id]
+}
+
+// create adds the session of id, a handshaked one always replaces the session
+// the client had before as its keys are those of the latest handshake
+func (st *SessionTable) create(id, name string, addr net.Addr, replay *ReplayWindow, lease *Lease, obscurer Obscurer) *Session {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if s, ok := st.sessions[id]; ok && name == "" && s.name == "" {
+		return s
+	}
+	if name != "" {
+		// a client handshaking again from a new address replaces its old session
+		for oldID, old := range st.sessions {
+			if old.name == name {
+				delete(st.sessions, oldID)
+				st.release(old)
+				Info.Printf("session %v replaced\n", old)
+			}
+		}
+	}
+	s := &Session{ id: id, name: name, owner: st.owner, replay: replay, lease: lease, obscurer: obscurer }
+	s.addr.Store(addr)
+	st.sessions[id] = s
+	sessionsCreated.Inc()
+	Info.Printf("new session %v\n", s)
+	return s
+}
+
+// Receive restores packet on behalf of the peer identified by id, the session is
+// only created once a packet from the peer is restored successfully. With
+// authentication only the handshake is sealed with the shared secret
+func (st *SessionTable) Receive(id string, addr net.Addr, packet []byte, obscurer Obscurer) (*Session, []byte) {
+	s := st.get(id)
+	if st.auth != nil && sealedBySession(obscurer, packet) {
+		return st.receiveSealed(s, id, addr, packet)
+	}
+	sender, told := uint32(0), false
+	if teller, ok := obscurer.(senderTeller); ok {
+		sender, told = teller.sender(packet)
+	}
+	replay := st.replayWindow(s, sender, told)
+	received := restoreWith(obscurer, replay, packet)
+	if received == nil {
+		return nil, nil
+	}
+	now := time.Now().UnixNano()
+	if told {
+		st.keepWindow(sender, replay, now)
+	}
+	if st.auth != nil && !isHandshakeMessage(received) {
+		unauthenticatedDrops.Inc()
+		Debug.Printf("Drop packet not sealed with a session key from %v\n", addr)
+		if s == nil {
+			st.owner.sendTo(addr, nil, []byte{ ctrlReject })
+		}
+		return nil, nil
+	}
+	if isControl(received) {
+		st.control(s, id, addr, replay, received)
+		return nil, nil
+	}
+	if s == nil {
+		s = st.create(id, "", addr, replay, nil, nil)
+	}
+	s.touch(now)
+	return s, received
+}
+
+// receiveSealed restores a packet sealed with the key of the session of id, a
+// peer without session is told to handshake again, e.g. after we restarted
+func (st *SessionTable) receiveSealed(s *Session, id string, addr net.Addr, packet []byte) (*Session, []byte) {
+	if s == nil || s.obscurer == nil {
+		unauthenticatedDrops.Inc()
+		Debug.Printf("Drop packet from unauthenticated %v\n", addr)
+		st.owner.sendTo(addr, nil, []byte{ ctrlReject })
+		return nil, nil
+	}
+	received := restoreWith(s.obscurer, s.replay, packet)
+	if received == nil {
+		return nil, nil
+	}
+	s.touch(time.Now().UnixNano())
+	if isControl(received) {
+		st.control(s, id, addr, s.replay, received)
+		return nil, nil
+	}
+	return s, received
+}
+
+// replayWindow is that of the sender of a packet if the obscurer tells it,
+// so that a packet replayed from another address is caught as well
+func (st *SessionTable) replayWindow(s *Session, sender uint32, told bool) *ReplayWindow {
+	if told {
+		st.lock.RLock()
+		w, ok := st.senders[sender]
+		st.lock.RUnlock()
+		if ok {
+			return w.replay
+		}
+	} else if s != nil {
+		return s.replay
+	}
+	return NewReplayWindow()
+}
+
+// keepWindow remembers the window of a sender once a packet of it is restored,
+// a packet which fails to restore does not take any room
+func (st *SessionTable) keepWindow(sender uint32, replay *ReplayWindow, now int64) {
+	st.lock.RLock()
+	w, ok := st.senders[sender]
+	st.lock.RUnlock()
+	if ok {
+		atomic.StoreInt64(&w.lastSeen, now)
+		return
+	}
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if _, ok := st.senders[sender]; !ok {
+		st.senders[sender] = &senderWindow{ replay, now }
+	}
+}
+
+func (st *SessionTable) control(s *Session, id string, addr net.Addr, replay *ReplayWindow, msg []byte) {
+	if s != nil {
+		s.touch(time.Now().UnixNano())
+	}
+	switch msg[0] {
+	case ctrlHello, ctrlResponse:
+		if st.auth == nil {
+			Warning.Printf("%v requested handshake but authentication is disabled\n", addr)
+			return
+		}
+	}
+	switch msg[0] {
+	case ctrlHello:
+		if challenge := st.auth.Hello(id, msg); challenge != nil {
+			st.owner.sendTo(addr, nil, challenge)
+		}
+	case ctrlResponse:
+		result, ok := st.auth.Response(id, msg)
+		if !ok {
+			st.owner.sendTo(addr, nil, []byte{ ctrlReject })
+			return
+		}
+		// the session key is fresh, so is the window of its sequence numbers
+		s = st.create(id, result.name, addr, NewReplayWindow(), result.lease, result.obscurer)
+		s.touch(time.Now().UnixNano())
+		st.owner.sendTo(addr, nil, result.welcome)
+	case ctrlKeepalive, ctrlPMTUProbe:
+		if s == nil {
+			s = st.create(id, "", addr, replay, nil, nil)
+			s.touch(time.Now().UnixNano())
+		}
+		if msg[0] == ctrlPMTUProbe {
+			if len(msg) >= pmtuProbeHeaderLength {
+				st.owner.sendTo(addr, s.obscurer, []byte{ ctrlPMTUAck, msg[1], msg[2] })
+			}
+			return
+		}
+		st.owner.sendTo(addr, s.obscurer, []byte{ ctrlKeepaliveAck })
+	}
+}
+
+func (st *SessionTable) Sessions() []*Session {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	ret := make([]*Session, 0, len(st.sessions))
+	for _, s := range st.sessions {
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+func (st *SessionTable) expire() {
+	deadline := time.Now().UnixNano() - st.timeout.Nanoseconds()
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for id, s := range st.sessions {
+		if atomic.LoadInt64(&s.lastSeen) < deadline {
+			delete(st.sessions, id)
+			st.release(s)
+			sessionsExpired.Inc()
+			Info.Printf("session %v expired\n", s)
+		}
+	}
+	for sender, w := range st.senders {
+		if atomic.LoadInt64(&w.lastSeen) < deadline {
+			delete(st.senders, sender)
+		}
+	}
+}
+
+// release hands the lease of a removed session back to the pool, every
+// handshake took one
+func (st *SessionTable) release(s *Session) {
+	if s.lease != nil && st.auth != nil && st.auth.pool != nil {
+		st.auth.pool.Release(credentialName(s.name))
+	}
+}
+
+func (st *SessionTable) expireLoop() {
+	for range time.Tick(time.Minute) {
+		st.expire()
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type recordingOwner struct {
+	sent [][]byte
+}
+
+func (o *recordingOwner) sendTo(_ net.Addr, _ Obscurer, content []byte) {
+	o.sent = append(o.sent, copyBytes(content))
+}
+
+func (o *recordingOwner) SetHandler(func (Tunnel, []byte)) {
+}
+
+func TestSessionReplayFromOtherAddress(t *testing.T) {
+	obscurer, _ := NewAEADObscurer("secret")
+	st := NewSessionTable(&recordingOwner{}, nil, time.Minute)
+	victim := &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1000 }
+	attacker := &net.UDPAddr{ IP: net.IPv4(198, 51, 100, 1), Port: 2000 }
+
+	sealed, _ := obscurer.Obscure(1400, []byte("E captured"))
+	captured := copyBytes(sealed)
+	if s, received := st.Receive(victim.String(), victim, sealed, obscurer); s == nil || string(received) != "E captured" {
+		t.Fatalf("Expect packet of victim received\n")
+	}
+	if s, _ := st.Receive(attacker.String(), attacker, captured, obscurer); s != nil {
+		t.Errorf("Expect packet replayed from another address dropped\n")
+	}
+	if n := len(st.Sessions()); n != 1 {
+		t.Errorf("Expect no session for the replayed packet but got %d sessions\n", n)
+	}
+
+	// the sender itself moving to another address keeps working
+	moved, _ := obscurer.Obscure(1400, []byte("E moved"))
+	if s, received := st.Receive(attacker.String(), attacker, moved, obscurer); s == nil || string(received) != "E moved" {
+		t.Errorf("Expect packet of the sender from a new address received\n")
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	obscurer, _ := NewAEADObscurer("secret")
+	st := NewSessionTable(&recordingOwner{}, nil, time.Minute)
+	addr := &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1000 }
+	sealed, _ := obscurer.Obscure(1400, []byte("E hello"))
+	s, _ := st.Receive(addr.String(), addr, sealed, obscurer)
+	if s == nil {
+		t.Fatalf("Expect session created\n")
+	}
+
+	st.expire()
+	if len(st.Sessions()) != 1 {
+		t.Errorf("Expect session kept within timeout\n")
+	}
+	s.touch(time.Now().Add(-2 * time.Minute).UnixNano())
+	for _, w := range st.senders {
+		w.lastSeen = s.lastSeen
+	}
+	st.expire()
+	if len(st.Sessions()) != 0 || len(st.senders) != 0 {
+		t.Errorf("Expect session and sender expired after timeout\n")
+	}
+}
+
+func TestSessionRequiresSessionKey(t *testing.T) {
+	shared, _ := NewAEADObscurer("shared")
+	owner := &recordingOwner{}
+	st := NewSessionTable(owner, NewAuthenticator(map[string]string { "alice": "secret" }), time.Minute)
+	addr := &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1000 }
+	h := &ClientHandshake{
+		credential: Credential{ "alice", []byte("secret") },
+		send: func(msg []byte) {
+			sealed, _ := shared.Obscure(1400, msg)
+			st.Receive(addr.String(), addr, sealed, shared)
+		},
+	}
+	h.hello()
+	h.Handle(owner.sent[len(owner.sent)-1])
+	h.Handle(owner.sent[len(owner.sent)-1])
+	if !h.Established() {
+		t.Fatalf("Expect client established\n")
+	}
+
+	sealed, _ := shared.Obscure(1400, []byte("E shared"))
+	if s, _ := st.Receive(addr.String(), addr, sealed, shared); s != nil {
+		t.Errorf("Expect data sealed with the shared secret dropped\n")
+	}
+	sealed, _ = h.Obscurer().Obscure(1400, []byte("E session"))
+	captured := copyBytes(sealed)
+	if s, received := st.Receive(addr.String(), addr, sealed, shared); s == nil || s.Name() != "alice" || string(received) != "E session" {
+		t.Errorf("Expect data sealed with the session key received\n")
+	}
+	if s, _ := st.Receive(addr.String(), addr, copyBytes(captured), shared); s != nil {
+		t.Errorf("Expect replayed data dropped\n")
+	}
+
+	other := &net.UDPAddr{ IP: net.IPv4(198, 51, 100, 1), Port: 2000 }
+	sent := len(owner.sent)
+	if s, _ := st.Receive(other.String(), other, captured, shared); s != nil {
+		t.Errorf("Expect data of a session from another address dropped\n")
+	}
+	if len(owner.sent) != sent + 1 || owner.sent[sent][0] != ctrlReject {
+		t.Errorf("Expect peer without session rejected\n")
+	}
+}
+
+func TestSessionReleasesLease(t *testing.T) {
+	auth := NewAuthenticator(map[string]string { "alice": "secret" })
+	pool, _ := NewAddressPool("10.8.0.0/24", "", 0)
+	auth.SetPool(pool)
+	st := NewSessionTable(&recordingOwner{}, auth, time.Minute)
+	addr := &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 1000 }
+	moved := &net.UDPAddr{ IP: net.IPv4(192, 0, 2, 1), Port: 2000 }
+
+	// a handshake from a new address replaces the session and its lease
+	for _, a := range []*net.UDPAddr{ addr, moved } {
+		lease, _ := pool.Lease("alice")
+		st.create(a.String(), "alice", a, NewReplayWindow(), lease, nil).touch(time.Now().UnixNano())
+	}
+	if pool.holders["alice"] != 1 {
+		t.Errorf("Expect lease held by the latest session only but got %d holders\n", pool.holders["alice"])
+	}
+	st.get(moved.String()).touch(time.Now().Add(-2 * time.Minute).UnixNano())
+	st.expire()
+	if _, ok := pool.leases["alice"]; ok {
+		t.Errorf("Expect lease released once the session expired\n")
+	}
+}
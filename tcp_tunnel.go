@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tcpMaxFrame = 0xffff
+	tcpDialTimeout = 10 * time.Second
+	tcpMaxBackoff = 30 * time.Second
+)
+
+var tcpDropped = NewCounter("tcp_tunnel_dropped_total", "Packets dropped by tcp tunnels for being disconnected or congested")
+
+// tcpConn is one stream of a listening tcp tunnel
+type tcpConn struct {
+	conn net.Conn
+	queue *SendQueue
+}
+
+// TCPTunnelImpl frames obscured packets with a 2 bytes length over a long lived
+// stream, the connecting side re-dials whenever the stream breaks
+type TCPTunnelImpl struct {
+	handler func (Tunnel, []byte)
+	obscurer Obscurer
+	replay *ReplayWindow
+	sessions *SessionTable
+	handshake *ClientHandshake
+	keepalive *Keepalive
+	preConnected bool
+	remote string
+	queue *SendQueue
+	connected int32
+	current atomic.Value
+	lock sync.RWMutex
+	conns map[string]*tcpConn
+	undeliverable undeliverableHandler
+}
+
+func TCPConnect(addr string, port uint16, opts *TunnelOptions) (Tunnel, error) {
+	remote := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	if _, err := net.ResolveTCPAddr("tcp", remote); err != nil {
+		return nil, err
+	}
+	// remote is resolved on every dial so that a moved server is followed
+	tunnel := &TCPTunnelImpl{
+		obscurer: opts.getObscurer(),
+		undeliverable: opts.getOnUndeliverable(),
+		replay: NewReplayWindow(),
+		preConnected: true,
+		remote: remote,
+		queue: NewSendQueue("tcp_tunnel", tunnelQueueLength, sendQueuePolicy),
+	}
+	if credential := opts.getCredential(); credential != nil {
+		tunnel.handshake = NewClientHandshake(*credential, func(msg []byte) { tunnel.sendTo(nil, nil, msg) }, opts.getOnLease())
+	}
+	tunnel.keepalive = opts.newKeepalive(func(msg []byte) { tunnel.sendTo(nil, tunnel.handshake.Obscurer(), msg) }, tunnel.reconnect)
+	go tunnel.connectLoop()
+	return tunnel, nil
+}
+
+func TCPListen(addr string, port uint16, opts *TunnelOptions) (Tunnel, error) {
+	listener, err := net.Listen(underlayNetwork("tcp", net.ParseIP(addr)), net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, err
+	}
+	tunnel := &TCPTunnelImpl{
+		obscurer: opts.getObscurer(),
+		undeliverable: opts.getOnUndeliverable(),
+		conns: make(map[string]*tcpConn),
+	}
+	tunnel.sessions = NewSessionTable(tunnel, opts.getAuth(), opts.getSessionTimeout())
+	go tunnel.acceptLoop(listener)
+	return tunnel, nil
+}
+
+func (t *TCPTunnelImpl) Send(content []byte) {
+	if !t.preConnected {
+		Warning.Printf("No destination, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableNet, 0)
+		return
+	}
+	if !t.handshake.Established() {
+		Debug.Printf("Handshake not established, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableHost, 0)
+		return
+	}
+	t.sendTo(nil, t.handshake.Obscurer(), content)
+}
+
+func (t *TCPTunnelImpl) sendTo(addr net.Addr, sealer Obscurer, content []byte) {
+	var queue *SendQueue
+	if t.preConnected {
+		if atomic.LoadInt32(&t.connected) == 0 {
+			tcpDropped.Inc()
+			Debug.Printf("Not connected, skip %v bytes\n", len(content))
+			t.undeliverable.report(content, unreachableHost, 0)
+			return
+		}
+		queue = t.queue
+	} else {
+		t.lock.RLock()
+		c, ok := t.conns[addr.String()]
+		t.lock.RUnlock()
+		if !ok {
+			tcpDropped.Inc()
+			Debug.Printf("Connection of %v closed, skip %v bytes\n", addr, len(content))
+			t.undeliverable.report(content, unreachableHost, 0)
+			return
+		}
+		queue = c.queue
+	}
+
+	buf := getPacketBuffer()
+	obscured := obscureInto(sealerOf(t.obscurer, sealer, content), buf, tcpMaxFrame, content)
+	if !samePlace(obscured, buf) {
+		putPacketBuffer(buf)
+	}
+	if obscured == nil {
+		t.undeliverable.report(content, unreachableTooBig, tcpMaxFrame - obscurerOverhead(t.obscurer))
+		return
+	}
+	// a congested stream must not hold up the device reader
+	if !queue.Push(outPacket{ obscured, nil, nil }, isPriorityPacket(content)) {
+		putPacketBuffer(obscured)
+		tcpDropped.Inc()
+		Debug.Printf("Stream to %v congested, skip %v bytes\n", addr, len(content))
+		t.undeliverable.report(content, unreachableHost, 0)
+	}
+}
+
+// Alive tells whether the server is handshaked and heard from recently
+func (t *TCPTunnelImpl) Alive() bool {
+	return t.handshake.Established() && t.keepalive.Alive()
+}
+
+func (t *TCPTunnelImpl) SetHandler(handler func (Tunnel, []byte)) {
+	t.handler = handler
+}
+
+// currentDestination is the server of the current stream, or the one being
+// dialed if there is none
+func (t *TCPTunnelImpl) currentDestination() string {
+	if conn, ok := t.current.Load().(net.Conn); ok && atomic.LoadInt32(&t.connected) == 1 {
+		return conn.RemoteAddr().String()
+	}
+	return t.remote
+}
+
+// reconnect breaks the current stream, connectLoop dials again
+func (t *TCPTunnelImpl) reconnect() {
+	if conn, ok := t.current.Load().(net.Conn); ok {
+		_ = conn.Close()
+	}
+}
+
+func (t *TCPTunnelImpl) connectLoop() {
+	backoff := time.Second
+	redial := false
+	for {
+		conn, err := net.DialTimeout("tcp", t.remote, tcpDialTimeout)
+		if err != nil {
+			Error.Printf("Failed to connect to %v, retry in %v, err: %v\n", t.remote, backoff, err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > tcpMaxBackoff {
+				backoff = tcpMaxBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		t.current.Store(conn)
+		if redial {
+			tunnelDestinationChanges.Inc()
+		}
+		redial = true
+		Info.Printf("tunnel connected to %v\n", conn.RemoteAddr())
+
+		// drop whatever was queued for the previous stream
+		t.queue.Drain()
+		atomic.StoreInt32(&t.connected, 1)
+		if t.handshake != nil {
+			t.handshake.Restart()
+		}
+
+		t.serve(conn, t.queue, func(packet []byte) {
+			received := restoreFromServer(t.obscurer, t.replay, t.handshake, packet)
+			if received != nil {
+				t.keepalive.Received()
+				dispatch(t, t.handshake, t.handler, received)
+			}
+		})
+		atomic.StoreInt32(&t.connected, 0)
+		Warning.Printf("tunnel to %v disconnected\n", t.remote)
+	}
+}
+
+func (t *TCPTunnelImpl) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			Error.Printf("Failed to accept, err: %v\n", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go t.serveAccepted(conn)
+	}
+}
+
+func (t *TCPTunnelImpl) serveAccepted(conn net.Conn) {
+	id := conn.RemoteAddr().String()
+	c := &tcpConn{ conn, NewSendQueue("tcp_tunnel", tunnelQueueLength, sendQueuePolicy) }
+	t.lock.Lock()
+	t.conns[id] = c
+	t.lock.Unlock()
+	Debug.Printf("accepted stream from %v\n", id)
+
+	t.serve(conn, c.queue, func(packet []byte) {
+		session, received := t.sessions.Receive(id, conn.RemoteAddr(), packet, t.obscurer)
+		if received != nil {
+			dispatch(session, nil, t.handler, received)
+		}
+	})
+
+	t.lock.Lock()
+	delete(t.conns, id)
+	t.lock.Unlock()
+	Debug.Printf("stream from %v closed\n", id)
+}
+
+// serve pumps conn in both directions until either of them fails
+func (t *TCPTunnelImpl) serve(conn net.Conn, queue *SendQueue, onPacket func([]byte)) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetKeepAlive(true)
+		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+	done := make(chan struct{})
+	go func() {
+		if err := readFrames(conn, onPacket); err != nil && err != io.EOF {
+			Error.Printf("Failed to receive from %v, err: %v\n", conn.RemoteAddr(), err)
+		}
+		close(done)
+	}()
+	if err := writeFrames(conn, queue, done); err != nil {
+		Error.Printf("Failed to send to %v, err: %v\n", conn.RemoteAddr(), err)
+	}
+	_ = conn.Close()
+	<-done
+}
+
+func readFrames(r io.Reader, onPacket func([]byte)) error {
+	reader := bufio.NewReaderSize(r, 64 * 1024)
+	header := make([]byte, 2)
+	buf := make([]byte, tcpMaxFrame)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(reader, buf[:n]); err != nil {
+			return err
+		}
+		Debug.Printf("received %d bytes\n", n)
+		onPacket(buf[:n])
+	}
+}
+
+// writeFrames coalesces whatever is queued into as few writes as possible
+func writeFrames(w io.Writer, queue *SendQueue, done chan struct{}) error {
+	writer := bufio.NewWriterSize(w, 64 * 1024)
+	header := make([]byte, 2)
+	write := func(packet []byte) error {
+		binary.BigEndian.PutUint16(header, uint16(len(packet)))
+		if _, err := writer.Write(header); err != nil {
+			return err
+		}
+		_, err := writer.Write(packet)
+		return err
+	}
+	for {
+		select {
+		case <-queue.Ready():
+		case <-done:
+			return nil
+		}
+		for packet, ok := queue.Pop(); ok; packet, ok = queue.Pop() {
+			err := write(packet.data)
+			// the writer copied it or wrote it through already
+			putPacketBuffer(packet.data)
+			if err != nil {
+				return err
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	var stream bytes.Buffer
+	queue := NewSendQueue("test", 3, dropTail)
+	done := make(chan struct{})
+	queue.Push(outPacket{ []byte("a"), nil, nil }, false)
+	queue.Push(outPacket{ make([]byte, 1500), nil, nil }, false)
+	queue.Push(outPacket{ []byte("ccc"), nil, nil }, false)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+	if err := writeFrames(&stream, queue, done); err != nil {
+		t.Fatalf("Failed to write frames: %v", err)
+	}
+
+	var lengths []int
+	_ = readFrames(&stream, func(packet []byte) {
+		lengths = append(lengths, len(packet))
+	})
+	if len(lengths) != 3 || lengths[0] != 1 || lengths[1] != 1500 || lengths[2] != 3 {
+		t.Errorf("Want frames of 1, 1500, 3 bytes but got %v", lengths)
+	}
+}
+
+func TestTCPEcho(t *testing.T) {
+	server, err := TCPListen("127.0.0.1", 11121, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen TCP: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, b []byte) {
+		session.Send(append([]byte("E "), b...))
+	})
+
+	client, err := TCPConnect("127.0.0.1", 11121, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect TCP: %v", err)
+	}
+	received := make(chan string, 1)
+	client.SetHandler(func(_ Tunnel, b []byte) {
+		received <- string(b)
+	})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.Send([]byte("E hello"))
+		select {
+		case r := <-received:
+			if r != "E E hello" {
+				t.Errorf("Want E E hello but got %s", r)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for echo")
+		}
+	}
+}
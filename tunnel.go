@@ -2,9 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"gopkg.in/ini.v1"
+	"net"
+	"syscall"
+	"time"
 )
 
+// Tunnel handlers receive the tunnel to reply through, for listening tunnels
+// it is the *Session of the remote peer which sent the packet
 type Tunnel interface {
 
 	Send(content []byte)
@@ -13,43 +19,395 @@ type Tunnel interface {
 
 }
 
-func NewClientTunnel(common, client *ini.Section) (Tunnel, error) {
-	tunnelType := common.Key("type").String()
+// destinationReporter is implemented by connecting tunnels which tell where
+// they send to
+type destinationReporter interface {
+
+	currentDestination() string
+
+}
+
+// tunnelDestination describes where tunnel sends to, empty if it does not tell
+func tunnelDestination(tunnel Tunnel) string {
+	if reporter, ok := tunnel.(destinationReporter); ok {
+		return reporter.currentDestination()
+	}
+	return ""
+}
+
+// outPacket is an obscured packet queued for sending, addr is nil on connected
+// tunnels. If seal is set data is not obscured yet, the writer seals it with
+// seal, e.g. once FEC has encoded it
+type outPacket struct {
+	data []byte
+	addr net.Addr
+	seal Obscurer
+}
+
+// TunnelOptions carries the settings shared by all tunnel types, nil means defaults
+type TunnelOptions struct {
+	obscurer Obscurer
+	// credential makes a connecting tunnel handshake before sending data
+	credential *Credential
+	// auth makes a listening tunnel accept only handshaked peers
+	auth *Authenticator
+	// onLease receives the addressing pushed by the server during handshake
+	onLease func(*Lease)
+	// keepalive is how often a connecting tunnel pings the server
+	keepalive time.Duration
+	// peerTimeout is how long the server may stay silent before reconnecting
+	peerTimeout time.Duration
+	// local is the address a connecting tunnel sends from, nil lets routing choose
+	local net.IP
+	// fecData and fecParity are the shards of a FEC group, no FEC if 0
+	fecData int
+	fecParity int
+	// pmtu makes a connecting tunnel probe the path MTU
+	pmtu bool
+	// onMTU receives the largest packet a connecting tunnel carries whole
+	// every time the path MTU changes
+	onMTU func(int)
+	// onUndeliverable receives the packets dropped for not being deliverable
+	onUndeliverable undeliverableHandler
+	// sessionTimeout is how long a listening tunnel remembers an idle peer
+	sessionTimeout time.Duration
+}
+
+func (opts *TunnelOptions) getObscurer() Obscurer {
+	if opts == nil {
+		return nil
+	}
+	return opts.obscurer
+}
+
+func (opts *TunnelOptions) getCredential() *Credential {
+	if opts == nil {
+		return nil
+	}
+	return opts.credential
+}
+
+func (opts *TunnelOptions) getAuth() *Authenticator {
+	if opts == nil {
+		return nil
+	}
+	return opts.auth
+}
+
+func (opts *TunnelOptions) getOnLease() func(*Lease) {
+	if opts == nil {
+		return nil
+	}
+	return opts.onLease
+}
+
+func (opts *TunnelOptions) getKeepalive() time.Duration {
+	if opts == nil {
+		return 0
+	}
+	return opts.keepalive
+}
+
+func (opts *TunnelOptions) getPeerTimeout() time.Duration {
+	if opts == nil {
+		return 0
+	}
+	return opts.peerTimeout
+}
+
+func (opts *TunnelOptions) getLocal() net.IP {
+	if opts == nil {
+		return nil
+	}
+	return opts.local
+}
+
+func (opts *TunnelOptions) getOnUndeliverable() undeliverableHandler {
+	if opts == nil {
+		return nil
+	}
+	return opts.onUndeliverable
+}
+
+func (opts *TunnelOptions) getSessionTimeout() time.Duration {
+	if opts == nil || opts.sessionTimeout == 0 {
+		return defaultSessionTimeout
+	}
+	return opts.sessionTimeout
+}
+
+// underlayConn is the socket a tunnel sends through, e.g. a *net.UDPConn
+type underlayConn interface {
+
+	syscall.Conn
+
+	LocalAddr() net.Addr
+
+}
+
+// newPathMTU probes the path MTU on behalf of a connecting tunnel, nil if
+// disabled or the socket can not be kept from fragmenting. Probing starts from
+// the MTU of the interface conn sends through
+func (opts *TunnelOptions) newPathMTU(conn underlayConn, v6 bool, ready func() bool, send func(int), payloadMTU func() int) *PathMTU {
+	if opts == nil || !opts.pmtu {
+		return nil
+	}
+	if err := setDontFragment(conn, v6); err != nil {
+		Warning.Printf("Failed to set don't fragment, path MTU is not probed: %v\n", err)
+		return nil
+	}
+	var local net.IP
+	switch addr := conn.LocalAddr().(type) {
+	case *net.UDPAddr:
+		local = addr.IP
+	case *net.IPAddr:
+		local = addr.IP
+	}
+	onMTU := opts.onMTU
+	return NewPathMTU(v6, interfaceMTU(local), ready, send, func(int) {
+		if onMTU != nil {
+			onMTU(payloadMTU())
+		}
+	})
+}
+
+// newFEC returns the FEC coders of a tunnel, both nil if FEC is off
+func (opts *TunnelOptions) newFEC() (*FECEncoder, *FECDecoder) {
+	if opts == nil || opts.fecData == 0 {
+		return nil, nil
+	}
+	return NewFECEncoder(opts.fecData, opts.fecParity), NewFECDecoder()
+}
+
+// newKeepalive pings through send on behalf of a connecting tunnel
+func (opts *TunnelOptions) newKeepalive(send func([]byte), onDead func()) *Keepalive {
+	return NewKeepalive(opts.getKeepalive(), opts.getPeerTimeout(), send, onDead)
+}
+
+func newTunnelOptions(common *ini.Section) (*TunnelOptions, error) {
+	obscurer, err := NewObscurer(common.Key("secret").String())
+	if err != nil {
+		return nil, err
+	}
+	opts := &TunnelOptions{
+		obscurer: obscurer,
+		keepalive: time.Duration(common.Key("keepalive").MustInt(25)) * time.Second,
+		pmtu: common.Key("pmtu").MustBool(true),
+	}
+	if fec := common.Key("fec").String(); fec != "" {
+		if opts.fecData, opts.fecParity, err = parseFEC(fec); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+func NewClientTunnel(common, client *ini.Section, onLease func(*Lease), onMTU func(int), onUndeliverable undeliverableHandler) (Tunnel, error) {
+	opts, err := newTunnelOptions(common)
+	if err != nil {
+		return nil, err
+	}
+	opts.onMTU = onMTU
+	opts.onUndeliverable = onUndeliverable
+	opts.peerTimeout = time.Duration(client.Key("peer_timeout").MustInt(120)) * time.Second
+	if secret := client.Key("credential").String(); secret != "" {
+		if _, ok := opts.obscurer.(*AEADObscurer); !ok {
+			return nil, errors.New("credential requires secret, sessions are sealed with keys derived from both")
+		}
+		opts.credential = &Credential{ client.Key("name").String(), []byte(secret) }
+		opts.onLease = onLease
+	}
+	endpoints, err := parseEndpoints(client.Key("vps_addr").String())
+	if err != nil {
+		return nil, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.tunnel, err = newClientEndpoint(common.Key("type").String(), common, client, endpoint.addr, opts); err != nil {
+			return nil, fmt.Errorf("server %s: %v", endpoint.addr, err)
+		}
+	}
+	if len(endpoints) == 1 {
+		return endpoints[0].tunnel, nil
+	}
+	return NewFailoverTunnel(endpoints), nil
+}
+
+func newClientEndpoint(tunnelType string, common, client *ini.Section, vpsAddr string, opts *TunnelOptions) (Tunnel, error) {
 	switch tunnelType {
 	case "udp":
 		port, err := common.Key("port").Uint()
 		if err != nil {
 			return nil, err
 		}
-		return UDPConnect(client.Key("vps_addr").String(), uint16(port))
+		return UDPConnect(vpsAddr, uint16(port), opts)
+	case "tcp":
+		port, err := common.Key("port").Uint()
+		if err != nil {
+			return nil, err
+		}
+		return TCPConnect(vpsAddr, uint16(port), opts)
+	case "faketcp":
+		port, err := common.Key("port").Uint()
+		if err != nil {
+			return nil, err
+		}
+		return FakeTCPConnect(vpsAddr, uint16(port), uint16(client.Key("local_port").MustUint(0)), opts)
+	case "icmp":
+		return ICMPConnect(vpsAddr, opts)
 	case "raw":
 		protocol, err := common.Key("ip_proto").Uint()
 		if err != nil {
 			return nil, err
 		}
-		return RawConnect(client.Key("vps_addr").String(), uint8(protocol))
+		return RawConnect(vpsAddr, uint8(protocol), opts)
+	case "bond":
+		return NewBondTunnel(common, client, vpsAddr, opts)
 	default:
 		return nil, errors.New("bad client type: " + tunnelType)
 	}
 }
 
-func NewServerTunnel(common, server *ini.Section) (Tunnel, error) {
-	tunnelType := common.Key("type").String()
+func NewServerTunnel(common, server *ini.Section, pool *AddressPool, onUndeliverable undeliverableHandler) (Tunnel, error) {
+	opts, err := newTunnelOptions(common)
+	if err != nil {
+		return nil, err
+	}
+	opts.onUndeliverable = onUndeliverable
+	if filename := server.Key("credentials").String(); filename != "" {
+		if _, ok := opts.obscurer.(*AEADObscurer); !ok {
+			return nil, errors.New("credentials requires secret, sessions are sealed with keys derived from both")
+		}
+		opts.auth = LoadAuthenticator(filename)
+		opts.auth.SetPool(pool)
+	} else {
+		Warning.Printf("No credentials configured, any peer can use the tunnel\n")
+		if pool != nil {
+			Warning.Printf("Address pool is only leased during handshake, configure credentials to use it\n")
+		}
+	}
+	opts.sessionTimeout = serverSessionTimeout(server)
+	return newServerListener(common.Key("type").String(), common, server, opts)
+}
+
+// serverSessionTimeout is how long the server remembers an idle client, its
+// sessions and the routes learned from it
+func serverSessionTimeout(server *ini.Section) time.Duration {
+	return time.Duration(server.Key("session_timeout").MustInt(600)) * time.Second
+}
+
+func newServerListener(tunnelType string, common, server *ini.Section, opts *TunnelOptions) (Tunnel, error) {
 	switch tunnelType {
 	case "udp":
 		port, err := common.Key("port").Uint()
 		if err != nil {
 			return nil, err
 		}
-		return UDPListen(server.Key("listen").String(), uint16(port))
+		return UDPListen(server.Key("listen").String(), uint16(port), opts)
+	case "tcp":
+		port, err := common.Key("port").Uint()
+		if err != nil {
+			return nil, err
+		}
+		return TCPListen(server.Key("listen").String(), uint16(port), opts)
+	case "faketcp":
+		port, err := common.Key("port").Uint()
+		if err != nil {
+			return nil, err
+		}
+		return FakeTCPListen(server.Key("listen").String(), uint16(port), opts)
+	case "icmp":
+		return ICMPListen(server.Key("listen").String(), opts)
 	case "raw":
 		protocol, err := common.Key("ip_proto").Uint()
 		if err != nil {
 			return nil, err
 		}
-		return RawListen(server.Key("listen").String(), uint8(protocol))
+		return RawListen(server.Key("listen").String(), uint8(protocol), opts)
+	case "bond":
+		return NewBondListener(common, server, opts)
 	default:
 		return nil, errors.New("bad server type: " + tunnelType)
 	}
 }
 
+func obscurerOverhead(obscurer Obscurer) int {
+	if obscurer == nil {
+		obscurer = xorObscurer{}
+	}
+	return obscurer.Overhead()
+}
+
+func obscureWith(obscurer Obscurer, mss int, packet []byte) []byte {
+	return obscureInto(obscurer, nil, mss, packet)
+}
+
+// obscureInto obscures packet into dst if it has room, e.g. a pooled buffer
+func obscureInto(obscurer Obscurer, dst []byte, mss int, packet []byte) []byte {
+	if obscurer == nil {
+		obscurer = xorObscurer{}
+	}
+	ret, err := obscurer.ObscureTo(dst, mss, packet)
+	if err != nil {
+		tunnelObscureErrors.Inc()
+		Error.Printf("Error when obscure packet: %v\n", err)
+		return nil
+	}
+	return ret
+}
+
+func restoreWith(obscurer Obscurer, window *ReplayWindow, packet []byte) []byte {
+	if obscurer == nil {
+		obscurer = xorObscurer{}
+	}
+	ret, seq, err := obscurer.Restore(packet)
+	if err == errAuthentication {
+		tunnelAuthFailures.Inc()
+		Debug.Printf("Drop packet: %v\n", err)
+		return nil
+	} else if err != nil {
+		tunnelRestoreErrors.Inc()
+		Error.Printf("Error when restore packet: %v\n", err)
+		return nil
+	}
+	if !window.Accept(seq) {
+		return nil
+	}
+	return ret
+}
+
+// restoreFromServer restores a packet received by a connecting tunnel. Once it
+// handshakes, only handshake messages may be sealed with the shared secret,
+// the rest must be sealed with the key of the current session
+func restoreFromServer(shared Obscurer, window *ReplayWindow, handshake *ClientHandshake, packet []byte) []byte {
+	if handshake == nil {
+		return restoreWith(shared, window, packet)
+	}
+	if sealedBySession(shared, packet) {
+		session := handshake.current()
+		if session == nil {
+			unauthenticatedDrops.Inc()
+			return nil
+		}
+		return restoreWith(session.obscurer, session.replay, packet)
+	}
+	received := restoreWith(shared, window, packet)
+	if received != nil && !isHandshakeMessage(received) {
+		unauthenticatedDrops.Inc()
+		Debug.Printf("Drop packet not sealed with the session key\n")
+		return nil
+	}
+	return received
+}
+
+// dispatch hands a packet restored by a connected tunnel to its handshake or its handler
+func dispatch(t Tunnel, handshake *ClientHandshake, handler func (Tunnel, []byte), received []byte) {
+	if !isControl(received) {
+		if handler == nil {
+			Warning.Printf("no receive handler set, ignored %d bytes", len(received))
+			return
+		}
+		handler(t, received)
+	} else if handshake != nil {
+		handshake.Handle(received)
+	}
+}
@@ -15,52 +15,100 @@ type TunTap interface {
 
 }
 
+// tunTapQueue is one queue of a multi-queue device, each is read and written
+// by goroutines of its own
+type tunTapQueue struct {
+
+	device *water.Interface
+
+	queue *SendQueue
+
+}
+
+// TunTapImpl spreads the packets it writes over the queues of the device by
+// flow, so that packets of a flow keep their order. The kernel does the same
+// for the packets read, each queue is read by a worker running the handler
 type TunTapImpl struct {
 
-	sendCh chan []byte
+	queues []*tunTapQueue
 
-	device *water.Interface
+	tap bool
+
+	name string
 
 	handler func (TunTap, []byte)
 
 }
 
-func StartTun(tunName string) (TunTap, error) {
-	return startTunTap(water.TUN, tunName)
+func StartTun(tunName string, queues int) (TunTap, error) {
+	return startTunTap(water.TUN, tunName, queues)
 }
 
-func StartTap(tapName string) (TunTap, error) {
-	return startTunTap(water.TAP, tapName)
+func StartTap(tapName string, queues int) (TunTap, error) {
+	return startTunTap(water.TAP, tapName, queues)
 }
 
-func startTunTap(deviceType water.DeviceType, name string) (TunTap, error) {
-	tun, err := water.New(water.Config{
-		DeviceType: deviceType,
-		PlatformSpecificParams: PlatformSpecificParams(name),
-	})
-	if err != nil {
-		return nil, err
+func startTunTap(deviceType water.DeviceType, name string, queues int) (TunTap, error) {
+	if queues < 1 {
+		queues = 1
+	} else if queues > 1 && !multiQueueSupported {
+		Warning.Printf("Multi-queue devices are not supported, use 1 queue\n")
+		queues = 1
+	}
+	t := TunTapImpl{ nil, deviceType == water.TAP, name, nil }
+	for i := 0; i < queues; i++ {
+		tun, err := water.New(water.Config{
+			DeviceType: deviceType,
+			PlatformSpecificParams: PlatformSpecificParams(t.name),
+		})
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			Warning.Printf("Failed to open queue %d of %s, use %d queues, err: %v\n", i, t.name, i, err)
+			break
+		}
+		// the other queues attach to the device the first one created
+		t.name = tun.Name()
+		t.queues = append(t.queues, &tunTapQueue{ tun, NewSendQueue("device", deviceQueueLength, sendQueuePolicy) })
+	}
+	Info.Printf("tun device %s created with %d queues\n", t.name, len(t.queues))
+	for _, q := range t.queues {
+		go t.send(q)
+		go t.receive(q)
 	}
-	Info.Printf("tun device %s created\n", tun.Name())
-	t := TunTapImpl{make(chan []byte, 50), tun, nil }
-	go t.send()
-	go t.receive()
 	return &t, nil
 }
 
 func (t *TunTapImpl) Send(content []byte) {
-	t.sendCh <- copyBytes(content)
+	q := t.queues[0]
+	if len(t.queues) > 1 {
+		var hash uint32
+		if t.tap {
+			hash = frameFlowHash(content)
+		} else {
+			hash = flowHash(content)
+		}
+		q = t.queues[hash % uint32(len(t.queues))]
+	}
+	packet := copyToPacketBuffer(content)
+	if !q.queue.Push(outPacket{ packet, nil, nil }, isPriorityPacket(content)) {
+		putPacketBuffer(packet)
+		Debug.Printf("%s congested, skip %d bytes\n", t.Name(), len(content))
+	}
 }
 
-func (t *TunTapImpl) send() {
-	for  {
-		toSend := <- t.sendCh
-		n, err := t.device.Write(toSend)
-		if err != nil {
-			Error.Printf("%s failed to send %d bytes, err: %v\n", t.Name(), len(toSend), err)
-			continue
+func (t *TunTapImpl) send(q *tunTapQueue) {
+	for range q.queue.Ready() {
+		for toSend, ok := q.queue.Pop(); ok; toSend, ok = q.queue.Pop() {
+			n, err := q.device.Write(toSend.data)
+			putPacketBuffer(toSend.data)
+			if err != nil {
+				Error.Printf("%s failed to send %d bytes, err: %v\n", t.Name(), len(toSend.data), err)
+				continue
+			}
+			Debug.Printf("sent to %v %d bytes\n", t.Name(), n)
 		}
-		Debug.Printf("sent to %v %d bytes\n", t.Name(), n)
 	}
 }
 
@@ -68,10 +116,13 @@ func (t *TunTapImpl) SetHandler(handler func(TunTap, [] byte)) {
 	t.handler = handler
 }
 
-func (t *TunTapImpl) receive() {
-	buf := make([]byte, 1500)
+func (t *TunTapImpl) receive(q *tunTapQueue) {
+	// room for the Ethernet header in tap mode. The buffer is read into again
+	// once the handler returns, so a tunnel copies the packet into the pooled
+	// buffer it seals it in, which is the one copy on the way to the socket
+	buf := make([]byte, 2048)
 	for {
-		n, err := t.device.Read(buf)
+		n, err := q.device.Read(buf)
 		if err != nil {
 			Error.Println("error: read:", err)
 			os.Exit(1)
@@ -87,5 +138,5 @@ func (t *TunTapImpl) receive() {
 }
 
 func (t *TunTapImpl) Name() string {
-	return t.device.Name()
+	return t.name
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// ConfigureDevice assigns addr/prefix to the device and brings it up, peer is
+// the other end of the tunnel, mtu is left untouched when zero
+func ConfigureDevice(name string, addr, peer net.IP, prefix int, mtu int) error {
+	args := []string { name, "inet", addr.String(), peer.String(), "netmask", net.IP(net.CIDRMask(prefix, 32)).String() }
+	if mtu > 0 {
+		args = append(args, "mtu", strconv.Itoa(mtu))
+	}
+	if err := runCommand("ifconfig", append(args, "up")...); err != nil {
+		return err
+	}
+	network := &net.IPNet{ IP: addr.Mask(net.CIDRMask(prefix, 32)), Mask: net.CIDRMask(prefix, 32) }
+	return runCommand("route", "-q", "-n", "add", "-net", network.String(), "-interface", name)
+}
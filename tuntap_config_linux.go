@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net"
+	"strconv"
+)
+
+// ConfigureDevice assigns addr/prefix to the device and brings it up, peer is
+// the other end of the tunnel, mtu is left untouched when zero
+func ConfigureDevice(name string, addr, peer net.IP, prefix int, mtu int) error {
+	if err := runCommand("ip", "addr", "replace", addr.String() + "/" + strconv.Itoa(prefix), "dev", name); err != nil {
+		return err
+	}
+	args := []string { "link", "set", "dev", name }
+	if mtu > 0 {
+		args = append(args, "mtu", strconv.Itoa(mtu))
+	}
+	return runCommand("ip", append(args, "up")...)
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/songgao/water"
 )
 
+// multiQueueSupported tells whether a device may be opened once per queue
+const multiQueueSupported = false
+
 func PlatformSpecificParams(tunName string) water.PlatformSpecificParams {
 	return water.PlatformSpecificParams {
 		Name: tunName,
@@ -4,6 +4,9 @@ import (
 	"github.com/songgao/water"
 )
 
+// multiQueueSupported tells whether a device may be opened once per queue
+const multiQueueSupported = true
+
 func PlatformSpecificParams(name string) water.PlatformSpecificParams {
 	return water.PlatformSpecificParams {
 		Name: name,
@@ -1,30 +1,51 @@
 package main
 
 import (
-	"fmt"
 	"golang.org/x/net/ipv4"
 	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 var udpTxLength = 64
 var udpRxLength = 64
 
 type UDPTunnelImpl struct {
-	sendCh       chan []byte
+	queue        *SendQueue
 	handler      func (Tunnel, []byte)
-	conn         *ipv4.PacketConn
-	destination  *net.UDPAddr
+	conn         atomic.Value
+	v6           bool
+	destination  atomic.Value
 	preConnected bool
+	obscurer     Obscurer
+	replay       *ReplayWindow
+	sessions     *SessionTable
+	handshake    *ClientHandshake
+	keepalive    *Keepalive
+	remote       string
+	local        net.IP
+	fecEncoder   *FECEncoder
+	fecDecoder   *FECDecoder
+	pmtu         *PathMTU
+	reassembler  *Reassembler
+	undeliverable undeliverableHandler
 }
 
 func newUDPAddr() *net.UDPAddr {
 	return &net.UDPAddr{ IP: net.ParseIP("::"), Port: 0 }
 }
 
-func dupUDPAddr(dst, src *net.UDPAddr) {
-	copy(dst.IP, src.IP.To16())
-	dst.Port = src.Port
-	dst.Zone = src.Zone
+func copyUDPAddr(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr{ IP: copyIP(addr.IP), Port: addr.Port, Zone: addr.Zone }
+}
+
+// localUDPAddr is the address to dial from, nil if ip is not set
+func localUDPAddr(ip net.IP) *net.UDPAddr {
+	if ip == nil {
+		return nil
+	}
+	return &net.UDPAddr{ IP: ip }
 }
 
 func equalUDPAddr(l, r *net.UDPAddr) bool {
@@ -37,13 +58,16 @@ func equalUDPAddr(l, r *net.UDPAddr) bool {
 	return l.IP.Equal(r.IP) && l.Port == r.Port
 }
 
-func initUDPTunnel(listen, connect *net.UDPAddr) (Tunnel, error) {
+func initUDPTunnel(listen, connect *net.UDPAddr, remote string, opts *TunnelOptions) (Tunnel, error) {
 	var conn *net.UDPConn
 	var err error
+	var v6 bool
 	if listen == nil {
-		conn, err = net.DialUDP("udp4", nil, connect)
+		v6 = isIPv6(connect.IP)
+		conn, err = net.DialUDP(underlayNetwork("udp", connect.IP), localUDPAddr(opts.getLocal()), connect)
 	} else {
-		conn, err = net.ListenUDP("udp4", listen)
+		v6 = isIPv6(listen.IP)
+		conn, err = net.ListenUDP(underlayNetwork("udp", listen.IP), listen)
 	}
 	if err != nil {
 		return nil, err
@@ -54,7 +78,7 @@ func initUDPTunnel(listen, connect *net.UDPAddr) (Tunnel, error) {
 		return nil, err
 	}
 
-	sendCh := make(chan []byte, udpTxLength)
+	queue := NewSendQueue("udp_tunnel", tunnelQueueLength, sendQueuePolicy)
 
 	destination := connect
 	if destination == nil {
@@ -62,102 +86,299 @@ func initUDPTunnel(listen, connect *net.UDPAddr) (Tunnel, error) {
 	}
 
 	tunnel := UDPTunnelImpl{
-		sendCh, nil, ipv4.NewPacketConn(conn), destination, connect != nil,
+		queue, nil, atomic.Value{}, v6, atomic.Value{}, connect != nil, opts.getObscurer(), NewReplayWindow(), nil, nil, nil, remote, opts.getLocal(), nil, nil, nil, NewReassembler(), opts.getOnUndeliverable(),
+	}
+	tunnel.fecEncoder, tunnel.fecDecoder = opts.newFEC()
+	tunnel.conn.Store(newBatchConn(conn, v6))
+	tunnel.destination.Store(destination)
+	if !tunnel.preConnected {
+		tunnel.sessions = NewSessionTable(&tunnel, opts.getAuth(), opts.getSessionTimeout())
+	} else {
+		if credential := opts.getCredential(); credential != nil {
+			tunnel.handshake = newClientHandshake(*credential, func(msg []byte) { tunnel.sendTo(nil, nil, msg) }, opts.getOnLease())
+		}
+		// keepalives and hellos are sent sized by the path MTU, which is set first
+		tunnel.pmtu = opts.newPathMTU(conn, v6, tunnel.handshake.Established, tunnel.sendProbe, tunnel.payloadMTU)
+		tunnel.keepalive = opts.newKeepalive(func(msg []byte) { tunnel.sendTo(nil, tunnel.handshake.Obscurer(), msg) }, tunnel.reconnect)
+		tunnel.handshake.start()
 	}
 	go tunnel.send()
 	go tunnel.receive()
 	return &tunnel, nil
 }
 
-func UDPConnect(addr string, port uint16) (Tunnel, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%v", addr, port))
+func UDPConnect(addr string, port uint16, opts *TunnelOptions) (Tunnel, error) {
+	remote := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	udpAddr, err := net.ResolveUDPAddr("udp", remote)
 	if err != nil {
 		return nil, err
 	}
-	return initUDPTunnel(nil, udpAddr)
+	return initUDPTunnel(nil, udpAddr, remote, opts)
 }
 
-func UDPListen(addr string, port uint16) (Tunnel, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%v", addr, port))
+func UDPListen(addr string, port uint16, opts *TunnelOptions) (Tunnel, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(addr, strconv.Itoa(int(port))))
 	if err != nil {
 		return nil, err
 	}
-	return initUDPTunnel(udpAddr, nil)
+	return initUDPTunnel(udpAddr, nil, "", opts)
+}
+
+func (t *UDPTunnelImpl) getConn() batchConn {
+	return t.conn.Load().(batchConn)
+}
+
+func (t *UDPTunnelImpl) getDestination() *net.UDPAddr {
+	return t.destination.Load().(*net.UDPAddr)
+}
+
+func (t *UDPTunnelImpl) currentDestination() string {
+	return t.getDestination().String()
+}
+
+// reconnect resolves the server again and dials it from a new port, so that
+// a stale NAT mapping or a moved server is left behind. The address family is
+// kept as the framing depends on it
+func (t *UDPTunnelImpl) reconnect() {
+	udpAddr, err := net.ResolveUDPAddr(underlayNetwork("udp", t.getDestination().IP), t.remote)
+	if err != nil {
+		Error.Printf("Failed to resolve %v, err: %v\n", t.remote, err)
+		return
+	}
+	conn, err := net.DialUDP(underlayNetwork("udp", udpAddr.IP), localUDPAddr(t.local), udpAddr)
+	if err != nil {
+		Error.Printf("Failed to re-dial to %v, err: %v\n", udpAddr, err)
+		return
+	}
+	if err = conn.SetWriteBuffer(256 * 1024); err != nil {
+		Error.Printf("Failed to set write buffer, err: %v\n", err)
+	}
+	if t.pmtu != nil {
+		if err = setDontFragment(conn, t.v6); err != nil {
+			Error.Printf("Failed to set don't fragment, err: %v\n", err)
+		}
+		t.pmtu.Restart()
+	}
+	old := t.getConn()
+	t.destination.Store(udpAddr)
+	t.conn.Store(newBatchConn(conn, t.v6))
+	if err = old.Close(); err != nil {
+		Error.Printf("Failed to close old connection, err: %v\n", err)
+	}
+	tunnelDestinationChanges.Inc()
+	Info.Printf("tunnel reconnected to %v\n", udpAddr)
+	if t.handshake != nil {
+		t.handshake.Restart()
+	}
 }
 
 func (t *UDPTunnelImpl) Send(content []byte) {
-	t.sendCh <- t.obscure(content)
+	if !t.preConnected {
+		Warning.Printf("No destination, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableNet, 0)
+		return
+	}
+	if !t.handshake.Established() {
+		Debug.Printf("Handshake not established, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableHost, 0)
+		return
+	}
+	t.sendTo(nil, t.handshake.Obscurer(), content)
+}
+
+func (t *UDPTunnelImpl) sendTo(addr net.Addr, sealer Obscurer, content []byte) {
+	priority := isPriorityPacket(content)
+	if len(content) <= t.payloadMTU() {
+		t.sendPacket(addr, sealer, content, content, priority)
+		return
+	}
+	fragments := fragmentToFit(content, t.payloadMTU())
+	if fragments == nil {
+		t.undeliverable.report(content, unreachableTooBig, t.payloadMTU())
+	}
+	for _, packet := range fragments {
+		if !t.sendPacket(addr, sealer, content, packet, priority) {
+			return
+		}
+	}
+}
+
+// sendPacket queues packet, content or a fragment of it, content is reported
+// undeliverable if packet is not queued. With FEC packets other than control
+// messages are sealed by the writer once encoded, along with their FEC header
+func (t *UDPTunnelImpl) sendPacket(addr net.Addr, sealer Obscurer, content, packet []byte, priority bool) bool {
+	queued := outPacket{ nil, addr, nil }
+	if t.fecEncoder != nil && !isControl(packet) {
+		queued.data, queued.seal = copyBytes(packet), sealerOf(t.obscurer, sealer, packet)
+		if queued.seal == nil {
+			queued.seal = xorObscurer{}
+		}
+	} else if queued.data = t.obscure(sealer, packet); queued.data == nil {
+		t.undeliverable.report(content, unreachableTooBig, t.payloadMTU())
+		return false
+	}
+	if !t.queue.Push(queued, priority) {
+		putPacketBuffer(queued.data)
+		Debug.Printf("Send queue full, skip %v bytes\n", len(content))
+		t.undeliverable.report(content, unreachableHost, 0)
+		return false
+	}
+	return true
+}
+
+// sendProbe sends a path MTU probe in an IP packet of size bytes
+func (t *UDPTunnelImpl) sendProbe(size int) {
+	// probes are control messages, which are not FEC encoded
+	mss := size - underlayHeaderLength(t.v6) - 8
+	probe := pmtuProbe(size, mss - obscurerOverhead(t.obscurer))
+	if probe == nil {
+		return
+	}
+	if obscured := obscureWith(sealerOf(t.obscurer, t.handshake.Obscurer(), probe), mss, probe); obscured != nil {
+		t.queue.Push(outPacket{ obscured, nil, nil }, false)
+	}
+}
+
+// tooLarge takes a datagram the interface MTU is too small for
+func (t *UDPTunnelImpl) tooLarge(datagram []byte) {
+	t.pmtu.TooLarge(len(datagram) + underlayHeaderLength(t.v6) + 8)
+}
+
+// Alive tells whether the server is handshaked and heard from recently
+func (t *UDPTunnelImpl) Alive() bool {
+	return t.handshake.Established() && t.keepalive.Alive()
 }
 
 func (t *UDPTunnelImpl) SetHandler(handler func (Tunnel, []byte)) {
 	t.handler = handler
 }
 
-func (t *UDPTunnelImpl) obscure(packet []byte) []byte {
-	ret, err := obscure(1492 - 20 - 8, packet)
-	if err != nil {
-		Error.Printf("Error when obscure packet: %v\n", err)
-		return nil
+// mss is the largest obscured packet fitting into the path MTU
+func (t *UDPTunnelImpl) mss() int {
+	return t.pmtu.MTU() - underlayHeaderLength(t.v6) - 8 - t.fecEncoder.Overhead()
+}
+
+// payloadMTU is the largest packet carried without fragmenting it
+func (t *UDPTunnelImpl) payloadMTU() int {
+	return t.mss() - obscurerOverhead(t.obscurer)
+}
+
+// obscure seals packet into a pooled buffer, handed back once sent
+func (t *UDPTunnelImpl) obscure(sealer Obscurer, packet []byte) []byte {
+	buf := getPacketBuffer()
+	obscured := obscureInto(sealerOf(t.obscurer, sealer, packet), buf, t.mss(), packet)
+	if !samePlace(obscured, buf) {
+		putPacketBuffer(buf)
 	}
-	return ret
+	return obscured
 }
 
 func (t *UDPTunnelImpl) restore(packet []byte) []byte {
-	ret, err := restore(packet)
-	if err != nil {
-		Error.Printf("Error when restore packet: %v\n", err)
-		return nil
-	}
-	return ret
+	return restoreFromServer(t.obscurer, t.replay, t.handshake, packet)
 }
 
+// send batches the queued packets, with FEC each of them is sent as a data
+// shard and parity shards follow every group
 func (t *UDPTunnelImpl) send() {
 	messages := make([]ipv4.Message, udpTxLength)
 	for i := 0; i < len(messages); i++ {
 		messages[i].Buffers = [][]byte { nil }
-		if !t.preConnected {
-			messages[i].Addr = t.destination
-		}
+	}
+	var flush <-chan time.Time
+	if t.fecEncoder != nil {
+		flush = time.Tick(fecFlushDelay / 2)
 	}
 
+	batch := make([]outPacket, 0, udpTxLength)
 	for {
-		count := 0
-		bytes := 0
-
-		toSend := <- t.sendCh
-		messages[count].Buffers[0] = toSend
-		count++
-		bytes += len(toSend)
-	getToSendLoop:
-		for {
-			if count >= len(messages) {
+		batch = batch[:0]
+		select {
+		case <- t.queue.Ready():
+		case now := <- flush:
+			batch = t.fecEncoder.Flush(batch, now)
+		}
+		for len(batch) < len(messages) {
+			toSend, ok := t.queue.Pop()
+			if !ok {
 				break
 			}
-			select {
-			case toSend := <- t.sendCh:
-				messages[count].Buffers[0] = toSend
-				count++
-				bytes += len(toSend)
-			default:
-				break getToSendLoop
+			batch = t.fecEncoder.Encode(batch, toSend)
+		}
+		if batch = t.seal(batch); len(batch) > 0 {
+			t.writeBatch(messages, batch)
+		}
+		for _, sent := range batch {
+			putPacketBuffer(sent.data)
+		}
+	}
+}
+
+// seal obscures the datagrams FEC encoded into pooled buffers, those failing
+// to are left out
+func (t *UDPTunnelImpl) seal(batch []outPacket) []outPacket {
+	sealed := batch[:0]
+	for _, packet := range batch {
+		if packet.seal != nil {
+			buf := getPacketBuffer()
+			obscured := obscureInto(packet.seal, buf, t.mss() + t.fecEncoder.Overhead(), packet.data)
+			if !samePlace(obscured, buf) {
+				putPacketBuffer(buf)
+			}
+			if obscured == nil {
+				continue
 			}
+			packet.data, packet.seal = obscured, nil
 		}
+		sealed = append(sealed, packet)
+	}
+	return sealed
+}
 
-		if t.destination.Port == 0 {
-			Warning.Printf("No destination, skip %v bytes\n", bytes)
-			continue
+func (t *UDPTunnelImpl) writeBatch(messages []ipv4.Message, batch []outPacket) {
+	for len(batch) > 0 {
+		count := 0
+		bytes := 0
+		for ; count < len(messages) && count < len(batch); count++ {
+			messages[count].Buffers[0] = batch[count].data
+			messages[count].Addr = batch[count].addr
+			bytes += len(batch[count].data)
 		}
 
-		msgSent := 0
-		for msgSent < count {
-			n, err := t.conn.WriteBatch(messages[msgSent:count], 0)
-			if err != nil {
-				Error.Printf("Failed to send to %v, err: %v\n", t.destination, err)
-				break
+		if _, err := writeMessages(t.getConn(), messages[:count], t.tooLarge); err != nil {
+			Error.Printf("Failed to send to %v, err: %v\n", t.getDestination(), err)
+		}
+		Debug.Printf("sent to %v %d bytes\n", t.getDestination(), bytes)
+		batch = batch[count:]
+	}
+}
+
+func (t *UDPTunnelImpl) received(remoteAddr *net.UDPAddr, datagram []byte) {
+	if t.preConnected {
+		received := t.restore(datagram)
+		if received == nil {
+			return
+		}
+		t.keepalive.Received()
+		if t.pmtu.Handle(received) {
+			return
+		}
+		for _, packet := range t.fecDecoder.Decode("", received) {
+			if packet = t.reassembler.Reassemble("", packet); packet != nil {
+				dispatch(t, t.handshake, t.handler, packet)
+			}
+		}
+	} else {
+		// only authenticated packets are allowed to create a session
+		session, received := t.sessions.Receive(remoteAddr.String(), copyUDPAddr(remoteAddr), datagram, t.obscurer)
+		if received == nil {
+			return
+		}
+		// FEC shards are kept only once restored, spoofed ones never pass
+		for _, packet := range t.fecDecoder.Decode(remoteAddr.String(), received) {
+			if packet = t.reassembler.Reassemble(remoteAddr.String(), packet); packet != nil {
+				dispatch(session, nil, t.handler, packet)
 			}
-			msgSent += n
 		}
-		Debug.Printf("sent to %v %d bytes\n", t.destination, bytes)
 	}
 }
 
@@ -168,37 +389,26 @@ func (t *UDPTunnelImpl) receive() {
 		messages[i].N = len(messages[i].Buffers[0])
 	}
 	for {
-		n, err := t.conn.ReadBatch(messages[:], ReadBatchFlags)
+		n, err := t.getConn().ReadBatch(messages[:], ReadBatchFlags)
 		if err != nil {
 			Error.Printf("Failed to receive, err: %v\n", err)
 			continue
 		}
 
-		if t.handler == nil {
-			Warning.Printf("no receive handler set, ignored %d * N bytes", n)
-			continue
-		}
-
 		for i := 0; i < n; i++ {
 			msg := &messages[i]
 			remoteAddr := msg.Addr.(*net.UDPAddr)
-			if !equalUDPAddr(remoteAddr, t.destination) {
-				if t.preConnected {
-					Error.Printf("cannot change destination from %v to %v\n", t.destination, remoteAddr)
-					break
-				} else {
-					Info.Printf("tunnel destination changed from %v to %v\n", t.destination, remoteAddr)
-					dupUDPAddr(t.destination, remoteAddr)
-				}
-			}
 			if len(msg.Buffers) != 1 {
 				Error.Printf("Bad msg Buffers size: %d, Flags: %d\n", len(msg.Buffers), msg.Flags)
 				continue
 			}
-			received := t.restore(msg.Buffers[0][:msg.N])
-			if received != nil {
-				t.handler(t, received)
+			if t.preConnected {
+				if destination := t.getDestination(); !equalUDPAddr(remoteAddr, destination) {
+					Error.Printf("cannot change destination from %v to %v\n", destination, remoteAddr)
+					break
+				}
 			}
+			t.received(remoteAddr, msg.Buffers[0][:msg.N])
 
 			Debug.Printf("received from %v %d bytes\n", remoteAddr, msg.N)
 			msg.N = len(msg.Buffers[0])
@@ -16,7 +16,7 @@ func TestObscureRestore(t *testing.T) {
 		o := make([]byte, length)
 		rand.Read(o)
 		tun := &UDPTunnelImpl{}
-		s := tun.restore(tun.obscure(o))
+		s := tun.restore(tun.obscure(nil, o))
 
 		if !bytes.Equal(o, s) {
 			t.Errorf("failed to obscure then restore payload of %d bytes", length)
@@ -38,12 +38,12 @@ func TestEcho(t *testing.T) {
 	}
 
 	var err error
-	t0, err := UDPListen("127.0.0.1", 11111)
+	t0, err := UDPListen("127.0.0.1", 11111, nil)
 	if err != nil {
 		t.Errorf("Failed to listen UDP: %v", err)
 	}
 	t0.SetHandler(handler)
-	t1, err := UDPConnect("127.0.0.1", 11111)
+	t1, err := UDPConnect("127.0.0.1", 11111, nil)
 	if err != nil {
 		t.Errorf("Failed to connect UDP: %v", err)
 	}
@@ -66,3 +66,72 @@ func TestEcho(t *testing.T) {
 	}
 }
 
+
+func TestMultiClient(t *testing.T) {
+	server, err := UDPListen("127.0.0.1", 11112, nil)
+	if err != nil {
+		t.Fatalf("Failed to listen UDP: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, b []byte) {
+		session.Send(append([]byte("echo "), b...))
+	})
+
+	clients := []string { "alice", "bob", "carol" }
+	results := make(chan string, len(clients))
+	for _, name := range clients {
+		client, err := UDPConnect("127.0.0.1", 11112, nil)
+		if err != nil {
+			t.Fatalf("Failed to connect UDP: %v", err)
+		}
+		expect := "echo " + name
+		client.SetHandler(func(_ Tunnel, b []byte) {
+			if string(b) != expect {
+				t.Errorf("Want %s but got %s", expect, string(b))
+			}
+			results <- string(b)
+		})
+		client.Send([]byte(name))
+	}
+
+	for range clients {
+		select {
+		case <-results:
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for echo")
+		}
+	}
+	if n := len(server.(*UDPTunnelImpl).sessions.Sessions()); n != len(clients) {
+		t.Errorf("Want %d sessions but got %d", len(clients), n)
+	}
+}
+
+func TestIPv6Underlay(t *testing.T) {
+	server, err := UDPListen("::1", 11114, nil)
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	server.SetHandler(func(session Tunnel, b []byte) {
+		session.Send(append([]byte("echo "), b...))
+	})
+	client, err := UDPConnect("::1", 11114, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect UDP: %v", err)
+	}
+	result := make(chan string, 1)
+	client.SetHandler(func(_ Tunnel, b []byte) {
+		result <- string(b)
+	})
+	client.Send([]byte("hello"))
+
+	select {
+	case r := <-result:
+		if r != "echo hello" {
+			t.Errorf("Expect echo hello but got %s", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Timeout waiting for echo over IPv6")
+	}
+	if !client.(*UDPTunnelImpl).v6 {
+		t.Errorf("Expect IPv6 underlay")
+	}
+}
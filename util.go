@@ -5,18 +5,37 @@ import (
 	"fmt"
 	"github.com/google/gopacket/layers"
 	"net"
+	"os/exec"
 )
 
 func copyIP(ip net.IP) net.IP {
 	return copyBytes(ip)
 }
 
+// ipKey makes IPv4 and IPv6 addresses usable as map keys, an IPv4 address is
+// keyed by its IPv4-mapped IPv6 form
+type ipKey [16]byte
+
+func toIPKey(ip net.IP) ipKey {
+	var key ipKey
+	copy(key[:], ip.To16())
+	return key
+}
+
 func copyBytes(content []byte) []byte {
 	dup := make([]byte, len(content))
 	copy(dup, content)
 	return dup
 }
 
+func runCommand(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %v, %s", name, args, err, output)
+	}
+	return nil
+}
+
 func UpdateIpv4Checksum(ipv4 *layers.IPv4) {
 	bytes := ipv4.Contents
 
@@ -44,3 +63,67 @@ func UpdateIpv4Checksum(ipv4 *layers.IPv4) {
 	fmt.Println("new", ipv4.Checksum)
 	binary.BigEndian.PutUint16(bytes[10:], ipv4.Checksum)
 }
+
+// packetSrcIP returns the source address of an IPv4 or IPv6 packet without copying
+func packetSrcIP(packet []byte) net.IP {
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		return packet[12:16]
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		return packet[8:24]
+	}
+	return nil
+}
+
+// packetDstIP returns the destination address of an IPv4 or IPv6 packet without copying
+func packetDstIP(packet []byte) net.IP {
+	if len(packet) >= 20 && packet[0] >> 4 == 4 {
+		return packet[16:20]
+	} else if len(packet) >= 40 && packet[0] >> 4 == 6 {
+		return packet[24:40]
+	}
+	return nil
+}
+
+// checksumAdd folds data into a ones' complement sum started from sum
+func checksumAdd(sum uint32, data []byte) uint32 {
+	n := len(data) / 2 * 2
+	for i := 0; i < n; i += 2 {
+		sum += uint32(data[i]) << 8 | uint32(data[i+1])
+	}
+	if n < len(data) {
+		sum += uint32(data[n]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderChecksum is the TCP/UDP checksum of segment sent from src to dst
+func pseudoHeaderChecksum(src, dst net.IP, protocol uint8, segment []byte) uint16 {
+	var sum uint32
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		sum = checksumAdd(sum, src4)
+		sum = checksumAdd(sum, dst4)
+	} else {
+		sum = checksumAdd(sum, src.To16())
+		sum = checksumAdd(sum, dst.To16())
+	}
+	sum += uint32(protocol) + uint32(len(segment))
+	return checksumFold(checksumAdd(sum, segment))
+}
+
+// checksumUpdate adjusts checksum for old bytes, starting at an even offset
+// of what it covers, replaced by new ones of the same length. This is
+// HC' = ~(~HC + ~m + m') of RFC 1624, m being every 16 bits changed
+func checksumUpdate(checksum uint16, old, new []byte) uint16 {
+	sum := uint32(^checksum)
+	for i := 0; i + 1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:])) + uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	return checksumFold(sum)
+}